@@ -1,5 +1,8 @@
 module github.com/jbowtie/ratago
 
-go 1.14
+go 1.16
 
-require github.com/jbowtie/gokogiri v0.0.0-20190301021639-37f655d3078f
+require (
+	github.com/jbowtie/gokogiri v0.0.0-20190301021639-37f655d3078f
+	golang.org/x/text v0.13.0
+)
@@ -15,6 +15,7 @@ func usage() {
 }
 
 var indent = flag.Bool("indent", false, "Attempt to indent any XML output")
+var stableIds = flag.Bool("stable-ids", false, "Number the IDs from generate-id() in document order, so they are the same on every run")
 
 func main() {
 	flag.Usage = usage
@@ -46,14 +47,15 @@ func main() {
 		fmt.Println(err)
 		return
 	}
+	defer stylesheet.Close()
 
-	options := xslt.StylesheetOptions{*indent, nil}
+	//report recoverable errors but carry on
+	warn := func(e *xslt.TransformError) { fmt.Fprintln(os.Stderr, e) }
+	options := xslt.StylesheetOptions{IndentOutput: *indent, ErrorHandler: warn, StableIds: *stableIds}
 
-	output, err := stylesheet.Process(doc, options)
+	err = stylesheet.ProcessTo(doc, os.Stdout, options)
 	if err != nil {
-		fmt.Println(err)
-		return
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-
-	fmt.Println(output)
 }
@@ -1,27 +1,45 @@
 package xslt
 
 import (
-	"container/list"
 	"errors"
 	"fmt"
 	"github.com/jbowtie/gokogiri/xml"
 	"github.com/jbowtie/gokogiri/xpath"
-	"path/filepath"
+	"os"
+	"sort"
 	"strings"
 	"unsafe"
 )
 
 // ExecutionContext is passed to XSLT instructions during processing.
 type ExecutionContext struct {
-	Style          *Stylesheet                 // The master stylesheet
-	Output         xml.Document                // The output document
-	Source         xml.Document                // The source input document
-	OutputNode     xml.Node                    // The current output node
-	Current        xml.Node                    // The node that will be returned for "current()"
-	XPathContext   *xpath.XPath                //the XPath context
-	Mode           string                      //The current template mode
-	Stack          list.List                   //stack used for scoping local variables
-	InputDocuments map[string]*xml.XmlDocument //additional input documents via document()
+	Style           *Stylesheet                 // The master stylesheet
+	Output          xml.Document                // The output document
+	Source          xml.Document                // The source input document
+	OutputNode      xml.Node                    // The current output node
+	Current         xml.Node                    // The node that will be returned for "current()"
+	XPathContext    *xpath.XPath                //the XPath context
+	Mode            string                      //The current template mode
+	CurrentTemplate *Template                   //The current template rule, used by xsl:apply-imports
+	bindings        []binding                   //the local variables and parameters in scope, innermost last
+	frame           int                         //where the bindings of the current template invocation start
+	tailCall        *tailCall                   //a call-template to be made by the calling template, if set
+	InputDocuments  map[string]*xml.XmlDocument //additional input documents via document()
+	variables       map[*Variable]interface{}   //the values of the global variables evaluated so far
+	evaluating      map[*Variable]bool          //the global variables being evaluated, to detect circular definitions
+	parameters      map[string]interface{}      //values supplied for global parameters, by expanded name
+	sourceNode      xml.Node                    //the document node of the source, the context for global variables
+	keys            map[keyIndexID]*keyIndex    //the key indexes built so far, for each tree
+	resolver        URIResolver                 //loads documents for document()
+	errorHandler    func(*TransformError)       //receives recoverable errors, if set
+	err             *TransformError             //the first recoverable error when there is no handler
+	fatal           *TransformError             //a non-recoverable error raised during an XPath evaluation
+	nesting         int                         //the number of XPath evaluations in progress
+	warningHandler  func(*TransformError)       //receives warnings, if set
+	conflicts       ConflictMode                //how to handle ambiguous template rule matches
+	stableIds       bool                        //number the IDs from generate-id() in document order
+	nodeOrder       map[unsafe.Pointer]int      //the position in document order of the nodes numbered so far
+	instruction     xml.Node                    //the stylesheet element whose expressions are being evaluated
 }
 
 func (context *ExecutionContext) EvalXPath(xmlNode xml.Node, data interface{}) (result interface{}, err error) {
@@ -36,9 +54,18 @@ func (context *ExecutionContext) EvalXPath(xmlNode xml.Node, data interface{}) (
 	case []byte:
 		result, err = context.EvalXPath(xmlNode, string(data))
 	case *xpath.Expression:
+		if data == nil {
+			return nil, errors.New("cannot evaluate an xpath that failed to compile")
+		}
 		xpathCtx := context.XPathContext
 		xpathCtx.SetResolver(context)
+		context.nesting++
 		err := xpathCtx.Evaluate(xmlNode.NodePtr(), data)
+		context.nesting--
+		if context.fatal != nil && context.nesting == 0 {
+			// back from libxml, so the error can unwind to Process
+			panic(context.fatal)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -67,17 +94,127 @@ func (context *ExecutionContext) EvalXPath(xmlNode xml.Node, data interface{}) (
 	return
 }
 
+// The context node of the XPath expression being evaluated, for functions
+// such as key() and generate-id() that depend on it.
+func (context *ExecutionContext) xpathContextNode() xml.Node {
+	node := xpathContextNodePtr(unsafe.Pointer(context.XPathContext.ContextPtr))
+	if node == nil {
+		return nil
+	}
+	return context.wrapNode(node)
+}
+
+// Wrap a node returned by libxml, associating it with the document that
+// contains it: the source, a stylesheet module, a document loaded with
+// document() or, for result tree fragments, the output.
+func (context *ExecutionContext) wrapNode(ptr unsafe.Pointer) xml.Node {
+	return xml.NewNode(ptr, context.ownerDocument(treeRoot(xml.NewNode(ptr, nil))))
+}
+
+// The document a tree belongs to: the source document, a stylesheet
+// module, a document loaded with document(), or the output document for
+// result tree fragments.
+func (context *ExecutionContext) ownerDocument(root xml.Node) xml.Document {
+	ptr := root.NodePtr()
+	if ptr == context.Source.DocPtr() {
+		return context.Source
+	}
+	if doc := context.Style.moduleDocument(ptr); doc != nil {
+		return doc
+	}
+	for _, doc := range context.InputDocuments {
+		if ptr == doc.DocPtr() {
+			return doc
+		}
+	}
+	return context.Output
+}
+
+// The base URI of a node: the URI of its document, adjusted by any xml:base
+// attributes on the node and its ancestors.
+func (context *ExecutionContext) baseURI(node xml.Node) string {
+	var bases []string
+	root := node
+	for n := node; n != nil; n = n.Parent() {
+		if n.NodeType() == xml.XML_ELEMENT_NODE {
+			for _, attr := range n.AttributeList() {
+				if attr.Name() == "base" && attr.Namespace() == XML_NAMESPACE {
+					bases = append(bases, attr.Value())
+				}
+			}
+		}
+		root = n
+	}
+	// the principal stylesheet module may have been parsed from memory
+	base := context.ownerDocument(root).Uri()
+	if root.NodePtr() == context.Style.Doc.DocPtr() {
+		base = context.Style.uri
+	}
+	for i := len(bases) - 1; i >= 0; i-- {
+		base = resolveURI(bases[i], base)
+	}
+	return base
+}
+
+// The ID returned by generate-id() for node. By default it is derived from
+// the address of the node, which changes from run to run. With stable IDs
+// it is the position of the node in document order, so a transformation
+// produces the same IDs every time it is run on the same input.
+func (context *ExecutionContext) generateId(node xml.Node) string {
+	// namespace nodes aren't part of the tree, so they can't be numbered
+	if !context.stableIds || node.NodeType() == xml.XML_NAMESPACE_DECL {
+		return fmt.Sprintf("N%v", uintptr(node.NodePtr()))
+	}
+	return fmt.Sprintf("N%d", context.nodeNumber(node))
+}
+
+// The position of node in document order. The nodes of a tree are numbered
+// the first time one of them is needed, and trees are ordered by when that
+// happens.
+func (context *ExecutionContext) nodeNumber(node xml.Node) int {
+	if n, ok := context.nodeOrder[node.NodePtr()]; ok {
+		return n
+	}
+	if context.nodeOrder == nil {
+		context.nodeOrder = make(map[unsafe.Pointer]int)
+	}
+	// nodes numbered earlier keep their numbers; a result tree fragment
+	// may have grown since it was numbered
+	add := func(n xml.Node) {
+		if _, ok := context.nodeOrder[n.NodePtr()]; !ok {
+			context.nodeOrder[n.NodePtr()] = len(context.nodeOrder)
+		}
+	}
+	var number func(n xml.Node)
+	number = func(n xml.Node) {
+		add(n)
+		if n.NodeType() == xml.XML_ELEMENT_NODE {
+			for _, attr := range n.AttributeList() {
+				add(attr)
+			}
+		}
+		for cur := n.FirstChild(); cur != nil; cur = cur.NextSibling() {
+			number(cur)
+		}
+	}
+	number(treeRoot(node))
+	return context.nodeOrder[node.NodePtr()]
+}
+
 // Register the namespaces in scope with libxml2 so that XPaths with namespaces
-// are resolved correctly.
+// are resolved correctly. The stylesheet node is also remembered as the one
+// containing the expressions about to be evaluated, whose base URI is used
+// by document().
 //
 // libxml2 probably already makes this info available
 func (context *ExecutionContext) RegisterXPathNamespaces(node xml.Node) (err error) {
+	context.instruction = node
 	seen := make(map[string]bool)
 	for n := node; n != nil; n = n.Parent() {
 		for _, decl := range n.DeclaredNamespaces() {
 			alreadySeen, _ := seen[decl.Prefix]
 			if !alreadySeen {
-				context.XPathContext.RegisterNamespace(decl.Prefix, decl.Uri)
+				context.Style.registerXPathNamespace(context.XPathContext, decl.Prefix, decl.Uri)
 				seen[decl.Prefix] = true
 			}
 		}
@@ -85,6 +222,23 @@ func (context *ExecutionContext) RegisterXPathNamespaces(node xml.Node) (err err
 	return
 }
 
+// Resolve a QName passed as a string to an XPath function (such as
+// function-available) using the namespaces in scope on the stylesheet
+// element containing the expression. Unprefixed names are in no namespace.
+func (context *ExecutionContext) resolveXPathQName(qname string) (ns, name string, ok bool) {
+	colon := strings.Index(qname, ":")
+	if colon < 0 {
+		return "", qname, true
+	}
+	prefix := qname[:colon]
+	name = qname[colon+1:]
+	if prefix == "xml" {
+		return XML_NAMESPACE, name, true
+	}
+	ns = lookupPrefix(context.instruction, prefix)
+	return ns, name, ns != ""
+}
+
 // Attempt to map a prefix to a URI.
 func (context *ExecutionContext) LookupNamespace(prefix string, node xml.Node) (uri string) {
 	//if given a context node, see if the prefix is in scope
@@ -143,15 +297,10 @@ func (context *ExecutionContext) EvalXPathAsString(xmlNode xml.Node, data interf
 	return
 }
 
-// ChildrenOf returns the node children, ignoring any whitespace-only text nodes that
-// are stripped by strip-space or xml:space
+// ChildrenOf returns the node children. Whitespace has already been stripped
+// from the trees that strip-space applies to.
 func (context *ExecutionContext) ChildrenOf(node xml.Node) (children []xml.Node) {
-
 	for cur := node.FirstChild(); cur != nil; cur = cur.NextSibling() {
-		//don't count stripped nodes
-		if context.ShouldStrip(cur) {
-			continue
-		}
 		children = append(children, cur)
 	}
 	return
@@ -161,41 +310,27 @@ func (context *ExecutionContext) ChildrenOf(node xml.Node) (children []xml.Node)
 // and returns true if a node is a whitespace-only text node that should
 // be stripped.
 func (context *ExecutionContext) ShouldStrip(xmlNode xml.Node) bool {
-	if xmlNode.NodeType() != xml.XML_TEXT_NODE {
+	if xmlNode.NodeType() != xml.XML_TEXT_NODE && xmlNode.NodeType() != xml.XML_CDATA_SECTION_NODE {
 		return false
 	}
 	if !IsBlank(xmlNode) {
 		return false
 	}
-	//do we have a match in strip-space?
-	elem := xmlNode.Parent().Name()
-	ns := xmlNode.Parent().Namespace()
-	for _, pat := range context.Style.StripSpace {
-		if pat == elem {
-			return true
-		}
-		if pat == "*" {
-			return true
-		}
-		if strings.Contains(pat, ":") {
-			uri, name := context.ResolveQName(pat)
-			if uri == ns {
-				if name == elem || name == "*" {
-					return true
-				}
-			}
-		}
+	parent := xmlNode.Parent()
+	if parent == nil || parent.NodeType() != xml.XML_ELEMENT_NODE {
+		return false
 	}
-	//do we have a match in preserve-space?
-	//resolve conflicts by priority (QName, ns:*, *)
-	//return a value
-	return false
+	if strip, _ := context.Style.stripsSpace(parent); !strip {
+		return false
+	}
+	// xml:space="preserve" on the element or an ancestor overrides strip-space
+	return xmlSpace(parent) != "preserve"
 }
 
 func (context *ExecutionContext) ResolveQName(qname string) (ns, name string) {
 	if !strings.Contains(qname, ":") {
 		//TODO: lookup default namespace
-		return "", name
+		return "", qname
 	}
 	parts := strings.Split(qname, ":")
 	for uri, prefix := range context.Style.NamespaceMapping {
@@ -224,14 +359,31 @@ func (context *ExecutionContext) UseCDataSection(node xml.Node) bool {
 	return false
 }
 
-func (context *ExecutionContext) ResolveVariable(name, ns string) (ret interface{}) {
-	v := context.FindVariable(name, ns)
+// A value bound to a local variable or parameter.
+type binding struct {
+	namespace string
+	name      string
+	value     interface{}
+}
 
-	if v == nil {
-		return
+// A call to a named template in tail position, which the calling template
+// makes once its own instructions are done.
+type tailCall struct {
+	template *Template
+	params   []binding
+}
+
+func (context *ExecutionContext) ResolveVariable(name, ns string) (ret interface{}) {
+	val, ok := context.lookupLocal(name, ns)
+	if !ok {
+		v := context.Style.lookupVariable(ns, name)
+		if v == nil {
+			return
+		}
+		val = context.VariableValue(v)
 	}
 
-	switch val := v.Value.(type) {
+	switch val := val.(type) {
 	case xml.Nodeset:
 		return unsafe.Pointer(val.ToXPathNodeset())
 	case []xml.Node:
@@ -242,57 +394,84 @@ func (context *ExecutionContext) ResolveVariable(name, ns string) (ret interface
 	}
 }
 
-func (context *ExecutionContext) FindVariable(name, ns string) (ret *Variable) {
-	//consult local vars
-	//consult local params
-	v := context.LookupLocalVariable(name, ns)
-	if v != nil {
-		return v
+// VariableValue returns the value of a global variable or parameter
+// during this transformation. The compiled Variable itself is never
+// modified, so a Stylesheet can be shared by concurrent transformations.
+//
+// Global variables are evaluated the first time they are referenced, with
+// the document node of the source as the context node. A parameter takes
+// the value supplied in the StylesheetOptions, if there is one.
+func (context *ExecutionContext) VariableValue(v *Variable) interface{} {
+	if val, ok := context.variables[v]; ok {
+		return val
 	}
-	//consult global vars (ss)
-	//consult global params (ss)
-	v, ok := context.Style.Variables[name]
-	if ok {
-		return v
+	if context.evaluating[v] {
+		context.raise(newTransformError("XTDE0640", v.Node, nil, nil, "circular definition of variable %s", v.Name))
+		return nil
 	}
-	return nil
+	if v.param {
+		if val, ok := context.parameters[expandedName(v.namespace, v.local)]; ok {
+			context.setVariableValue(v, val)
+			return val
+		}
+	}
+	if context.evaluating == nil {
+		context.evaluating = make(map[*Variable]bool)
+	}
+	context.evaluating[v] = true
+
+	// Variables are usually evaluated while another expression is, so they
+	// get an XPath context of their own (see keyIndex), and none of the
+	// local variables of the instruction being evaluated are in scope.
+	outer, instruction := context.XPathContext, context.instruction
+	current, frame, mode, template := context.Current, context.frame, context.Mode, context.CurrentTemplate
+	context.XPathContext = xpath.NewXPath(context.Source.DocPtr())
+	context.XPathContext.SetContextPosition(1, 1)
+	context.Current, context.frame, context.Mode, context.CurrentTemplate = context.sourceNode, len(context.bindings), "", nil
+	val := v.value(context.sourceNode, context)
+	freeXPath(context.XPathContext)
+	context.XPathContext, context.instruction = outer, instruction
+	context.Current, context.frame, context.Mode, context.CurrentTemplate = current, frame, mode, template
+
+	delete(context.evaluating, v)
+	context.setVariableValue(v, val)
+	return val
 }
 
-func (context *ExecutionContext) DeclareLocalVariable(name, ns string, v *Variable) error {
-	if context.Stack.Len() == 0 {
-		return errors.New("Attempting to declare a local variable without a stack frame")
+// Record the value of a global variable or parameter for the rest of this transformation.
+func (context *ExecutionContext) setVariableValue(v *Variable, val interface{}) {
+	if context.variables == nil {
+		context.variables = make(map[*Variable]interface{})
 	}
-	e := context.Stack.Front()
-	scope := e.Value.(map[string]*Variable)
-	scope[name] = v
-	//fmt.Println("DECLARE", name, v)
-	return nil
+	context.variables[v] = val
 }
 
-func (context *ExecutionContext) LookupLocalVariable(name, ns string) (ret *Variable) {
-	for e := context.Stack.Front(); e != nil; e = e.Next() {
-		scope := e.Value.(map[string]*Variable)
-		v, ok := scope[name]
-		if ok {
-			//fmt.Println("FOUND", name, v)
-			return v
-		}
-	}
-	return
+// Bind a value to a local variable or parameter. The binding is in scope
+// until the sequence constructor or template declaring it is finished.
+func (context *ExecutionContext) bind(ns, name string, value interface{}) {
+	context.bindings = append(context.bindings, binding{ns, name, value})
 }
 
-// create a local scope for variable resolution
-func (context *ExecutionContext) PushStack() {
-	scope := make(map[string]*Variable)
-	context.Stack.PushFront(scope)
+// Leave the scope of the bindings made since mark.
+func (context *ExecutionContext) unbind(mark int) {
+	for i := mark; i < len(context.bindings); i++ {
+		// let the values be collected
+		context.bindings[i] = binding{}
+	}
+	context.bindings = context.bindings[:mark]
 }
 
-// leave the variable scope
-func (context *ExecutionContext) PopStack() {
-	if context.Stack.Len() == 0 {
-		return
+// The value of a local variable or parameter in scope. Only the bindings
+// of the current template invocation are visible; the innermost binding
+// of a name wins.
+func (context *ExecutionContext) lookupLocal(name, ns string) (interface{}, bool) {
+	for i := len(context.bindings) - 1; i >= context.frame; i-- {
+		b := context.bindings[i]
+		if b.name == name && b.namespace == ns {
+			return b.value, true
+		}
 	}
-	context.Stack.Remove(context.Stack.Front())
+	return nil, false
 }
 
 func (context *ExecutionContext) IsFunctionRegistered(name, ns string) bool {
@@ -340,33 +519,155 @@ func (context *ExecutionContext) DeclareStylesheetNamespacesIfRoot(node xml.Node
 	}
 }
 
-func (context *ExecutionContext) FetchInputDocument(loc string, relativeToSource bool) (doc *xml.XmlDocument) {
-	//create the map if needed
-	if context.InputDocuments == nil {
-		context.InputDocuments = make(map[string]*xml.XmlDocument)
+// Report a recoverable error. Processing continues; the error is passed to the
+// ErrorHandler if one was supplied, otherwise the first one is kept so that
+// Process can return it.
+func (context *ExecutionContext) reportError(err *TransformError) {
+	if context.fatal != nil {
+		// the transformation is being abandoned; this is a consequence
+		return
+	}
+	if context.errorHandler != nil {
+		context.errorHandler(err)
+		return
+	}
+	if context.err == nil {
+		context.err = err
+	}
+}
+
+// Raise a non-recoverable error, which stops the transformation. Code
+// called back by libxml during an XPath evaluation can't unwind through it,
+// so the error is raised once the outermost evaluation has returned.
+func (context *ExecutionContext) raise(err *TransformError) {
+	if context.nesting == 0 {
+		panic(err)
 	}
+	if context.fatal == nil {
+		context.fatal = err
+	}
+}
 
+// Report a warning, which does not affect the result of the transformation.
+func (context *ExecutionContext) warn(err *TransformError) {
+	if context.warningHandler != nil {
+		context.warningHandler(err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, "warning:", err)
+}
+
+// Create an element to hold a result tree fragment. Like every other node
+// created during the transformation it belongs to the output document, and
+// is freed along with it.
+func (context *ExecutionContext) createRVT() xml.Node {
+	rvt := context.Output.CreateElementNode("RVT")
+	context.Output.AddUnlinkedNode(rvt.NodePtr())
+	return rvt
+}
+
+// Free the documents loaded by document() during the transformation.
+func (context *ExecutionContext) freeInputDocuments() {
+	for uri, doc := range context.InputDocuments {
+		doc.Free()
+		delete(context.InputDocuments, uri)
+	}
+}
+
+func (context *ExecutionContext) FetchInputDocument(loc string, relativeToSource bool) (doc *xml.XmlDocument) {
 	// rely on caller to tell us how to resolve relative paths
-	base := ""
+	base := context.Style.uri
 	if relativeToSource {
-		base, _ = filepath.Abs(filepath.Dir(context.Source.Uri()))
-	} else {
-		base, _ = filepath.Abs(filepath.Dir(context.Style.Doc.Uri()))
+		base = context.Source.Uri()
+	}
+	return context.fetchDocument(resolveURI(loc, base))
+}
+
+// The nodes identified by a URI reference passed to document(): a whole
+// document, or the element selected by a fragment identifier. A relative
+// reference is resolved against the base URI of base, or of the principal
+// stylesheet module if base is nil.
+func (context *ExecutionContext) document(uri string, base xml.Node) xml.Nodeset {
+	ref, fragment := uri, ""
+	if i := strings.Index(uri, "#"); i >= 0 {
+		ref, fragment = uri[:i], uri[i+1:]
+	}
+	var root xml.Node
+	var doc xml.Document
+	switch {
+	case ref != "":
+		b := context.Style.uri
+		if base != nil {
+			b = context.baseURI(base)
+		}
+		d := context.fetchDocument(resolveURI(ref, b))
+		if d == nil {
+			return nil
+		}
+		root, doc = d, d
+	case base != nil:
+		// an empty reference is the document containing the base node, so
+		// document('') is the stylesheet module
+		root = treeRoot(base)
+		doc = context.ownerDocument(root)
+	default:
+		root, doc = context.Style.Doc, context.Style.Doc
+	}
+	if fragment == "" {
+		return xml.Nodeset{root}
+	}
+	// the fragment identifier is the ID of an element
+	if e := doc.NodeById(fragment); e != nil {
+		return xml.Nodeset{e}
+	}
+	context.reportError(newTransformError("XTDE1160", context.instruction, context.Current, nil, "no element with ID %s in %s", fragment, uri))
+	return nil
+}
+
+// Remove duplicate nodes and put the rest in document order. When the nodes
+// are all whole documents, as they usually are for document(), they are
+// kept in the order they were first seen.
+func (context *ExecutionContext) documentOrder(nodes xml.Nodeset) xml.Nodeset {
+	seen := make(map[unsafe.Pointer]bool)
+	unique := nodes[:0]
+	roots := true
+	for _, n := range nodes {
+		if !seen[n.NodePtr()] {
+			seen[n.NodePtr()] = true
+			unique = append(unique, n)
+			roots = roots && n.Parent() == nil
+		}
+	}
+	if !roots {
+		sort.SliceStable(unique, func(i, j int) bool {
+			return context.nodeNumber(unique[i]) < context.nodeNumber(unique[j])
+		})
+	}
+	return unique
+}
+
+// Load the document at the absolute URI, or return the copy loaded earlier
+// in the transformation. Returns nil, after reporting an error, if the
+// document cannot be loaded.
+func (context *ExecutionContext) fetchDocument(uri string) (doc *xml.XmlDocument) {
+	//create the map if needed
+	if context.InputDocuments == nil {
+		context.InputDocuments = make(map[string]*xml.XmlDocument)
 	}
-	resolvedLoc := filepath.Join(base, loc)
 
 	//if abspath in map return existing document
-	doc, ok := context.InputDocuments[resolvedLoc]
+	doc, ok := context.InputDocuments[uri]
 	if ok {
 		return
 	}
 
 	//else load the document and add to map
-	doc, e := xml.ReadFile(resolvedLoc, xml.StrictParseOption)
+	doc, e := loadDocument(context.resolver, uri)
 	if e != nil {
-		fmt.Println(e)
+		context.reportError(newTransformError("FODC0002", nil, context.Current, e, "cannot load document %s", uri))
 		return
 	}
-	context.InputDocuments[resolvedLoc] = doc
+	context.stripWhitespace(doc)
+	context.InputDocuments[uri] = doc
 	return
 }
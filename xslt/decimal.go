@@ -0,0 +1,322 @@
+package xslt
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jbowtie/gokogiri/xml"
+)
+
+// DecimalFormat holds the symbols declared by an xsl:decimal-format
+// element. They control how format-number() interprets its pattern and
+// which characters appear in the result.
+type DecimalFormat struct {
+	Name              string // the expanded name, as {namespace}local if it has a namespace
+	DecimalSeparator  rune
+	GroupingSeparator rune
+	Infinity          string
+	MinusSign         rune
+	NaN               string
+	Percent           rune
+	PerMille          rune
+	ZeroDigit         rune
+	Digit             rune
+	PatternSeparator  rune
+}
+
+// The decimal format used when the stylesheet does not declare one.
+var defaultDecimalFormat = &DecimalFormat{
+	DecimalSeparator:  '.',
+	GroupingSeparator: ',',
+	Infinity:          "Infinity",
+	MinusSign:         '-',
+	NaN:               "NaN",
+	Percent:           '%',
+	PerMille:          '‰',
+	ZeroDigit:         '0',
+	Digit:             '#',
+	PatternSeparator:  ';',
+}
+
+// compileDecimalFormat reads the attributes of xsl:decimal-format; any
+// attribute that is not present keeps its default value.
+func compileDecimalFormat(node xml.Node) (f *DecimalFormat) {
+	f = new(DecimalFormat)
+	*f = *defaultDecimalFormat
+	f.Name = expandedName(resolveQName(node, node.Attr("name")))
+	readRune := func(attr string, r *rune) {
+		if v := node.Attr(attr); v != "" {
+			*r, _ = utf8.DecodeRuneInString(v)
+		}
+	}
+	readRune("decimal-separator", &f.DecimalSeparator)
+	readRune("grouping-separator", &f.GroupingSeparator)
+	readRune("minus-sign", &f.MinusSign)
+	readRune("percent", &f.Percent)
+	readRune("per-mille", &f.PerMille)
+	readRune("zero-digit", &f.ZeroDigit)
+	readRune("digit", &f.Digit)
+	readRune("pattern-separator", &f.PatternSeparator)
+	if v := node.Attr("infinity"); v != "" {
+		f.Infinity = v
+	}
+	if v := node.Attr("NaN"); v != "" {
+		f.NaN = v
+	}
+	return
+}
+
+// A parsed format-number() sub-pattern.
+type numberPicture struct {
+	prefix     string
+	suffix     string
+	minInt     int
+	minFrac    int
+	maxFrac    int
+	grouping   int
+	multiplier float64
+}
+
+// isDigitChar reports whether r has special meaning in the numeric part of a pattern.
+func (f *DecimalFormat) isDigitChar(r rune) bool {
+	return r == f.Digit || r == f.ZeroDigit || r == f.GroupingSeparator || r == f.DecimalSeparator
+}
+
+// parsePattern splits a format-number() pattern into its positive and
+// (optional) negative sub-patterns.
+func (f *DecimalFormat) parsePattern(pattern string) (pos, neg *numberPicture, err error) {
+	var parts []string
+	inQuote := false
+	start := 0
+	for i, r := range pattern {
+		if r == '\'' {
+			inQuote = !inQuote
+		}
+		if r == f.PatternSeparator && !inQuote {
+			parts = append(parts, pattern[start:i])
+			start = i + utf8.RuneLen(r)
+		}
+	}
+	parts = append(parts, pattern[start:])
+	if len(parts) > 2 {
+		err = errors.New("format-number: pattern contains multiple pattern separators: " + pattern)
+		return
+	}
+	pos, err = f.parseSubPattern(parts[0])
+	if err != nil {
+		return
+	}
+	if len(parts) == 2 {
+		neg, err = f.parseSubPattern(parts[1])
+	}
+	return
+}
+
+func (f *DecimalFormat) parseSubPattern(pattern string) (p *numberPicture, err error) {
+	const (
+		inPrefix = iota
+		inInteger
+		inFraction
+		inSuffix
+	)
+	p = &numberPicture{multiplier: 1}
+	phase := inPrefix
+	inQuote := false
+	sawDigits, sawZero, sawFracDigit, sawGroup := false, false, false, false
+	groupCount := 0
+	var affix []rune
+
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if inQuote {
+			if r == '\'' {
+				if i+1 < len(runes) && runes[i+1] == '\'' {
+					affix = append(affix, r)
+					i++
+				} else {
+					inQuote = false
+				}
+				continue
+			}
+			affix = append(affix, r)
+			continue
+		}
+		switch phase {
+		case inPrefix, inSuffix:
+			if f.isDigitChar(r) {
+				if phase == inSuffix {
+					return nil, errors.New("format-number: unexpected digit in pattern suffix: " + pattern)
+				}
+				p.prefix = string(affix)
+				affix = nil
+				phase = inInteger
+				i--
+				continue
+			}
+			if r == '\'' {
+				if i+1 < len(runes) && runes[i+1] == '\'' {
+					affix = append(affix, r)
+					i++
+				} else {
+					inQuote = true
+				}
+				continue
+			}
+			if r == f.Percent || r == f.PerMille {
+				if p.multiplier != 1 {
+					return nil, errors.New("format-number: pattern contains more than one percent or per-mille sign: " + pattern)
+				}
+				if r == f.Percent {
+					p.multiplier = 100
+				} else {
+					p.multiplier = 1000
+				}
+			}
+			affix = append(affix, r)
+		case inInteger:
+			switch r {
+			case f.Digit:
+				if sawZero {
+					return nil, errors.New("format-number: optional digit follows mandatory digit: " + pattern)
+				}
+				sawDigits = true
+				groupCount++
+			case f.ZeroDigit:
+				sawZero = true
+				sawDigits = true
+				p.minInt++
+				groupCount++
+			case f.GroupingSeparator:
+				sawGroup = true
+				groupCount = 0
+			case f.DecimalSeparator:
+				phase = inFraction
+			default:
+				phase = inSuffix
+				i--
+			}
+		case inFraction:
+			switch r {
+			case f.ZeroDigit:
+				if sawFracDigit {
+					return nil, errors.New("format-number: mandatory digit follows optional digit: " + pattern)
+				}
+				sawDigits = true
+				p.minFrac++
+				p.maxFrac++
+			case f.Digit:
+				sawDigits = true
+				sawFracDigit = true
+				p.maxFrac++
+			case f.GroupingSeparator, f.DecimalSeparator:
+				return nil, errors.New("format-number: unexpected separator in fractional part: " + pattern)
+			default:
+				phase = inSuffix
+				i--
+			}
+		}
+	}
+	if inQuote {
+		return nil, errors.New("format-number: unterminated quote in pattern: " + pattern)
+	}
+	if phase == inPrefix {
+		p.prefix = string(affix)
+	} else {
+		p.suffix = string(affix)
+	}
+	if !sawDigits {
+		return nil, errors.New("format-number: pattern contains no digits: " + pattern)
+	}
+	if sawGroup {
+		p.grouping = groupCount
+	}
+	return
+}
+
+// Format a number according to the pattern, using the symbols of this decimal format.
+func (f *DecimalFormat) Format(num float64, pattern string) (out string, err error) {
+	pos, neg, err := f.parsePattern(pattern)
+	if err != nil {
+		return
+	}
+	if math.IsNaN(num) {
+		return f.NaN, nil
+	}
+
+	prefix, suffix := pos.prefix, pos.suffix
+	if num < 0 {
+		if neg != nil {
+			prefix, suffix = neg.prefix, neg.suffix
+		} else {
+			prefix = string(f.MinusSign) + prefix
+		}
+	}
+
+	abs := math.Abs(num) * pos.multiplier
+	if math.IsInf(abs, 0) {
+		return prefix + f.Infinity + suffix, nil
+	}
+
+	digits := strconv.FormatFloat(abs, 'f', pos.maxFrac, 64)
+	intPart, fracPart := digits, ""
+	if dot := strings.IndexByte(digits, '.'); dot >= 0 {
+		intPart, fracPart = digits[:dot], digits[dot+1:]
+	}
+	for len(fracPart) > pos.minFrac && fracPart[len(fracPart)-1] == '0' {
+		fracPart = fracPart[:len(fracPart)-1]
+	}
+	intPart = strings.TrimLeft(intPart, "0")
+	if len(intPart) < pos.minInt {
+		intPart = strings.Repeat("0", pos.minInt-len(intPart)) + intPart
+	}
+	if intPart == "" && fracPart == "" {
+		intPart = "0"
+	}
+
+	var b strings.Builder
+	b.WriteString(prefix)
+	for i, d := range intPart {
+		if i > 0 && pos.grouping > 0 && (len(intPart)-i)%pos.grouping == 0 {
+			b.WriteRune(f.GroupingSeparator)
+		}
+		b.WriteRune(f.ZeroDigit + (d - '0'))
+	}
+	if fracPart != "" {
+		b.WriteRune(f.DecimalSeparator)
+		for _, d := range fracPart {
+			b.WriteRune(f.ZeroDigit + (d - '0'))
+		}
+	}
+	b.WriteString(suffix)
+	out = b.String()
+	return
+}
+
+// Locate a decimal format by expanded name, honouring import precedence.
+// The empty name refers to the default decimal format.
+func (style *Stylesheet) LookupDecimalFormat(name string) *DecimalFormat {
+	if f := style.lookupDecimalFormat(name); f != nil {
+		return f
+	}
+	if name == "" {
+		return defaultDecimalFormat
+	}
+	return nil
+}
+
+func (style *Stylesheet) lookupDecimalFormat(name string) *DecimalFormat {
+	f, ok := style.DecimalFormats[name]
+	if ok {
+		return f
+	}
+	for _, s := range style.Imports {
+		if f = s.lookupDecimalFormat(name); f != nil {
+			return f
+		}
+	}
+	return nil
+}
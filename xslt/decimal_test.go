@@ -0,0 +1,106 @@
+package xslt
+
+import (
+	"github.com/jbowtie/gokogiri/xml"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestFormatNumber(t *testing.T) {
+	czech := *defaultDecimalFormat
+	czech.DecimalSeparator = ','
+	czech.GroupingSeparator = '.'
+
+	custom := *defaultDecimalFormat
+	custom.NaN = "not a number"
+	custom.Infinity = "forever"
+	custom.ZeroDigit = '٠'
+
+	cases := []struct {
+		format  *DecimalFormat
+		num     float64
+		pattern string
+		want    string
+	}{
+		{defaultDecimalFormat, 1234567.891, "#,##0.00", "1,234,567.89"},
+		{defaultDecimalFormat, 100000000000, "#,##0.##", "100,000,000,000"},
+		{defaultDecimalFormat, 0.5, "#.#", ".5"},
+		{defaultDecimalFormat, 0, "#", "0"},
+		{defaultDecimalFormat, 7, "000", "007"},
+		{defaultDecimalFormat, 1.5, "0.000", "1.500"},
+		{defaultDecimalFormat, 0.256, "#%", "26%"},
+		{defaultDecimalFormat, 0.256, "#‰", "256‰"},
+		{defaultDecimalFormat, -12.5, "#.0", "-12.5"},
+		{defaultDecimalFormat, -12.5, "#.0;(#.0)", "(12.5)"},
+		{defaultDecimalFormat, 12.5, "'#'#.0", "#12.5"},
+		{defaultDecimalFormat, math.NaN(), "#", "NaN"},
+		{defaultDecimalFormat, math.Inf(-1), "#", "-Infinity"},
+		{&czech, 1234567.5, "#.##0,00", "1.234.567,50"},
+		{&custom, math.NaN(), "#", "not a number"},
+		{&custom, math.Inf(1), "#", "forever"},
+		{&custom, 42, "#", "٤٢"},
+	}
+	for _, c := range cases {
+		got, err := c.format.Format(c.num, c.pattern)
+		if err != nil {
+			t.Error(c.pattern, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("Format(%v, %q) = %q, want %q", c.num, c.pattern, got, c.want)
+		}
+	}
+}
+
+func TestFormatNumberBadPattern(t *testing.T) {
+	for _, pattern := range []string{"", "abc", "#;#;#", "0#", "#.#0", "#.##,#", "%#%"} {
+		if _, err := defaultDecimalFormat.Format(1, pattern); err == nil {
+			t.Error("expected error for pattern", pattern)
+		}
+	}
+}
+
+// Decimal formats are named by expanded names, so any prefix bound to the
+// namespace of a format finds it.
+func TestDecimalFormatQName(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform" xmlns:p="urn:x-test:formats">
+<xsl:output method="text"/>
+<xsl:decimal-format name="p:euro" decimal-separator="," grouping-separator="."/>
+<xsl:decimal-format name="p:euro" grouping-separator="." decimal-separator=","/>
+<xsl:template match="/">
+  <xsl:value-of xmlns:q="urn:x-test:formats" select="format-number(1234.5, '#.##0,00', 'q:euro')"/>
+  <xsl:text>|</xsl:text>
+  <xsl:value-of select="format-number(1234.5, '#,##0.00', 'euro')"/>
+</xsl:template>
+</xsl:stylesheet>`
+	stylesheet, doc := parseTransformTest(t, xsl, "<doc/>")
+	defer stylesheet.Close()
+	defer doc.Free()
+	var codes []string
+	handler := func(e *TransformError) { codes = append(codes, e.Code) }
+	output, err := stylesheet.Process(doc, StylesheetOptions{ErrorHandler: handler})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "1.234,50|" {
+		t.Errorf("got %q, want %q", output, "1.234,50|")
+	}
+	if strings.Join(codes, " ") != "XTDE1280" {
+		t.Error("unexpected errors reported", codes)
+	}
+}
+
+// Declaring a decimal format twice with different symbols is a static error.
+func TestDecimalFormatConflict(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform" xmlns:p="urn:x-test:formats" xmlns:q="urn:x-test:formats">
+<xsl:decimal-format name="p:f" decimal-separator=","/>
+<xsl:decimal-format name="q:f" decimal-separator="."/>
+</xsl:stylesheet>`
+	style, _ := xml.Parse([]byte(xsl), nil, nil, xml.StrictParseOption, nil)
+	defer style.Free()
+	_, err := ParseStylesheet(style, "")
+	if terr, ok := err.(*TransformError); !ok || terr.Code != "XTSE1290" || terr.Line != 3 {
+		t.Errorf("expected XTSE1290 at line 3, got %v", err)
+	}
+}
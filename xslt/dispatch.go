@@ -0,0 +1,243 @@
+package xslt
+
+import (
+	"github.com/jbowtie/gokogiri/xml"
+	"sort"
+	"sync"
+)
+
+// Template rules are found through an index of the rules in a stylesheet
+// and everything it imports, built the first time the stylesheet is used
+// to look up a template. For each kind of node, expanded name and mode the
+// index holds the template rules that could match, ordered from the best
+// to the worst, so finding a template is a matter of evaluating the
+// patterns in that list until one matches.
+
+type nodeKind int
+
+const (
+	documentKind nodeKind = iota
+	elementKind
+	attributeKind
+	textKind
+	commentKind
+	piKind
+	anyKind // patterns such as id('x') and key('k', 'v'), which can match any kind of node
+)
+
+// Identifies a list of template rules. Rules for * have an empty name;
+// rules for prefix:* have a name of *. For processing instructions, the
+// name is the target.
+type dispatchKey struct {
+	kind      nodeKind
+	namespace string
+	name      string
+	mode      string
+}
+
+// An alternative of a template rule's pattern and the import precedence
+// of the module that declared it.
+type dispatchRule struct {
+	match      *CompiledMatch
+	precedence int
+}
+
+// Returns true if r should be chosen over o when both match a node.
+func (r dispatchRule) outranks(o dispatchRule) bool {
+	if r.precedence != o.precedence {
+		return r.precedence > o.precedence
+	}
+	return r.match.outranks(o.match)
+}
+
+// The range of import precedences of the rules in a module and in the
+// modules it imports; the imported rules are below the module's own.
+type precedenceRange struct {
+	imports    int // the lowest precedence of the imported modules
+	precedence int // the precedence of the module itself
+}
+
+type dispatchIndex struct {
+	patterns map[dispatchKey][]dispatchRule // by the last step of the pattern, in any mode
+	modules  map[*Stylesheet]precedenceRange
+	next     int // the next import precedence to assign
+
+	mu    sync.RWMutex
+	rules map[dispatchKey][]dispatchRule // every rule that could match, best first; built on demand
+}
+
+// The dispatch index for the stylesheet, covering the template rules in
+// the stylesheet and the modules it imports.
+func (style *Stylesheet) dispatch() *dispatchIndex {
+	style.indexOnce.Do(func() {
+		ix := &dispatchIndex{
+			patterns: make(map[dispatchKey][]dispatchRule),
+			modules:  make(map[*Stylesheet]precedenceRange),
+			rules:    make(map[dispatchKey][]dispatchRule),
+		}
+		ix.addModule(style)
+		style.index = ix
+	})
+	return style.index
+}
+
+// Add the template rules of a module and the modules it imports. The
+// import precedences are assigned by a post-order traversal of the import
+// tree, so the modules imported by a module occupy the range just below it.
+func (ix *dispatchIndex) addModule(style *Stylesheet) {
+	imports := ix.next
+	// add the lowest precedence import first
+	for i := len(style.Imports) - 1; i >= 0; i-- {
+		ix.addModule(style.Imports[i])
+	}
+	precedence := ix.next
+	ix.next++
+	ix.modules[style] = precedenceRange{imports, precedence}
+	for _, t := range style.templates {
+		for _, m := range t.matches {
+			for _, key := range m.dispatchKeys() {
+				ix.patterns[key] = append(ix.patterns[key], dispatchRule{m, precedence})
+			}
+		}
+	}
+}
+
+// The lists in the dispatch index that the pattern belongs in, which are
+// determined by its last step.
+func (m *CompiledMatch) dispatchKeys() []dispatchKey {
+	step := m.lastStep()
+	if step == nil {
+		if m.path.idKey != nil {
+			return []dispatchKey{{kind: anyKind}}
+		}
+		return []dispatchKey{{kind: documentKind}}
+	}
+	test := step.test
+	name := test.name
+	if name == "*" && test.prefix == "" {
+		name = ""
+	}
+	if step.axis == attributeAxis {
+		switch test.kind {
+		case nameTest:
+			return []dispatchKey{{kind: attributeKind, namespace: test.namespace, name: name}}
+		case anyNodeTest:
+			return []dispatchKey{{kind: attributeKind}}
+		}
+		// text(), comment() and processing-instruction() never match attributes
+		return nil
+	}
+	switch test.kind {
+	case nameTest:
+		return []dispatchKey{{kind: elementKind, namespace: test.namespace, name: name}}
+	case textTest:
+		return []dispatchKey{{kind: textKind}}
+	case commentTest:
+		return []dispatchKey{{kind: commentKind}}
+	case piTest:
+		return []dispatchKey{{kind: piKind, name: test.name}}
+	}
+	// node() matches every kind of node on the child axis
+	return []dispatchKey{{kind: elementKind}, {kind: textKind}, {kind: commentKind}, {kind: piKind}}
+}
+
+// The key for the rules that could match node in mode, or false if no
+// pattern can match a node of its kind.
+func nodeDispatchKey(node xml.Node, mode string) (key dispatchKey, ok bool) {
+	key.mode = mode
+	switch node.NodeType() {
+	case xml.XML_DOCUMENT_NODE, xml.XML_HTML_DOCUMENT_NODE:
+		key.kind = documentKind
+	case xml.XML_ELEMENT_NODE:
+		key.kind, key.namespace, key.name = elementKind, node.Namespace(), node.Name()
+	case xml.XML_ATTRIBUTE_NODE:
+		key.kind, key.namespace, key.name = attributeKind, node.Namespace(), node.Name()
+	case xml.XML_TEXT_NODE, xml.XML_CDATA_SECTION_NODE:
+		key.kind = textKind
+	case xml.XML_COMMENT_NODE:
+		key.kind = commentKind
+	case xml.XML_PI_NODE:
+		key.kind, key.name = piKind, node.Name()
+	default:
+		return key, false
+	}
+	return key, true
+}
+
+// The rules that could match a node with the key, best first.
+func (ix *dispatchIndex) candidates(key dispatchKey) []dispatchRule {
+	// Names and namespaces that no pattern mentions share the rules for
+	// any node of their kind, so the lists cached on the stylesheet are
+	// bounded by the stylesheet rather than by the documents it processes.
+	named := false
+	wildcard := false
+	switch key.kind {
+	case elementKind, attributeKind:
+		_, named = ix.patterns[dispatchKey{kind: key.kind, namespace: key.namespace, name: key.name}]
+		_, wildcard = ix.patterns[dispatchKey{kind: key.kind, namespace: key.namespace, name: "*"}]
+		if !named {
+			key.name = ""
+		}
+		if !named && !wildcard {
+			key.namespace = ""
+		}
+	case piKind:
+		_, named = ix.patterns[dispatchKey{kind: piKind, name: key.name}]
+		if !named {
+			key.name = ""
+		}
+	}
+
+	ix.mu.RLock()
+	rules, ok := ix.rules[key]
+	ix.mu.RUnlock()
+	if ok {
+		return rules
+	}
+
+	lists := [][]dispatchRule{ix.patterns[dispatchKey{kind: key.kind}], ix.patterns[dispatchKey{kind: anyKind}]}
+	if named {
+		lists = append(lists, ix.patterns[dispatchKey{kind: key.kind, namespace: key.namespace, name: key.name}])
+	}
+	if wildcard {
+		lists = append(lists, ix.patterns[dispatchKey{kind: key.kind, namespace: key.namespace, name: "*"}])
+	}
+	rules = []dispatchRule{}
+	for _, l := range lists {
+		for _, r := range l {
+			if r.match.Template.Mode == key.mode {
+				rules = append(rules, r)
+			}
+		}
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].outranks(rules[j])
+	})
+
+	ix.mu.Lock()
+	ix.rules[key] = rules
+	ix.mu.Unlock()
+	return rules
+}
+
+// Find the best template rule matching the node in mode, considering only
+// the rules with an import precedence in [low, high).
+func (ix *dispatchIndex) lookup(node xml.Node, mode string, context *ExecutionContext, low, high int) *Template {
+	key, ok := nodeDispatchKey(node, mode)
+	if !ok {
+		return nil
+	}
+	rules := ix.candidates(key)
+	for i, r := range rules {
+		if r.precedence < low || r.precedence >= high {
+			continue
+		}
+		if r.match.EvalMatch(node, mode, context) {
+			if context != nil && context.conflicts != ConflictRecover {
+				context.checkConflicts(rules[i:], node, mode)
+			}
+			return r.match.Template
+		}
+	}
+	return nil
+}
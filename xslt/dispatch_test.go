@@ -0,0 +1,197 @@
+package xslt
+
+import (
+	"fmt"
+	"github.com/jbowtie/gokogiri/xml"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Rules are chosen by import precedence before priority, and
+// xsl:apply-imports only considers the modules imported by the module
+// containing the current rule, even when a sibling import has a rule with
+// a higher precedence.
+func TestDispatchImportPrecedence(t *testing.T) {
+	resolver := mapResolver{
+		"main.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:import href="b.xsl"/>
+<xsl:import href="c.xsl"/>
+<xsl:output method="text"/>
+<xsl:template match="/"><xsl:apply-templates select="doc/node()"/><xsl:apply-templates select="doc/*" mode="m"/></xsl:template>
+</xsl:stylesheet>`,
+		"b.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:template match="x" priority="10">[b x]</xsl:template>
+<xsl:template match="y">[b y]</xsl:template>
+<xsl:template match="*" mode="m">[b * <xsl:value-of select="name()"/>]</xsl:template>
+</xsl:stylesheet>`,
+		"c.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:import href="d.xsl"/>
+<xsl:template match="doc/x">[c x]<xsl:apply-imports/></xsl:template>
+<xsl:template match="z" mode="m">[c z m]<xsl:apply-imports/></xsl:template>
+</xsl:stylesheet>`,
+		"d.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:template match="node()">[d <xsl:value-of select="name()"/>]</xsl:template>
+<xsl:template match="processing-instruction('p')">[d p]</xsl:template>
+</xsl:stylesheet>`,
+	}
+	style, _ := loadDocument(resolver, "main.xsl")
+	defer style.Free()
+	stylesheet, err := ParseStylesheetWithResolver(style, "main.xsl", resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stylesheet.Close()
+	doc, _ := xml.Parse([]byte("<doc><x/><y/><z/><?p?></doc>"), nil, nil, xml.StrictParseOption, nil)
+	defer doc.Free()
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[c x][d x][d y][d z][d p]" + "[b * x][b * y][c z m]"
+	if output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
+// Element names that no pattern mentions don't each get an entry in the
+// dispatch index, however many of them the documents contain.
+func TestDispatchCacheBounded(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform" xmlns:p="urn:p">
+<xsl:output method="text"/>
+<xsl:template match="a">A</xsl:template>
+<xsl:template match="p:*">P</xsl:template>
+<xsl:template match="*">.<xsl:apply-templates/></xsl:template>
+</xsl:stylesheet>`
+	var elements []string
+	for i := 0; i < 100; i++ {
+		elements = append(elements, fmt.Sprintf(`<e%d/><p:e%d/><q:e%d/>`, i, i, i))
+	}
+	input := `<doc xmlns:p="urn:p" xmlns:q="urn:q"><a/>` + strings.Join(elements, "") + `</doc>`
+	stylesheet, doc := parseTransformTest(t, xsl, input)
+	defer stylesheet.Close()
+	defer doc.Free()
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ".A" + strings.Repeat(".P.", 100); output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+	// the document node, a, p:* and every other element
+	if n := len(stylesheet.index.rules); n > 4 {
+		t.Errorf("dispatch index has %d cached lists, want at most 4", n)
+	}
+}
+
+// A transformation to be timed.
+type benchmarkCase struct {
+	name     string
+	style    *Stylesheet
+	input    *xml.XmlDocument
+	styleDoc *xml.XmlDocument
+}
+
+// Load a transformation and run it once, returning nil if it fails or
+// doesn't produce the expected output.
+func loadBenchmarkCase(b *testing.B, xslFile, inputFile, outputFile string) *benchmarkCase {
+	styleDoc, err := xml.ReadFile(xslFile, xml.StrictParseOption)
+	if err != nil {
+		return nil
+	}
+	style, err := ParseStylesheet(styleDoc, xslFile)
+	if err != nil {
+		styleDoc.Free()
+		return nil
+	}
+	input, err := xml.ReadFile(inputFile, xml.StrictParseOption)
+	if err != nil {
+		style.Close()
+		styleDoc.Free()
+		return nil
+	}
+	c := &benchmarkCase{name: xslFile, style: style, input: input, styleDoc: styleDoc}
+	expected, _ := ioutil.ReadFile(outputFile)
+	if output, err := style.Process(input, StylesheetOptions{}); err != nil || output != string(expected) {
+		c.free()
+		return nil
+	}
+	return c
+}
+
+func (c *benchmarkCase) free() {
+	c.style.Close()
+	c.styleDoc.Free()
+	c.input.Free()
+}
+
+func runBenchmarkCases(b *testing.B, cases []*benchmarkCase) {
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, c := range cases {
+			if _, err := c.style.Process(c.input, StylesheetOptions{}); err != nil {
+				b.Fatal(c.name, err)
+			}
+		}
+	}
+	b.StopTimer()
+	for _, c := range cases {
+		c.free()
+	}
+}
+
+// The second full example in the XSLT 1.0 spec, rendered three ways.
+func BenchmarkREC2(b *testing.B) {
+	var cases []*benchmarkCase
+	for _, name := range []string{"html", "svg", "vrml"} {
+		c := loadBenchmarkCase(b, "testdata/REC2/"+name+".xsl", "testdata/REC2/data.xml", "testdata/REC2/"+name+".xml")
+		if c == nil {
+			b.Fatal("cannot run", name)
+		}
+		cases = append(cases, c)
+	}
+	runBenchmarkCases(b, cases)
+}
+
+// The tests in the general suite.
+func BenchmarkGeneral(b *testing.B) {
+	pwd, _ := os.Getwd()
+	defer os.Chdir(pwd)
+	_ = os.Chdir("testdata/general")
+	var cases []*benchmarkCase
+	for _, name := range generalTests {
+		c := loadBenchmarkCase(b, name+".xsl", "../docs/"+name+".xml", name+".out")
+		if c == nil {
+			b.Fatal("cannot run", name)
+		}
+		cases = append(cases, c)
+	}
+	runBenchmarkCases(b, cases)
+}
+
+// A large stylesheet: most elements match one of many template rules,
+// with a few rules for wildcards and other modes.
+func BenchmarkManyTemplates(b *testing.B) {
+	var rules, elements []string
+	for i := 0; i < 2000; i++ {
+		rules = append(rules, fmt.Sprintf(`<xsl:template match="e%d">%d<xsl:apply-templates/></xsl:template>`, i, i))
+		rules = append(rules, fmt.Sprintf(`<xsl:template match="e%d" mode="toc"/>`, i))
+	}
+	for i := 0; i < 20000; i++ {
+		elements = append(elements, fmt.Sprintf(`<e%d><u>text</u></e%d>`, (i*7919)%2500, (i*7919)%2500))
+	}
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:template match="*">?<xsl:apply-templates/></xsl:template>
+<xsl:template match="u/text()">.</xsl:template>
+` + strings.Join(rules, "\n") + `
+</xsl:stylesheet>`
+	stylesheet, doc := parseTransformTest(b, xsl, "<doc>"+strings.Join(elements, "")+"</doc>")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := stylesheet.Process(doc, StylesheetOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package xslt
+
+import (
+	"fmt"
+	"github.com/jbowtie/gokogiri/xml"
+	"strconv"
+)
+
+// TransformError reports a problem found while compiling a stylesheet
+// or running a transformation, together with where it happened.
+//
+// Code holds the matching error code from the XSLT 2.0 and XPath 2.0
+// specifications (e.g. XTMM9000 for xsl:message terminate="yes"), since
+// XSLT 1.0 does not define any; it is empty when no code applies.
+type TransformError struct {
+	Code     string // the XSLT/XPath error code, if known
+	URI      string // the stylesheet module containing the offending instruction
+	Line     int    // line number of the offending instruction
+	NodePath string // path of the source node being processed, if any
+	Message  string
+	Err      error // the underlying error, if any
+}
+
+func (e *TransformError) Error() (out string) {
+	if e.URI != "" {
+		out = e.URI + ":"
+	}
+	if e.Line > 0 {
+		out = out + strconv.Itoa(e.Line) + ":"
+	}
+	if out != "" {
+		out = out + " "
+	}
+	if e.Code != "" {
+		out = out + e.Code + ": "
+	}
+	out = out + e.Message
+	if e.Err != nil {
+		out = out + ": " + e.Err.Error()
+	}
+	if e.NodePath != "" {
+		out = out + " (processing " + e.NodePath + ")"
+	}
+	return
+}
+
+// Unwrap returns the underlying error, if any.
+func (e *TransformError) Unwrap() error {
+	return e.Err
+}
+
+// Create an error positioned at the stylesheet node inst (which may be nil)
+// while processing the source node (which may also be nil).
+func newTransformError(code string, inst xml.Node, node xml.Node, cause error, format string, args ...interface{}) *TransformError {
+	e := &TransformError{Code: code, Err: cause, Message: fmt.Sprintf(format, args...)}
+	if inst != nil {
+		if doc := inst.MyDocument(); doc != nil {
+			e.URI = doc.Uri()
+		}
+		e.Line = inst.LineNumber()
+	}
+	if node != nil {
+		e.NodePath = node.Path()
+	}
+	return e
+}
+
+// Convert the value passed to panic() into an error. Errors raised
+// deliberately during processing are already TransformErrors.
+func recoveredError(r interface{}) *TransformError {
+	switch r := r.(type) {
+	case *TransformError:
+		return r
+	case error:
+		return &TransformError{Message: "unexpected failure", Err: r}
+	}
+	return &TransformError{Message: fmt.Sprint(r)}
+}
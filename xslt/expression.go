@@ -0,0 +1,173 @@
+package xslt
+
+import (
+	"github.com/jbowtie/gokogiri/xml"
+	"github.com/jbowtie/gokogiri/xpath"
+	"strings"
+)
+
+// Compile the XPath expression held by the named attribute of a stylesheet
+// element, returning nil if the attribute is absent.
+//
+// An expression that cannot be compiled is a static error; the panic is
+// recovered by ParseStylesheet, which returns the error.
+func compileExpression(inst xml.Node, attr string) *xpath.Expression {
+	src := inst.Attr(attr)
+	if src == "" {
+		return nil
+	}
+	return compileXPath(inst, attr, src)
+}
+
+func compileXPath(inst xml.Node, attr, src string) *xpath.Expression {
+	e := xpath.Compile(src)
+	if e == nil {
+		panic(newTransformError("XPST0003", inst, nil, xpath.Check(src), "invalid XPath expression in %s=%q", attr, src))
+	}
+	return e
+}
+
+func freeExpression(e *xpath.Expression) {
+	if e != nil {
+		e.Free()
+	}
+}
+
+// An attribute value template, compiled into a sequence of literal
+// text and XPath expressions.
+type avt struct {
+	node  xml.Node // the element holding the attribute, for namespace resolution
+	parts []avtPart
+}
+
+type avtPart struct {
+	text string
+	expr *xpath.Expression // if nil, the part is literal text
+}
+
+// Compile the value of the named attribute of inst as an attribute
+// value template, returning nil if the attribute is absent.
+func compileAttributeAVT(inst xml.Node, attr string) *avt {
+	value := inst.Attr(attr)
+	if value == "" {
+		return nil
+	}
+	return compileAVT(inst, attr, value)
+}
+
+// Compile an attribute value template. Doubled braces stand for literal
+// braces; anything else between braces is an XPath expression, which may
+// contain braces within string literals.
+func compileAVT(inst xml.Node, attr, value string) *avt {
+	a := &avt{node: inst}
+	text := ""
+	start := 0 // the start of the literal text not yet added to text
+	for pos := 0; pos < len(value); {
+		c := value[pos]
+		switch {
+		case (c == '{' || c == '}') && pos+1 < len(value) && value[pos+1] == c:
+			text = text + value[start:pos+1]
+			pos += 2
+			start = pos
+		case c == '{':
+			end := avtExpressionEnd(value, pos+1)
+			if end < 0 {
+				panic(newTransformError("XTSE0350", inst, nil, nil, "unterminated expression in %s=%q", attr, value))
+			}
+			text = text + value[start:pos]
+			if text != "" {
+				a.parts = append(a.parts, avtPart{text: text})
+				text = ""
+			}
+			a.parts = append(a.parts, avtPart{expr: compileXPath(inst, attr, value[pos+1:end])})
+			pos = end + 1
+			start = pos
+		case c == '}':
+			panic(newTransformError("XTSE0370", inst, nil, nil, "unescaped '}' in %s=%q", attr, value))
+		default:
+			pos++
+		}
+	}
+	text = text + value[start:]
+	if text != "" {
+		a.parts = append(a.parts, avtPart{text: text})
+	}
+	return a
+}
+
+// Find the brace that closes the expression starting at start, ignoring
+// any braces inside string literals.
+func avtExpressionEnd(value string, start int) int {
+	var quote byte
+	for pos := start; pos < len(value); pos++ {
+		c := value[pos]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '}':
+			return pos
+		}
+	}
+	return -1
+}
+
+// Evaluate the attribute value template with node as the context node.
+// A nil template evaluates to the empty string.
+func (a *avt) eval(node xml.Node, context *ExecutionContext) string {
+	if a == nil {
+		return ""
+	}
+	var out strings.Builder
+	registered := false
+	for _, p := range a.parts {
+		if p.expr == nil {
+			out.WriteString(p.text)
+			continue
+		}
+		if !registered {
+			context.RegisterXPathNamespaces(a.node)
+			registered = true
+		}
+		s, err := context.EvalXPathAsString(node, p.expr)
+		if err != nil {
+			context.reportError(newTransformError("", a.node, node, err, "cannot evaluate {%s}", p.expr))
+		}
+		out.WriteString(s)
+	}
+	return out.String()
+}
+
+func (a *avt) free() {
+	if a == nil {
+		return
+	}
+	for _, p := range a.parts {
+		freeExpression(p.expr)
+	}
+}
+
+// The expressions in an attribute value template, as written. Any text
+// after a malformed expression is ignored.
+func avtExpressions(value string) (exprs []string) {
+	for pos := 0; pos < len(value); {
+		c := value[pos]
+		switch {
+		case (c == '{' || c == '}') && pos+1 < len(value) && value[pos+1] == c:
+			pos += 2
+		case c == '{':
+			end := avtExpressionEnd(value, pos+1)
+			if end < 0 {
+				return
+			}
+			exprs = append(exprs, value[pos+1:end])
+			pos = end + 1
+		default:
+			pos++
+		}
+	}
+	return
+}
@@ -0,0 +1,35 @@
+package xslt
+
+import (
+	"github.com/jbowtie/gokogiri/xml"
+	"testing"
+)
+
+func TestAttributeValueTemplates(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output omit-xml-declaration="yes"/>
+<xsl:template match="/doc">
+  <out braces="{{x}}" quoted="{'}'}{&quot;{&quot;}" number="{1000000}" nodes="{item}" text="don't {@n}">
+    <xsl:element name="{concat('e', @n)}"/>
+    <xsl:processing-instruction name="p{@n}">x</xsl:processing-instruction>
+  </out>
+</xsl:template>
+</xsl:stylesheet>`
+	style, _ := xml.Parse([]byte(xsl), nil, nil, xml.StrictParseOption, nil)
+	stylesheet, err := ParseStylesheet(style, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, _ := xml.Parse([]byte(`<doc n="1"><item>a</item><item>b</item></doc>`), nil, nil, xml.StrictParseOption, nil)
+	output, err := stylesheet.Process(input, StylesheetOptions{})
+	if err != nil {
+		t.Error(err)
+	}
+	want := `<out braces="{x}" quoted="}{" number="1000000" nodes="a" text="don't 1"><e1/><?p1 x?></out>` + "\n"
+	if output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+	stylesheet.Close()
+	// closing twice is harmless
+	stylesheet.Close()
+}
@@ -0,0 +1,251 @@
+package xslt
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jbowtie/gokogiri/xml"
+	"github.com/jbowtie/gokogiri/xpath"
+	"math"
+	"strings"
+	"unsafe"
+)
+
+// ExtensionFunction is an XPath extension function implemented in Go.
+//
+// The value returned is converted to the corresponding XPath type: strings,
+// Go numeric types and booleans as you would expect, and an xml.Node,
+// []xml.Node or xml.Nodeset as a node-set. Returning nil produces an
+// empty node-set.
+//
+// A non-nil error is reported as a recoverable error (see StylesheetOptions)
+// and the function call evaluates to an empty node-set.
+type ExtensionFunction func(context *ExecutionContext, args FunctionArgs) (interface{}, error)
+
+// FunctionArgs holds the arguments passed to an extension function. The
+// methods convert an argument using the rules of the corresponding XPath
+// function; an index beyond the end of the arguments behaves like an empty
+// node-set.
+type FunctionArgs []interface{}
+
+func (args FunctionArgs) value(i int) interface{} {
+	if i < 0 || i >= len(args) {
+		return nil
+	}
+	return args[i]
+}
+
+// String converts argument i as if by the XPath string() function.
+func (args FunctionArgs) String(i int) string {
+	return argValToString(args.value(i))
+}
+
+// Number converts argument i as if by the XPath number() function.
+func (args FunctionArgs) Number(i int) float64 {
+	return argValToNumber(args.value(i))
+}
+
+// Boolean converts argument i as if by the XPath boolean() function.
+func (args FunctionArgs) Boolean(i int) bool {
+	switch v := args.value(i).(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	case []unsafe.Pointer:
+		return len(v) > 0
+	}
+	return false
+}
+
+// NodeSet returns the nodes of argument i, which must be a node-set.
+// Each node is associated with the document containing it, which may be
+// the source, a document loaded with document(), a stylesheet module or,
+// for a result tree fragment, the output document.
+func (args FunctionArgs) NodeSet(context *ExecutionContext, i int) ([]xml.Node, error) {
+	switch v := args.value(i).(type) {
+	case nil:
+		return nil, nil
+	case []unsafe.Pointer:
+		nodes := make([]xml.Node, 0, len(v))
+		for _, p := range v {
+			nodes = append(nodes, context.wrapNode(p))
+		}
+		return nodes, nil
+	}
+	return nil, fmt.Errorf("argument %d is not a node-set", i+1)
+}
+
+// RegisterFunction makes fn available to XPath expressions in the stylesheet
+// as the function localName in the namespace namespaceURI. Extension functions
+// must be in a namespace other than the XSLT namespace.
+//
+// Functions should be registered before the stylesheet is used to process
+// any documents.
+func (style *Stylesheet) RegisterFunction(namespaceURI, localName string, fn ExtensionFunction) error {
+	if namespaceURI == "" || namespaceURI == XSLT_NAMESPACE {
+		return errors.New("extension functions must be in a non-XSLT namespace: " + localName)
+	}
+	style.Functions[fmt.Sprintf("{%s}%s", namespaceURI, localName)] = func(scope xpath.VariableScope, args []interface{}) interface{} {
+		c := scope.(*ExecutionContext)
+		result, err := fn(c, FunctionArgs(args))
+		if err == nil {
+			result, err = c.toXPathValue(result)
+		}
+		if err != nil {
+			c.reportError(newTransformError("", nil, c.Current, err, "extension function {%s}%s failed", namespaceURI, localName))
+			return nil
+		}
+		return result
+	}
+	return nil
+}
+
+// Convert a value returned from Go code into one we can hand back to libxml.
+func (context *ExecutionContext) toXPathValue(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case nil, string, float64:
+		return v, nil
+	case bool:
+		return xpathBoolean(v), nil
+	case int:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case float32:
+		return float64(v), nil
+	case xml.Node:
+		return []unsafe.Pointer{v.NodePtr()}, nil
+	case xml.Nodeset:
+		return v.ToPointers(), nil
+	case []xml.Node:
+		return xml.Nodeset(v).ToPointers(), nil
+	}
+	return nil, fmt.Errorf("cannot convert %T to an XPath value", val)
+}
+
+// ExtensionElement implements an extension instruction in Go.
+//
+// It is called with the extension element from the stylesheet (so that
+// attributes can be read), the current source node, the execution context and
+// the compiled content of the element, excluding any xsl:fallback. Calling
+// Apply on each child instantiates the content in the current output position.
+//
+// A non-nil error is reported as a recoverable error.
+type ExtensionElement func(inst xml.Node, node xml.Node, context *ExecutionContext, children []CompiledStep) error
+
+// RegisterElement registers fn as the implementation of the extension
+// instruction localName in the namespace namespaceURI. The namespace must
+// be declared as an extension namespace (using extension-element-prefixes)
+// by the stylesheet modules using the instruction.
+//
+// Elements should be registered before the stylesheet is used to process
+// any documents.
+func (style *Stylesheet) RegisterElement(namespaceURI, localName string, fn ExtensionElement) error {
+	if namespaceURI == "" || namespaceURI == XSLT_NAMESPACE {
+		return errors.New("extension elements must be in a non-XSLT namespace: " + localName)
+	}
+	style.Elements[fmt.Sprintf("{%s}%s", namespaceURI, localName)] = fn
+	return nil
+}
+
+// ExtensionInstruction is an element in an extension namespace. It is
+// executed by the ExtensionElement registered for it, or if there is none,
+// by instantiating its xsl:fallback children.
+type ExtensionInstruction struct {
+	Node     xml.Node
+	Children []CompiledStep
+	fallback []CompiledStep
+}
+
+func (e *ExtensionInstruction) Compile(node xml.Node) {
+	for cur := node.FirstChild(); cur != nil; cur = cur.NextSibling() {
+		res := CompileSingleNode(cur)
+		if res == nil {
+			continue
+		}
+		res.Compile(cur)
+		if IsXsltName(cur, "fallback") {
+			e.fallback = append(e.fallback, res)
+		} else {
+			e.Children = append(e.Children, res)
+		}
+	}
+}
+
+func (e *ExtensionInstruction) Apply(node xml.Node, context *ExecutionContext) {
+	name := fmt.Sprintf("{%s}%s", e.Node.Namespace(), e.Node.Name())
+	if fn, ok := context.Style.Elements[name]; ok {
+		if err := fn(e.Node, node, context, e.Children); err != nil {
+			context.reportError(newTransformError("", e.Node, node, err, "extension element %s failed", name))
+		}
+		return
+	}
+	if !applyFallback(e.fallback, node, context) {
+		context.reportError(newTransformError("XTDE1450", e.Node, node, nil, "no implementation of extension element %s", name))
+	}
+}
+
+// Instantiate the content of each xsl:fallback in steps, returning false if
+// there were none.
+func applyFallback(steps []CompiledStep, node xml.Node, context *ExecutionContext) (found bool) {
+	for _, c := range steps {
+		if inst, ok := c.(*XsltInstruction); ok && inst.Name == "fallback" {
+			applySequence(inst.Children, node, context)
+			found = true
+		}
+	}
+	return
+}
+
+// Returns true if the element is in a namespace designated as an extension
+// namespace, either by the extension-element-prefixes attribute of
+// xsl:stylesheet or the xsl:extension-element-prefixes attribute of an
+// enclosing literal result element.
+func isExtensionElement(node xml.Node) bool {
+	ns := node.Namespace()
+	if ns == "" || ns == XSLT_NAMESPACE {
+		return false
+	}
+	for n := node; n != nil && n.NodeType() == xml.XML_ELEMENT_NODE; n = n.Parent() {
+		prefixes := ""
+		for _, attr := range n.AttributeList() {
+			if attr.Name() != "extension-element-prefixes" {
+				continue
+			}
+			if attr.Namespace() == XSLT_NAMESPACE || (attr.Namespace() == "" && n.Namespace() == XSLT_NAMESPACE) {
+				prefixes = attr.Content()
+			}
+		}
+		for _, prefix := range strings.Fields(prefixes) {
+			if prefix == "#default" {
+				prefix = ""
+			}
+			if lookupPrefix(n, prefix) == ns {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Find the namespace URI bound to prefix in the scope of node.
+func lookupPrefix(node xml.Node, prefix string) string {
+	for n := node; n != nil && n.NodeType() == xml.XML_ELEMENT_NODE; n = n.Parent() {
+		for _, decl := range n.DeclaredNamespaces() {
+			if decl.Prefix == prefix {
+				return decl.Uri
+			}
+		}
+	}
+	return ""
+}
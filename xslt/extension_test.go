@@ -0,0 +1,244 @@
+package xslt
+
+import (
+	"errors"
+	"github.com/jbowtie/gokogiri/xml"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func registerTestFunctions(t *testing.T, stylesheet *Stylesheet) {
+	ns := "urn:x-test:functions"
+	funcs := map[string]ExtensionFunction{
+		"greet": func(c *ExecutionContext, args FunctionArgs) (interface{}, error) {
+			return "hello " + args.String(0), nil
+		},
+		"total": func(c *ExecutionContext, args FunctionArgs) (interface{}, error) {
+			nodes, err := args.NodeSet(c, 0)
+			total := 0.0
+			for _, n := range nodes {
+				total += argValToNumber(n.Attr("v"))
+			}
+			return total, err
+		},
+		"even": func(c *ExecutionContext, args FunctionArgs) (interface{}, error) {
+			return int(args.Number(0))%2 == 0, nil
+		},
+		"alternate": func(c *ExecutionContext, args FunctionArgs) (interface{}, error) {
+			nodes, err := args.NodeSet(c, 0)
+			var out []xml.Node
+			for i := 0; i < len(nodes); i += 2 {
+				out = append(out, nodes[i])
+			}
+			return out, err
+		},
+		"fail": func(c *ExecutionContext, args FunctionArgs) (interface{}, error) {
+			return nil, errors.New("deliberate failure")
+		},
+	}
+	for name, fn := range funcs {
+		if err := stylesheet.RegisterFunction(ns, name, fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRegisterFunction(t *testing.T) {
+	xslFile := "testdata/extensions/functions.xsl"
+	style, _ := xml.ReadFile(xslFile, xml.StrictParseOption)
+	input, _ := xml.ReadFile("testdata/extensions/data.xml", xml.StrictParseOption)
+	stylesheet, _ := ParseStylesheet(style, xslFile)
+	registerTestFunctions(t, stylesheet)
+
+	output, err := stylesheet.Process(input, StylesheetOptions{})
+	if err != nil {
+		t.Error(err)
+	}
+	for _, want := range []string{
+		"<greet>hello world</greet>",
+		"<total>6.5</total>",
+		"<even>true,false</even>",
+		"<test>right</test>",
+		"<nodes>2,3.5</nodes>",
+		"true,false,true,true",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %s in output:\n%s", want, output)
+		}
+	}
+}
+
+// The nodes passed to an extension function belong to the documents that
+// contain them, not to the principal source document.
+func TestFunctionArgsOwnerDocument(t *testing.T) {
+	resolver := mapResolver{
+		"main.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform" xmlns:my="urn:x-test:functions">
+<xsl:output method="text"/>
+<xsl:template match="/">
+  <xsl:variable name="rvt"><r/></xsl:variable>
+  <xsl:value-of select="my:owned(/doc)"/>
+  <xsl:value-of select="my:owned(document('other.xml')/other)"/>
+  <xsl:value-of select="my:owned(document('')/xsl:stylesheet)"/>
+  <xsl:value-of select="my:owned($rvt)"/>
+</xsl:template>
+</xsl:stylesheet>`,
+		"other.xml": "<other/>",
+	}
+	style, _ := loadDocument(resolver, "main.xsl")
+	defer style.Free()
+	stylesheet, err := ParseStylesheetWithResolver(style, "main.xsl", resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stylesheet.Close()
+	// whether every node belongs to the document at the root of its tree
+	// (or, for a result tree fragment, to the output)
+	stylesheet.RegisterFunction("urn:x-test:functions", "owned", func(c *ExecutionContext, args FunctionArgs) (interface{}, error) {
+		nodes, err := args.NodeSet(c, 0)
+		for _, n := range nodes {
+			root := treeRoot(n).NodePtr()
+			if n.MyDocument().DocPtr() != root && n.MyDocument().DocPtr() != c.Output.DocPtr() {
+				return "n", err
+			}
+			if root != c.Source.DocPtr() && n.MyDocument().DocPtr() == c.Source.DocPtr() {
+				return "n", err
+			}
+		}
+		return "y", err
+	})
+	doc, _ := xml.Parse([]byte("<doc/>"), nil, nil, xml.StrictParseOption, nil)
+	defer doc.Free()
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "yyyy" {
+		t.Errorf("got %q, want %q", output, "yyyy")
+	}
+}
+
+func TestRegisterFunctionErrors(t *testing.T) {
+	style, _ := xml.Parse([]byte(`<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform" xmlns:my="urn:x-test:functions" exclude-result-prefixes="my">
+<xsl:template match="/"><out><xsl:value-of select="my:fail()"/></out></xsl:template>
+</xsl:stylesheet>`), nil, nil, xml.StrictParseOption, nil)
+	stylesheet, _ := ParseStylesheet(style, "")
+	if err := stylesheet.RegisterFunction("", "greet", nil); err == nil {
+		t.Error("expected an error registering a function in no namespace")
+	}
+	registerTestFunctions(t, stylesheet)
+
+	input, _ := xml.Parse([]byte("<doc/>"), nil, nil, xml.StrictParseOption, nil)
+	var reported []*TransformError
+	handler := func(e *TransformError) { reported = append(reported, e) }
+	output, _ := stylesheet.Process(input, StylesheetOptions{ErrorHandler: handler})
+	if len(reported) != 1 || !strings.Contains(reported[0].Error(), "deliberate failure") {
+		t.Error("expected the failure to be reported, got", reported)
+	}
+	if !strings.Contains(output, "<out/>") {
+		t.Error("unexpected output", output)
+	}
+}
+
+func TestRegisterElement(t *testing.T) {
+	xslFile := "testdata/extensions/elements.xsl"
+	style, _ := xml.ReadFile(xslFile, xml.StrictParseOption)
+	input, _ := xml.ReadFile("testdata/extensions/data.xml", xml.StrictParseOption)
+	stylesheet, _ := ParseStylesheet(style, xslFile)
+	ns := "urn:x-test:elements"
+	wrap := func(inst, node xml.Node, c *ExecutionContext, children []CompiledStep) error {
+		r := c.Output.CreateElementNode(inst.Attr("name"))
+		c.OutputNode.AddChild(r)
+		old := c.OutputNode
+		c.OutputNode = r
+		for _, child := range children {
+			child.Apply(node, c)
+		}
+		c.OutputNode = old
+		return nil
+	}
+	repeat := func(inst, node xml.Node, c *ExecutionContext, children []CompiledStep) error {
+		n, err := strconv.Atoi(inst.Attr("times"))
+		for i := 0; i < n; i++ {
+			for _, child := range children {
+				child.Apply(node, c)
+			}
+		}
+		return err
+	}
+	if err := stylesheet.RegisterElement(ns, "wrap", wrap); err != nil {
+		t.Fatal(err)
+	}
+	stylesheet.RegisterElement(ns, "repeat", repeat)
+	if err := stylesheet.RegisterElement(XSLT_NAMESPACE, "wrap", wrap); err == nil {
+		t.Error("expected an error registering an element in the XSLT namespace")
+	}
+
+	output, err := stylesheet.Process(input, StylesheetOptions{})
+	if err != nil {
+		t.Error(err)
+	}
+	for _, want := range []string{
+		"<greeting>hello world</greeting>",
+		"<repeated>[3][3][3]</repeated>",
+		"<fallback>right</fallback>",
+		">xx</scoped>",
+		"true,false,true,false,false",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %s in output:\n%s", want, output)
+		}
+	}
+}
+
+// function-available() resolves its argument with the namespaces in scope
+// where it is called, not those of instructions evaluated earlier.
+func TestFunctionAvailablePrefixScope(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:template match="/">
+  <xsl:value-of xmlns:my="urn:x-test:functions" select="function-available('my:greet')"/>
+  <xsl:text>|</xsl:text>
+  <xsl:value-of select="function-available('my:greet')"/>
+</xsl:template>
+</xsl:stylesheet>`
+	stylesheet, doc := parseTransformTest(t, xsl, "<doc/>")
+	defer stylesheet.Close()
+	defer doc.Free()
+	registerTestFunctions(t, stylesheet)
+	var codes []string
+	handler := func(e *TransformError) { codes = append(codes, e.Code) }
+	output, err := stylesheet.Process(doc, StylesheetOptions{ErrorHandler: handler})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "true|false" {
+		t.Errorf("got %q, want %q", output, "true|false")
+	}
+	if strings.Join(codes, " ") != "XTDE1400" {
+		t.Error("unexpected errors reported", codes)
+	}
+}
+
+// libxml2 remembers the namespace of an extension function call in the
+// compiled expression, so it must still be found after the XPath context
+// where the expression was first evaluated is gone.
+func TestExtensionFunctionRepeatedRuns(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform" xmlns:my="urn:x-test:functions">
+<xsl:output method="text"/>
+<xsl:template match="/"><xsl:value-of select="my:greet('world')"/></xsl:template>
+</xsl:stylesheet>`
+	stylesheet, doc := parseTransformTest(t, xsl, "<doc/>")
+	defer stylesheet.Close()
+	defer doc.Free()
+	registerTestFunctions(t, stylesheet)
+	for i := 0; i < 100; i++ {
+		output, err := stylesheet.Process(doc, StylesheetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != "hello world" {
+			t.Fatalf("run %d: got %q", i, output)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package xslt
 import (
 	"fmt"
 	"math"
+	"strconv"
+	"strings"
 	"unsafe"
 
 	"github.com/jbowtie/gokogiri/xml"
@@ -19,7 +21,7 @@ func (style *Stylesheet) RegisterXsltFunctions() {
 	style.Functions["{}current"] = XsltCurrent
 	style.Functions["{}element-available"] = XsltElementAvailable
 	style.Functions["{}function-available"] = XsltFunctionAvailable
-	//format-number - requires handling decimal-format
+	style.Functions["{}format-number"] = XsltFormatNumber
 
 	style.Functions["{http://xmlsoft.org/XSLT/namespace}node-set"] = EXSLTnodeset
 	style.Functions["{http://exslt.org/common}node-set"] = EXSLTnodeset
@@ -29,90 +31,130 @@ func (style *Stylesheet) RegisterXsltFunctions() {
 	style.Functions["{http://exslt.org/math}abs"] = EXSLTmathabs
 }
 
-type Key struct {
-	nodes map[string]xml.Nodeset
-	use   string
-	match string
-}
-
 // Implementation of key() from XSLT spec
 func XsltKey(context xpath.VariableScope, args []interface{}) interface{} {
 	if len(args) < 2 {
 		return nil
 	}
-	// always convert to string
-	name := argValToString(args[0])
-
-	// convert to string
-	val := argValToString(args[1])
-	/*
-		val := ""
-		switch v := args[1].(type) {
-		case string:
-			val = v
-		case []unsafe.Pointer:
-			// nodeset; see xsl:key spec for how to handle this
-		}*/
-	//get the execution context
 	c := context.(*ExecutionContext)
-	//look up the key
-	k, ok := c.Style.Keys[name]
-	if !ok {
+	// the key is looked up in the tree containing the context node
+	node := c.xpathContextNode()
+	if node == nil {
+		node = c.Current
+	}
+	index := c.keyIndex(node, argValToString(args[0]))
+	if index == nil {
 		return nil
 	}
-	result, _ := k.nodes[val]
-	//return the nodeset
-	return result.ToPointers()
+	// a node-set selects the nodes with the string value of any of its nodes
+	var values []string
+	switch v := args[1].(type) {
+	case []unsafe.Pointer:
+		for _, p := range v {
+			values = append(values, xml.NewNode(p, nil).Content())
+		}
+	default:
+		values = []string{argValToString(v)}
+	}
+	return index.lookup(values).ToPointers()
 }
 
 // Implementation of system-property() from XSLT spec
+//
+// The argument is a QName, resolved using the namespaces in scope for the
+// expression; properties other than those in the XSLT namespace are empty.
 func XsltSystemProperty(context xpath.VariableScope, args []interface{}) interface{} {
 	if len(args) < 1 {
 		return nil
 	}
-	switch args[0].(string) {
-	case "xsl:version":
+	c := context.(*ExecutionContext)
+	ns, name, ok := c.resolveXPathQName(argValToString(args[0]))
+	if !ok || ns != XSLT_NAMESPACE {
+		return ""
+	}
+	switch name {
+	case "version":
 		return 1.0
-	case "xsl:vendor":
+	case "vendor":
 		return "John C Barstow"
-	case "xsl:vendor-url":
+	case "vendor-url":
 		return "http://github.com/jbowtie/ratago"
-	default:
-		fmt.Println("EXEC system-property", args[0])
 	}
-	return nil
+	return ""
 }
 
-//Implementation of document() from XSLT spec
+// Implementation of document() from XSLT spec
 func XsltDocumentFn(context xpath.VariableScope, args []interface{}) interface{} {
-	if len(args) < 1 {
+	if len(args) < 1 || len(args) > 2 {
 		return nil
 	}
 	c := context.(*ExecutionContext)
 
-	switch doc := args[0].(type) {
-	case string:
-		if doc == "" {
-			nodeset := xml.Nodeset{c.Style.Doc}
-			return nodeset.ToPointers()
+	// relative URIs are resolved against the first node of the second
+	// argument, if there is one
+	var base xml.Node
+	if len(args) == 2 {
+		nodes, ok := args[1].([]unsafe.Pointer)
+		if !ok {
+			c.reportError(newTransformError("XPTY0004", c.instruction, c.Current, nil, "the second argument of document() must be a node-set"))
+			return nil
 		}
-		input := c.FetchInputDocument(doc, false)
-		if input != nil {
-			nodeset := xml.Nodeset{input}
-			return nodeset.ToPointers()
+		if len(nodes) == 0 {
+			c.reportError(newTransformError("XTDE1162", c.instruction, c.Current, nil, "document() has no base URI: the second argument is empty"))
+			return nil
 		}
-		return nil
+		base = xml.NewNode(nodes[0], nil)
+	}
+
+	var result xml.Nodeset
+	switch v := args[0].(type) {
 	case []unsafe.Pointer:
-		n := xml.NewNode(doc[0], nil)
-		location := n.Content()
-		input := c.FetchInputDocument(location, true)
-		if input != nil {
-			nodeset := xml.Nodeset{input}
-			return nodeset.ToPointers()
+		// each URI is relative to the node it came from
+		for _, p := range v {
+			n := xml.NewNode(p, nil)
+			if base != nil {
+				result = append(result, c.document(n.Content(), base)...)
+			} else {
+				result = append(result, c.document(n.Content(), n)...)
+			}
+		}
+	default:
+		// otherwise it is relative to the stylesheet
+		if base == nil {
+			base = c.instruction
+		}
+		result = c.document(argValToString(v), base)
+	}
+	return c.documentOrder(result).ToPointers()
+}
+
+// Implementation of format-number() from XSLT spec
+func XsltFormatNumber(context xpath.VariableScope, args []interface{}) interface{} {
+	if len(args) < 2 || len(args) > 3 {
+		return nil
+	}
+	c := context.(*ExecutionContext)
+	qname, name := "", ""
+	if len(args) == 3 {
+		qname = argValToString(args[2])
+		ns, local, ok := c.resolveXPathQName(qname)
+		if !ok {
+			c.reportError(newTransformError("XTDE1280", c.instruction, c.Current, nil, "format-number: undeclared prefix in %s", qname))
+			return nil
 		}
-		fmt.Println("DOCUMENT", location)
+		name = expandedName(ns, local)
+	}
+	format := c.Style.LookupDecimalFormat(name)
+	if format == nil {
+		c.reportError(newTransformError("XTDE1280", c.instruction, c.Current, nil, "format-number: unknown decimal format %s", qname))
+		return nil
+	}
+	out, err := format.Format(argValToNumber(args[0]), argValToString(args[1]))
+	if err != nil {
+		c.reportError(newTransformError("XTDE1310", c.instruction, c.Current, err, "invalid picture string"))
+		return nil
 	}
-	return nil
+	return out
 }
 
 // Implementation of generate-id() from XSLT spec
@@ -121,20 +163,24 @@ func XsltGenerateId(context xpath.VariableScope, args []interface{}) interface{}
 	if len(args) > 1 {
 		return nil
 	}
-
-	//c := context.(*ExecutionContext)
+	c := context.(*ExecutionContext)
 	if len(args) < 1 {
-		fmt.Println("GENERATE-ID for current")
-		return "N" //id of context node
+		// the context node of the expression, which inside a predicate
+		// is not the current node
+		node := c.xpathContextNode()
+		if node == nil {
+			node = c.Current
+		}
+		return c.generateId(node)
 	}
 
 	switch v := args[0].(type) {
 	case []unsafe.Pointer:
+		// the ID of the first node in document order, or "" if there is none
 		if len(v) == 0 {
-			return nil
+			return ""
 		}
-		out := fmt.Sprintf("N%v", uintptr(v[0]))
-		return out
+		return c.generateId(xml.NewNode(v[0], nil))
 	default:
 		return nil
 	}
@@ -164,14 +210,53 @@ func XsltFunctionAvailable(context xpath.VariableScope, args []interface{}) inte
 		return nil
 	}
 	c := context.(*ExecutionContext)
-	qname := args[0].(string)
-	//TODO: resolve namespace of argument
-	return c.IsFunctionRegistered("", qname)
+	qname := argValToString(args[0])
+	ns, name, ok := c.resolveXPathQName(qname)
+	if !ok {
+		c.reportError(newTransformError("XTDE1400", c.instruction, c.Current, nil, "function-available: undeclared prefix in %s", qname))
+		return xpathBoolean(false)
+	}
+	available := c.IsFunctionRegistered(name, ns) || (ns == "" && xpathCoreFunctions[name])
+	return xpathBoolean(available)
+}
+
+// the functions built into libxml2's XPath implementation
+var xpathCoreFunctions = map[string]bool{
+	"last": true, "position": true, "count": true, "id": true, "local-name": true,
+	"namespace-uri": true, "name": true, "string": true, "concat": true,
+	"starts-with": true, "contains": true, "substring-before": true,
+	"substring-after": true, "substring": true, "string-length": true,
+	"normalize-space": true, "translate": true, "boolean": true, "not": true,
+	"true": true, "false": true, "lang": true, "number": true, "sum": true,
+	"floor": true, "ceiling": true, "round": true,
 }
 
 // Implementation of element-available() from XSLT spec
 func XsltElementAvailable(context xpath.VariableScope, args []interface{}) interface{} {
-	return false
+	if len(args) < 1 {
+		return nil
+	}
+	c := context.(*ExecutionContext)
+	qname := argValToString(args[0])
+	ns, name, ok := c.resolveXPathQName(qname)
+	if !ok {
+		c.reportError(newTransformError("XTDE1440", c.instruction, c.Current, nil, "element-available: undeclared prefix in %s", qname))
+		return xpathBoolean(false)
+	}
+	if ns == XSLT_NAMESPACE {
+		return xpathBoolean(xsltInstructions[name])
+	}
+	_, available := c.Style.Elements[fmt.Sprintf("{%s}%s", ns, name)]
+	return xpathBoolean(available)
+}
+
+// the XSLT 1.0 elements that are instructions (rather than top-level elements)
+var xsltInstructions = map[string]bool{
+	"apply-imports": true, "apply-templates": true, "attribute": true,
+	"call-template": true, "choose": true, "comment": true, "copy": true,
+	"copy-of": true, "element": true, "fallback": true, "for-each": true,
+	"if": true, "message": true, "number": true, "processing-instruction": true,
+	"text": true, "value-of": true, "variable": true,
 }
 
 // util function because we can't assume we're actually getting a string
@@ -188,12 +273,55 @@ func argValToString(val interface{}) (out string) {
 		}
 		n := xml.NewNode(v[0], nil)
 		out = n.Content()
+	case float64:
+		out = numberToString(v)
 	default:
 		out = fmt.Sprintf("%v", v)
 	}
 	return
 }
 
+// util function to format a number using the rules of the XPath string() function
+func numberToString(num float64) string {
+	switch {
+	case math.IsNaN(num):
+		return "NaN"
+	case math.IsInf(num, 1):
+		return "Infinity"
+	case math.IsInf(num, -1):
+		return "-Infinity"
+	case num == 0:
+		// includes negative zero
+		return "0"
+	}
+	return strconv.FormatFloat(num, 'f', -1, 64)
+}
+
+// util function to convert an argument using the rules of the XPath number() function
+func argValToNumber(val interface{}) float64 {
+	switch v := val.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case nil:
+		return math.NaN()
+	}
+	s := strings.TrimSpace(argValToString(val))
+	// XPath numbers are only digits, an optional decimal point and an optional leading minus
+	if s == "" || strings.Trim(strings.TrimPrefix(s, "-"), "0123456789.") != "" {
+		return math.NaN()
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return n
+}
+
 func EXSLTnodeset(context xpath.VariableScope, args []interface{}) interface{} {
 	if len(args) < 1 {
 		return nil
@@ -206,6 +334,8 @@ func EXSLTnodeset(context xpath.VariableScope, args []interface{}) interface{} {
 			return nil
 		}
 		fauxroot := c.Output.CreateElementNode("VARIABLE")
+		// freed along with the output document
+		c.Output.AddUnlinkedNode(fauxroot.NodePtr())
 		for _, node := range v {
 			n := xml.NewNode(node, nil)
 			fauxroot.AddChild(n)
@@ -213,8 +343,7 @@ func EXSLTnodeset(context xpath.VariableScope, args []interface{}) interface{} {
 		out := xml.Nodeset{fauxroot}
 		return out.ToPointers()
 	default:
-		out := fmt.Sprintf("%v", v)
-		fmt.Println("invalid argument to exslt:nodeset", out)
+		c.reportError(newTransformError("", nil, c.Current, nil, "invalid argument to exslt:node-set: %v", v))
 	}
 
 	return nodes
@@ -245,8 +374,9 @@ func EXSLTmathconstant(context xpath.VariableScope, args []interface{}) interfac
 	case "SQRT1_2":
 		return fmt.Sprintf("%.*f", precision, 0.70710678118654752440)
 	default:
-		out := fmt.Sprintf("%v", name)
-		fmt.Println("unsupported constant in math:constant", out)
+		if c, ok := context.(*ExecutionContext); ok {
+			c.reportError(newTransformError("", nil, c.Current, nil, "unsupported constant in math:constant: %s", name))
+		}
 	}
 
 	return 0
@@ -0,0 +1,209 @@
+package xslt
+
+import (
+	"github.com/jbowtie/gokogiri/xml"
+	"strings"
+	"testing"
+)
+
+const generateIdXsl = `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:template match="/">
+  <xsl:for-each select="//item | //@a">
+    <xsl:value-of select="generate-id()"/>
+    <xsl:if test="generate-id() != generate-id(.)">!</xsl:if>
+    <xsl:text> </xsl:text>
+  </xsl:for-each>
+  <xsl:text>[</xsl:text>
+  <xsl:value-of select="generate-id(//missing)"/>
+  <xsl:text>][</xsl:text>
+  <xsl:value-of select="generate-id(//item) = generate-id(/doc/item[1])"/>
+  <xsl:text>]</xsl:text>
+</xsl:template>
+</xsl:stylesheet>`
+
+// generate-id() with no argument is the ID of the context node; the IDs of
+// different nodes are different, and an empty node-set has an empty ID.
+func TestGenerateId(t *testing.T) {
+	input := `<doc><item a="1"/><item a="2"/><item/></doc>`
+	stylesheet, doc := parseTransformTest(t, generateIdXsl, input)
+	defer stylesheet.Close()
+	defer doc.Free()
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(output, "[][true]") || strings.Contains(output, "!") {
+		t.Fatalf("unexpected output %q", output)
+	}
+	ids := strings.Fields(strings.TrimSuffix(output, "[][true]"))
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if seen[id] {
+			t.Errorf("duplicate ID %s in %q", id, output)
+		}
+		seen[id] = true
+	}
+	if len(ids) != 5 {
+		t.Errorf("got %d IDs, want 5: %q", len(ids), output)
+	}
+}
+
+// With StableIds, the IDs depend only on the position of the nodes in
+// document order, not on where the documents happen to be in memory.
+func TestGenerateIdStable(t *testing.T) {
+	input := `<doc><item a="1"/><item a="2"/><item/></doc>`
+	stylesheet, doc := parseTransformTest(t, generateIdXsl, input)
+	defer stylesheet.Close()
+	defer doc.Free()
+	other, _ := xml.Parse([]byte(input), nil, nil, xml.StrictParseOption, nil)
+	defer other.Free()
+
+	options := StylesheetOptions{StableIds: true}
+	first, err := stylesheet.Process(doc, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := stylesheet.Process(other, options)
+	if first != second {
+		t.Errorf("IDs differ between runs: %q and %q", first, second)
+	}
+	if want := "N2 N3 N4 N5 N6 [][true]"; first != want {
+		t.Errorf("got %q, want %q", first, want)
+	}
+}
+
+// Inside a predicate, generate-id() is the ID of the node being filtered
+// rather than of the current node.
+func TestGenerateIdPredicate(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:template match="/">
+  <xsl:variable name="id" select="generate-id(//item[2])"/>
+  <xsl:for-each select="//item[generate-id() = $id]"><xsl:value-of select="@a"/></xsl:for-each>
+  <xsl:text>|</xsl:text>
+  <xsl:value-of select="count(//item[generate-id() = generate-id(current())])"/>
+</xsl:template>
+</xsl:stylesheet>`
+	stylesheet, doc := parseTransformTest(t, xsl, `<doc><item a="1"/><item a="2"/><item a="3"/></doc>`)
+	defer stylesheet.Close()
+	defer doc.Free()
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2|0"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
+// document() resolves each node of a node-set against the node's own base
+// URI, or against the second argument, drops duplicate documents and
+// selects elements by fragment identifier.
+func TestDocument(t *testing.T) {
+	resolver := mapResolver{
+		"main.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:template match="/">
+  <xsl:variable name="manifest" select="document('data/manifest.xml')"/>
+  <xsl:for-each select="document($manifest//file/@href)">[<xsl:value-of select="."/>]</xsl:for-each>
+  <xsl:text>|</xsl:text>
+  <xsl:value-of select="document('a.xml', $manifest/*)"/>
+  <xsl:text>|</xsl:text>
+  <xsl:value-of select="document('data/parts/b.xml#second')"/>
+  <xsl:text>|</xsl:text>
+  <xsl:value-of select="count(document('', /)) + count(document('')/xsl:stylesheet)"/>
+</xsl:template>
+</xsl:stylesheet>`,
+		"data/manifest.xml": `<files>
+<file href="a.xml"/><file href="parts/b.xml"/><file href="a.xml"/>
+<group xml:base="parts/"><file href="c.xml"/></group>
+</files>`,
+		"data/a.xml":       `<a>a</a>`,
+		"data/parts/b.xml": `<b><i xml:id="first">b1</i><i xml:id="second">b2</i></b>`,
+		"data/parts/c.xml": `<c>c</c>`,
+	}
+	style, _ := loadDocument(resolver, "main.xsl")
+	defer style.Free()
+	stylesheet, err := ParseStylesheetWithResolver(style, "main.xsl", resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stylesheet.Close()
+	doc, _ := xml.Parse([]byte("<doc/>"), nil, nil, xml.StrictParseOption, nil)
+	defer doc.Free()
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[a][b1b2][c]|a|b2|2"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
+// Documents that cannot be loaded and unknown fragment identifiers are
+// recoverable errors.
+func TestDocumentErrors(t *testing.T) {
+	resolver := mapResolver{
+		"main.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:template match="/">
+  <xsl:value-of select="count(document('missing.xml'))"/>
+  <xsl:value-of select="count(document('a.xml#nothing'))"/>
+  <xsl:value-of select="count(document('a.xml#here'))"/>
+</xsl:template>
+</xsl:stylesheet>`,
+		"a.xml": `<a><b xml:id="here"/></a>`,
+	}
+	style, _ := loadDocument(resolver, "main.xsl")
+	defer style.Free()
+	stylesheet, err := ParseStylesheetWithResolver(style, "main.xsl", resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stylesheet.Close()
+	doc, _ := xml.Parse([]byte("<doc/>"), nil, nil, xml.StrictParseOption, nil)
+	defer doc.Free()
+	var codes []string
+	handler := func(e *TransformError) { codes = append(codes, e.Code) }
+	output, err := stylesheet.Process(doc, StylesheetOptions{ErrorHandler: handler})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "001" {
+		t.Errorf("got %q, want %q", output, "001")
+	}
+	if strings.Join(codes, " ") != "FODC0002 XTDE1160" {
+		t.Error("unexpected errors reported", codes)
+	}
+}
+
+// system-property() resolves its QName argument with the namespaces in scope,
+// whatever the prefix, and is empty for properties it doesn't know.
+func TestSystemProperty(t *testing.T) {
+	xsl := `<x:stylesheet version="1.0" xmlns:x="http://www.w3.org/1999/XSL/Transform" xmlns:xsl="urn:not-xslt">
+<x:output method="text"/>
+<x:template match="/">
+  <x:value-of select="system-property('x:version')"/>
+  <x:text>|</x:text>
+  <x:value-of select="system-property('x:vendor-url')"/>
+  <x:text>|</x:text>
+  <x:value-of select="system-property('xsl:version')"/>
+  <x:text>|</x:text>
+  <x:value-of select="system-property('x:unknown')"/>
+  <x:text>|</x:text>
+  <x:value-of select="system-property(/doc/name)"/>
+</x:template>
+</x:stylesheet>`
+	stylesheet, doc := parseTransformTest(t, xsl, `<doc><name>x:vendor</name></doc>`)
+	defer stylesheet.Close()
+	defer doc.Free()
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1|http://github.com/jbowtie/ratago|||John C Barstow"
+	if output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
@@ -1,7 +1,6 @@
 package xslt
 
 import (
-	"fmt"
 	"github.com/jbowtie/gokogiri/xml"
 	"github.com/jbowtie/gokogiri/xpath"
 	"strings"
@@ -14,6 +13,23 @@ type XsltInstruction struct {
 	Name     string
 	Children []CompiledStep
 	sorting  []*sortCriteria
+	expr     *xpath.Expression // the select, test or value expression
+	avts     map[string]*avt   // attribute value templates, by attribute name
+	number   *numberInstruction
+	tail     bool // a call-template that is the last thing its template does
+}
+
+// the attribute holding the XPath expression evaluated by an instruction
+var instructionExpressions = map[string]string{
+	"apply-templates": "select", "for-each": "select", "copy-of": "select",
+	"value-of": "select", "if": "test", "when": "test", "number": "value",
+}
+
+// the attributes of an instruction that are attribute value templates
+var instructionAVTs = map[string][]string{
+	"element":                {"name", "namespace"},
+	"attribute":              {"name", "namespace"},
+	"processing-instruction": {"name"},
 }
 
 // Compile the instruction.
@@ -31,6 +47,36 @@ func (i *XsltInstruction) Compile(node xml.Node) {
 			i.Children = append(i.Children, res)
 		}
 	}
+	if attr, ok := instructionExpressions[i.Name]; ok {
+		i.expr = compileExpression(node, attr)
+	}
+	for _, attr := range instructionAVTs[i.Name] {
+		if a := compileAttributeAVT(node, attr); a != nil {
+			if i.avts == nil {
+				i.avts = make(map[string]*avt)
+			}
+			i.avts[attr] = a
+		}
+	}
+	if i.Name == "number" {
+		i.number = compileNumber(node)
+	}
+}
+
+// Evaluate the attribute value template in the named attribute.
+func (i *XsltInstruction) evalAVT(attr string, node xml.Node, context *ExecutionContext) string {
+	return i.avts[attr].eval(node, context)
+}
+
+// Evaluate the xsl:with-param children of the instruction, in the scope of
+// the instruction rather than that of the template they are passed to.
+func (i *XsltInstruction) evalParams(node xml.Node, context *ExecutionContext) (params []binding) {
+	for _, cur := range i.Children {
+		if p, ok := cur.(*Variable); ok && IsXsltName(p.Node, "with-param") {
+			params = append(params, binding{p.namespace, p.local, p.value(node, context)})
+		}
+	}
+	return
 }
 
 // Some instructions (such as xsl:attribute) require the template body
@@ -40,10 +86,8 @@ func (i *XsltInstruction) Compile(node xml.Node) {
 // course of evaluation.
 func (i *XsltInstruction) evalChildrenAsText(node xml.Node, context *ExecutionContext) (out string, err error) {
 	curOutput := context.OutputNode
-	context.OutputNode = context.Output.CreateElementNode("RVT")
-	for _, c := range i.Children {
-		c.Apply(node, context)
-	}
+	context.OutputNode = context.createRVT()
+	applySequence(i.Children, node, context)
 	for cur := context.OutputNode.FirstChild(); cur != nil; cur = cur.NextSibling() {
 		//TODO: generate error if cur is not a text node
 		out = out + cur.Content()
@@ -58,59 +102,30 @@ func (i *XsltInstruction) Apply(node xml.Node, context *ExecutionContext) {
 	switch i.Name {
 	case "apply-templates":
 		scope := i.Node.Attr("select")
-		mode := i.Node.Attr("mode")
-		// #current is a 2.0 keyword
-		if mode != context.Mode && mode != "#current" {
-			context.Mode = mode
-		}
-		// TODO: determine with-params at compile time
-		var params []*Variable
-		for _, cur := range i.Children {
-			switch p := cur.(type) {
-			case *Variable:
-				if IsXsltName(p.Node, "with-param") {
-					p.Apply(node, context)
-					params = append(params, p)
-				}
-			}
-		}
-		// By default, scope is children of current node
+		params := i.evalParams(node, context)
+		var nodes []xml.Node
 		if scope == "" {
-			children := context.ChildrenOf(node)
-			if i.sorting != nil {
-				i.Sort(children, context)
-			}
-			total := len(children)
-			oldpos, oldtotal := context.XPathContext.GetContextPosition()
-			oldcurr := context.Current
-			for i, cur := range children {
-				context.XPathContext.SetContextPosition(i+1, total)
-				//processNode will update Context.Current whenever a template is invoked
-				context.Style.processNode(cur, context, params)
+			// By default, scope is children of current node
+			nodes = context.ChildrenOf(node)
+		} else {
+			context.RegisterXPathNamespaces(i.Node)
+			selected, err := context.EvalXPathAsNodeset(node, i.expr)
+			if err != nil {
+				context.reportError(newTransformError("", i.Node, node, err, "cannot evaluate select=%q", scope))
 			}
-			context.XPathContext.SetContextPosition(oldpos, oldtotal)
-			context.Current = oldcurr
-			return
-		}
-		context.RegisterXPathNamespaces(i.Node)
-		e := xpath.Compile(scope)
-		// TODO: ensure we apply strip-space if required
-		nodes, err := context.EvalXPathAsNodeset(node, e)
-		if err != nil {
-			fmt.Println("apply-templates @select", err)
+			nodes = selected
 		}
 		if i.sorting != nil {
-			i.Sort(nodes, context)
+			i.Sort(nodes, node, context)
 		}
-		total := len(nodes)
-		oldpos, oldtotal := context.XPathContext.GetContextPosition()
-		oldcurr := context.Current
-		for i, cur := range nodes {
-			context.XPathContext.SetContextPosition(i+1, total)
-			context.Style.processNode(cur, context, params)
+		// the nodes are processed in the mode named by the instruction
+		// (#current is a 2.0 keyword), which only lasts until we return
+		oldmode := context.Mode
+		if mode := i.Node.Attr("mode"); mode != "#current" {
+			context.Mode = mode
 		}
-		context.XPathContext.SetContextPosition(oldpos, oldtotal)
-		context.Current = oldcurr
+		context.Style.processNodes(nodes, context, params)
+		context.Mode = oldmode
 	case "number":
 		i.numbering(node, context)
 
@@ -131,30 +146,19 @@ func (i *XsltInstruction) Apply(node xml.Node, context *ExecutionContext) {
 		name := i.Node.Attr("name")
 		t, ok := context.Style.NamedTemplates[name]
 		if ok && t != nil {
-			// TODO: determine with-params at compile time
-			var params []*Variable
-			for _, cur := range i.Children {
-				switch p := cur.(type) {
-				case *Variable:
-					if IsXsltName(p.Node, "with-param") {
-						p.Apply(node, context)
-						params = append(params, p)
-					}
-				}
+			params := i.evalParams(node, context)
+			if i.tail {
+				// the calling template makes the call once it is done
+				context.tailCall = &tailCall{t, params}
+				return
 			}
 			t.Apply(node, context, params)
 		}
 
 	case "element":
-		ename := i.Node.Attr("name")
-		if strings.ContainsRune(ename, '{') {
-			ename = evalAVT(ename, node, context)
-		}
+		ename := i.evalAVT("name", node, context)
 		r := context.Output.CreateElementNode(ename)
-		ns := i.Node.Attr("namespace")
-		if strings.ContainsRune(ns, '{') {
-			ns = evalAVT(ns, node, context)
-		}
+		ns := i.evalAVT("namespace", node, context)
 		if ns != "" {
 			//TODO: search through namespaces in-scope
 			// not just top-level stylesheet mappings
@@ -183,9 +187,7 @@ func (i *XsltInstruction) Apply(node xml.Node, context *ExecutionContext) {
 				}
 			}
 		}
-		for _, c := range i.Children {
-			c.Apply(node, context)
-		}
+		applySequence(i.Children, node, context)
 		context.OutputNode = old
 
 	case "comment":
@@ -194,21 +196,15 @@ func (i *XsltInstruction) Apply(node xml.Node, context *ExecutionContext) {
 		context.OutputNode.AddChild(r)
 
 	case "processing-instruction":
-		name := i.Node.Attr("name")
+		name := i.evalAVT("name", node, context)
 		val, _ := i.evalChildrenAsText(node, context)
 		//TODO: it is an error if val contains "?>"
 		r := context.Output.CreatePINode(name, val)
 		context.OutputNode.AddChild(r)
 
 	case "attribute":
-		aname := i.Node.Attr("name")
-		if strings.ContainsRune(aname, '{') {
-			aname = evalAVT(aname, node, context)
-		}
-		ahref := i.Node.Attr("namespace")
-		if strings.ContainsRune(ahref, '{') {
-			ahref = evalAVT(ahref, node, context)
-		}
+		aname := i.evalAVT("name", node, context)
+		ahref := i.evalAVT("namespace", node, context)
 		val, _ := i.evalChildrenAsText(node, context)
 		if ahref == "" {
 			context.OutputNode.SetAttr(aname, val)
@@ -234,11 +230,10 @@ func (i *XsltInstruction) Apply(node xml.Node, context *ExecutionContext) {
 		//context.OutputNode.AddChild(a)
 
 	case "value-of":
-		e := xpath.Compile(i.Node.Attr("select"))
 		disableEscaping := i.Node.Attr("disable-output-escaping") == "yes"
 
 		context.RegisterXPathNamespaces(i.Node)
-		content, _ := context.EvalXPathAsString(node, e)
+		content, _ := context.EvalXPathAsString(node, i.expr)
 		//don't bother creating a text node for an empty string
 		if content != "" {
 			if context.UseCDataSection(context.OutputNode) {
@@ -261,16 +256,17 @@ func (i *XsltInstruction) Apply(node xml.Node, context *ExecutionContext) {
 		}
 	case "when":
 	case "if":
-		e := xpath.Compile(i.Node.Attr("test"))
-		if context.EvalXPathAsBoolean(node, e) {
-			for _, c := range i.Children {
-				c.Apply(node, context)
-			}
+		context.RegisterXPathNamespaces(i.Node)
+		if context.EvalXPathAsBoolean(node, i.expr) {
+			applySequence(i.Children, node, context)
 		}
 	case "attribute-set":
-		for _, c := range i.Children {
-			c.Apply(node, context)
-		}
+		// attribute sets are declared at the top level, so the local
+		// variables of the instruction using them are not in scope
+		frame := context.frame
+		context.frame = len(context.bindings)
+		applySequence(i.Children, node, context)
+		context.frame = frame
 		othersets := i.Node.Attr("use-attribute-sets")
 		if othersets != "" {
 			asets := strings.Fields(othersets)
@@ -282,23 +278,17 @@ func (i *XsltInstruction) Apply(node xml.Node, context *ExecutionContext) {
 			}
 		}
 	case "fallback":
-		for _, c := range i.Children {
-			c.Apply(node, context)
-		}
+		// only instantiated when the parent instruction is not implemented
 	case "otherwise":
-		for _, c := range i.Children {
-			c.Apply(node, context)
-		}
+		applySequence(i.Children, node, context)
 
 	case "choose":
 		for _, c := range i.Children {
 			inst := c.(*XsltInstruction)
 			if inst.Node.Name() == "when" {
-				xp := xpath.Compile(inst.Node.Attr("test"))
-				if context.EvalXPathAsBoolean(node, xp) {
-					for _, wc := range inst.Children {
-						wc.Apply(node, context)
-					}
+				context.RegisterXPathNamespaces(inst.Node)
+				if context.EvalXPathAsBoolean(node, inst.expr) {
+					applySequence(inst.Children, node, context)
 					break
 				}
 			} else {
@@ -361,40 +351,30 @@ func (i *XsltInstruction) Apply(node xml.Node, context *ExecutionContext) {
 					}
 				}
 			}
-			for _, c := range i.Children {
-				c.Apply(node, context)
-			}
+			applySequence(i.Children, node, context)
 			context.OutputNode = old
 		}
 	case "for-each":
-		scope := i.Node.Attr("select")
-		e := xpath.Compile(scope)
 		context.RegisterXPathNamespaces(i.Node)
-		nodes, _ := context.EvalXPathAsNodeset(node, e)
+		nodes, _ := context.EvalXPathAsNodeset(node, i.expr)
 		if i.sorting != nil {
-			i.Sort(nodes, context)
+			i.Sort(nodes, node, context)
 		}
 		total := len(nodes)
 		old_curr := context.Current
+		// there is no current template rule inside xsl:for-each
+		oldTemplate := context.CurrentTemplate
+		context.CurrentTemplate = nil
 		for j, cur := range nodes {
-			context.PushStack()
 			context.XPathContext.SetContextPosition(j+1, total)
 			context.Current = cur
-			for _, c := range i.Children {
-				c.Apply(cur, context)
-				switch v := c.(type) {
-				case *Variable:
-					_ = context.DeclareLocalVariable(v.Name, "", v)
-				}
-			}
-			context.PopStack()
+			applySequence(i.Children, cur, context)
 		}
 		context.Current = old_curr
+		context.CurrentTemplate = oldTemplate
 	case "copy-of":
-		scope := i.Node.Attr("select")
-		e := xpath.Compile(scope)
 		context.RegisterXPathNamespaces(i.Node)
-		nodes, _ := context.EvalXPathAsNodeset(node, e)
+		nodes, _ := context.EvalXPathAsNodeset(node, i.expr)
 		total := len(nodes)
 		for j, cur := range nodes {
 			context.XPathContext.SetContextPosition(j+1, total)
@@ -405,92 +385,44 @@ func (i *XsltInstruction) Apply(node xml.Node, context *ExecutionContext) {
 		val, _ := i.evalChildrenAsText(node, context)
 		terminate := i.Node.Attr("terminate")
 		if terminate == "yes" {
-			//TODO: fixup error flow to terminate more gracefully
-			panic(val)
+			// unwinds to Process, which returns it as an error
+			panic(newTransformError("XTMM9000", i.Node, node, nil, "%s", val))
 		} else {
-			fmt.Println(val)
+			// kept out of the result, which may itself be going to stdout
+			context.warn(newTransformError("", i.Node, node, nil, "%s", val))
 		}
 	case "apply-imports":
-		fmt.Println("TODO handle xsl:apply-imports instruction")
-	default:
-		hasFallback := false
-		for _, c := range i.Children {
-			switch v := c.(type) {
-			case *XsltInstruction:
-				if v.Name == "fallback" {
-					c.Apply(node, context)
-					hasFallback = true
-					break
-				}
-			}
+		if context.CurrentTemplate == nil {
+			context.reportError(newTransformError("XTDE0560", i.Node, node, nil, "xsl:apply-imports used when there is no current template rule"))
+			return
 		}
-		if !hasFallback {
-			fmt.Println("UNKNOWN instruction ", i.Name)
+		context.Style.applyImports(node, context)
+	default:
+		if !applyFallback(i.Children, node, context) {
+			context.reportError(newTransformError("XTSE0010", i.Node, node, nil, "unknown instruction xsl:%s", i.Name))
 		}
 	}
 }
 
 func (i *XsltInstruction) numbering(node xml.Node, context *ExecutionContext) {
-	//level
-	level := i.Node.Attr("level")
-	if level == "" {
-		level = "single"
-	}
-	//count
-	count := i.Node.Attr("count")
-	if count == "" {
-		//TODO: qname (should match NS as well
-		count = node.Name()
-	}
-	//from
-	from := i.Node.Attr("from")
-	//value
-	valattr := i.Node.Attr("value")
-	//format
-	format := i.Node.Attr("format")
-	if format == "" {
-		format = "1"
-	}
-	//lang
-	//letter-value
-	//grouping-seperator
-	//grouping-size
+	format, f := i.number.evalFormat(node, context)
 
-	var numbers []int
-	//if value, just use that!
-	if valattr != "" {
-		v, _ := node.EvalXPath(valattr, context)
-		if v == nil {
-			numbers = append(numbers, 0)
-		} else {
-			numbers = append(numbers, int(v.(float64)))
+	var outtxt string
+	if i.expr != nil {
+		//if value, just use that!
+		context.RegisterXPathNamespaces(i.Node)
+		_, err := context.EvalXPath(node, i.expr)
+		if err != nil {
+			context.reportError(newTransformError("", i.Node, node, err, "cannot evaluate value=%q", i.expr))
+			return
 		}
+		v, _ := context.XPathContext.ResultAsNumber()
+		outtxt = formatValue(v, format, f)
 	} else {
-
-		target := findTarget(node, count)
-		v := countNodes(level, target, count, from)
-		numbers = append(numbers, v)
-
-		if level == "multiple" {
-			for cur := target.Parent(); cur != nil; cur = cur.Parent() {
-				v = countNodes(level, cur, count, from)
-				if v > 0 {
-					numbers = append(numbers, v)
-				}
-			}
-			if len(numbers) > 1 {
-				for i, j := 0, len(numbers)-1; i < j; i, j = i+1, j-1 {
-					numbers[i], numbers[j] = numbers[j], numbers[i]
-				}
-			}
-		}
+		numbers := i.number.placeMarkers(node, context)
+		outtxt = formatNumbers(numbers, format, f)
 	}
 
-	// level = multiple
-	// count preceding siblings AT EACH LEVEL
-
-	// format using the format string
-	outtxt := formatNumbers(numbers, format)
 	r := context.Output.CreateTextNode(outtxt)
 	context.OutputNode.AddChild(r)
 }
@@ -557,7 +489,7 @@ func (i *XsltInstruction) copyToOutput(node xml.Node, context *ExecutionContext,
 			for _, attr := range node.AttributeList() {
 				i.copyToOutput(attr, context, recursive)
 			}
-			for cur := node.FirstChild(); cur != nil; cur = cur.NextSibling() {
+			for _, cur := range context.ChildrenOf(node) {
 				i.copyToOutput(cur, context, recursive)
 			}
 		}
@@ -0,0 +1,173 @@
+package xslt
+
+import (
+	"github.com/jbowtie/gokogiri/xml"
+	"github.com/jbowtie/gokogiri/xpath"
+	"sort"
+	"unsafe"
+)
+
+// Key is a compiled xsl:key declaration. The index itself is built
+// separately for each transformation.
+type Key struct {
+	node     xml.Node // the xsl:key element, for resolving prefixes in use
+	use      *xpath.Expression
+	match    string
+	patterns []*CompiledMatch // the compiled alternatives of match
+}
+
+// Key indexes are built the first time a key is used for a tree during a
+// transformation: the source document, a document loaded with document(),
+// or a result tree fragment. The index for a name covers every xsl:key
+// declaration with that name, including those in imported modules.
+
+// Identifies the index of a key for one tree.
+type keyIndexID struct {
+	root unsafe.Pointer // the root node of the tree
+	name string         // the expanded name of the key
+}
+
+type keyIndex struct {
+	nodes    map[string]xml.Nodeset // the nodes with each key value, in document order
+	order    map[unsafe.Pointer]int // the position of each indexed node in document order
+	building bool                   // set while the tree is walked, to detect circular keys
+}
+
+// The xsl:key declarations with the expanded name in the stylesheet and the
+// modules it imports. Import precedence doesn't matter; all of them contribute.
+func (style *Stylesheet) lookupKeys(name string) (keys []*Key) {
+	keys = append(keys, style.Keys[name]...)
+	for _, s := range style.Imports {
+		keys = append(keys, s.lookupKeys(name)...)
+	}
+	return
+}
+
+// The root of the tree containing node.
+func treeRoot(node xml.Node) xml.Node {
+	for parent := node.Parent(); parent != nil; parent = node.Parent() {
+		node = parent
+	}
+	return node
+}
+
+// The index of the key named by qname for the tree containing node, building
+// it if necessary. The prefix of qname is resolved with the namespaces in
+// scope for the current instruction. Returns nil, after reporting an error,
+// if there is no key with that name.
+func (context *ExecutionContext) keyIndex(node xml.Node, qname string) *keyIndex {
+	ns, local, ok := context.resolveXPathQName(qname)
+	if !ok {
+		context.reportError(newTransformError("XTDE1260", context.instruction, node, nil, "key: undeclared prefix in %s", qname))
+		return nil
+	}
+	name := expandedName(ns, local)
+	root := treeRoot(node)
+	id := keyIndexID{root.NodePtr(), name}
+	if ix, ok := context.keys[id]; ok {
+		if ix.building {
+			// a match or use expression of the key depends on the key itself
+			context.reportError(newTransformError("XTDE0640", nil, node, nil, "circular definition of key %s", qname))
+			return nil
+		}
+		return ix
+	}
+	keys := context.Style.lookupKeys(name)
+	if len(keys) == 0 {
+		context.reportError(newTransformError("XTDE1260", context.instruction, node, nil, "no key named %s", qname))
+		return nil
+	}
+	if context.keys == nil {
+		context.keys = make(map[keyIndexID]*keyIndex)
+	}
+	ix := &keyIndex{
+		nodes:    make(map[string]xml.Nodeset),
+		order:    make(map[unsafe.Pointer]int),
+		building: true,
+	}
+	context.keys[id] = ix
+
+	// Indexes are usually built while key() is evaluated, so the patterns
+	// and use expressions get an XPath context of their own; gokogiri can't
+	// evaluate an expression on a context that is already in use.
+	outer, current, instruction := context.XPathContext, context.Current, context.instruction
+	context.XPathContext = xpath.NewXPath(context.Source.DocPtr())
+	ix.add(root, keys, context)
+	freeXPath(context.XPathContext)
+	context.XPathContext, context.Current, context.instruction = outer, current, instruction
+	ix.building = false
+	return ix
+}
+
+// Index node, its attributes and its descendants.
+func (ix *keyIndex) add(node xml.Node, keys []*Key, context *ExecutionContext) {
+	ix.addNode(node, keys, context)
+	if node.NodeType() == xml.XML_ELEMENT_NODE {
+		for _, attr := range node.AttributeList() {
+			ix.addNode(attr, keys, context)
+		}
+	}
+	for _, cur := range context.ChildrenOf(node) {
+		ix.add(cur, keys, context)
+	}
+}
+
+func (ix *keyIndex) addNode(node xml.Node, keys []*Key, context *ExecutionContext) {
+	for _, key := range keys {
+		if !matchesOne(node, key.patterns, context) {
+			continue
+		}
+		// use is evaluated with the node as the current node, at position 1 of 1
+		context.Current = node
+		context.XPathContext.SetContextPosition(1, 1)
+		context.RegisterXPathNamespaces(key.node)
+		result, err := context.EvalXPath(node, key.use)
+		if err != nil {
+			context.reportError(newTransformError("", key.node, node, err, "cannot evaluate use=%q", key.use))
+			continue
+		}
+		// a node-set is indexed under the string value of every node in it
+		if nodes, ok := result.([]xml.Node); ok {
+			for _, n := range nodes {
+				ix.insert(n.Content(), node)
+			}
+		} else {
+			ix.insert(argValToString(result), node)
+		}
+	}
+}
+
+func (ix *keyIndex) insert(val string, node xml.Node) {
+	ptr := node.NodePtr()
+	if _, ok := ix.order[ptr]; !ok {
+		ix.order[ptr] = len(ix.order)
+	}
+	// nodes are indexed in document order, so a node already indexed under
+	// this value is at the end of the list
+	nodes := ix.nodes[val]
+	if len(nodes) > 0 && nodes[len(nodes)-1].NodePtr() == ptr {
+		return
+	}
+	ix.nodes[val] = append(nodes, node)
+}
+
+// The nodes with any of the values, without duplicates and in document order.
+func (ix *keyIndex) lookup(values []string) xml.Nodeset {
+	if len(values) == 1 {
+		return ix.nodes[values[0]]
+	}
+	seen := make(map[unsafe.Pointer]bool)
+	var result xml.Nodeset
+	for _, val := range values {
+		for _, n := range ix.nodes[val] {
+			if !seen[n.NodePtr()] {
+				seen[n.NodePtr()] = true
+				result = append(result, n)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return ix.order[result[i].NodePtr()] < ix.order[result[j].NodePtr()]
+	})
+	return result
+}
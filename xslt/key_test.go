@@ -0,0 +1,145 @@
+package xslt
+
+import (
+	"github.com/jbowtie/gokogiri/xml"
+	"strings"
+	"testing"
+)
+
+// Every value of a node-set use is indexed, declarations sharing a name
+// are combined, and a node-set argument to key() selects the union of the
+// nodes for each of its values, in document order.
+func TestKeyValues(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:key name="tag" match="item" use="tag"/>
+<xsl:key name="tag" match="note" use="@about"/>
+<xsl:key name="tag" match="@label" use="."/>
+<xsl:template match="/">
+  <xsl:for-each select="key('tag', 'red')">[<xsl:value-of select="name()"/>:<xsl:value-of select="@id"/>]</xsl:for-each>
+  <xsl:text>|</xsl:text>
+  <xsl:for-each select="key('tag', //want)">[<xsl:value-of select="name()"/>:<xsl:value-of select="@id"/>]</xsl:for-each>
+  <xsl:text>|</xsl:text>
+  <xsl:value-of select="count(key('tag', 'none'))"/>
+</xsl:template>
+</xsl:stylesheet>`
+	input := `<doc>
+<item id="1"><tag>red</tag><tag>blue</tag></item>
+<item id="2" label="blue"><tag>green</tag></item>
+<note id="3" about="red"/>
+<item id="4"><tag>blue</tag><tag>blue</tag></item>
+<want>green</want><want>blue</want>
+</doc>`
+	stylesheet, doc := parseTransformTest(t, xsl, input)
+	defer stylesheet.Close()
+	defer doc.Free()
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[item:1][note:3]|[item:1][item:2][label:][item:4]|0"
+	if output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
+// Keys declared in imported modules can be used, and key() looks in the
+// document containing the context node, including documents loaded with
+// document().
+func TestKeyDocuments(t *testing.T) {
+	resolver := mapResolver{
+		"main.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:import href="keys.xsl"/>
+<xsl:output method="text"/>
+<xsl:template match="/">
+  <xsl:for-each select="//ref">
+    <xsl:variable name="id" select="@to"/>
+    <xsl:value-of select="key('id', $id)"/>
+    <xsl:for-each select="document('other.xml')">/<xsl:value-of select="key('id', $id)"/></xsl:for-each>
+    <xsl:text>;</xsl:text>
+  </xsl:for-each>
+  <xsl:for-each select="document('other.xml')//def[key('id', @id)/@alt]">(<xsl:value-of select="."/>)</xsl:for-each>
+</xsl:template>
+</xsl:stylesheet>`,
+		"keys.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:key name="id" match="def" use="@id"/>
+</xsl:stylesheet>`,
+		"other.xml": `<defs><def id="a">other a</def><def id="b" alt="yes">other b</def></defs>`,
+	}
+	style, _ := loadDocument(resolver, "main.xsl")
+	defer style.Free()
+	stylesheet, err := ParseStylesheetWithResolver(style, "main.xsl", resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stylesheet.Close()
+	doc, _ := xml.Parse([]byte(`<doc><def id="a">main a</def><ref to="a"/><ref to="b"/></doc>`), nil, nil, xml.StrictParseOption, nil)
+	defer doc.Free()
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "main a/other a;/other b;(other b)"
+	if output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
+// A key whose use expression depends on the key itself is an error.
+func TestKeyCircular(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:key name="k" match="item" use="key('k', 'x')"/>
+<xsl:template match="/"><xsl:value-of select="count(key('k', 'x'))"/></xsl:template>
+</xsl:stylesheet>`
+	stylesheet, doc := parseTransformTest(t, xsl, "<doc><item/></doc>")
+	defer stylesheet.Close()
+	defer doc.Free()
+	_, err := stylesheet.Process(doc, StylesheetOptions{})
+	if terr, ok := err.(*TransformError); !ok || terr.Code != "XTDE0640" {
+		t.Error("expected XTDE0640, got", err)
+	}
+}
+
+// Key names are expanded names, so modules can use different prefixes for
+// the namespace of a key; a key that isn't declared is an error.
+func TestKeyNames(t *testing.T) {
+	resolver := mapResolver{
+		"main.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform" xmlns:a="urn:x-test:keys">
+<xsl:import href="keys.xsl"/>
+<xsl:output method="text"/>
+<xsl:template match="/">
+  <xsl:value-of select="key('a:id', 'x')"/>
+  <xsl:text>|</xsl:text>
+  <xsl:value-of select="count(key('id', 'x'))"/>
+  <xsl:text>|</xsl:text>
+  <xsl:apply-templates select="doc/def"/>
+</xsl:template>
+<xsl:template match="key('a:id', 'x')">matched</xsl:template>
+</xsl:stylesheet>`,
+		"keys.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform" xmlns:b="urn:x-test:keys">
+<xsl:key name="b:id" match="def" use="@id"/>
+</xsl:stylesheet>`,
+	}
+	style, _ := loadDocument(resolver, "main.xsl")
+	defer style.Free()
+	stylesheet, err := ParseStylesheetWithResolver(style, "main.xsl", resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stylesheet.Close()
+	doc, _ := xml.Parse([]byte(`<doc><def id="x">def x</def></doc>`), nil, nil, xml.StrictParseOption, nil)
+	defer doc.Free()
+	var codes []string
+	handler := func(e *TransformError) { codes = append(codes, e.Code) }
+	output, err := stylesheet.Process(doc, StylesheetOptions{ErrorHandler: handler})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "def x|0|matched"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+	if strings.Join(codes, " ") != "XTDE1260" {
+		t.Error("unexpected errors reported", codes)
+	}
+}
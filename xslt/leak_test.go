@@ -0,0 +1,75 @@
+//go:build !race
+// +build !race
+
+package xslt
+
+import (
+	"fmt"
+	"github.com/jbowtie/gokogiri/xml"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Repeatedly compile, run and close a stylesheet that builds result tree
+// fragments and loads documents, checking that every document, node and
+// attribute libxml2 creates for them is freed.
+func TestNoMemoryLeak(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping repeated transformations in short mode")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	countNodes(true)
+	defer countNodes(false)
+	var items []string
+	for i := 0; i < 500; i++ {
+		items = append(items, fmt.Sprintf(`<item n="%d">item number %d</item>`, i, i))
+	}
+	resolver := mapResolver{
+		"main.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:include href="common.xsl"/>
+<xsl:template match="/">
+  <xsl:variable name="copy"><xsl:copy-of select="doc/item"/></xsl:variable>
+  <out>
+    <xsl:for-each select="doc/item"><xsl:sort select="@n" data-type="number" order="descending"/>
+      <xsl:attribute name="a{@n}"><xsl:value-of select="."/></xsl:attribute>
+    </xsl:for-each>
+    <xsl:call-template name="common"/>
+    <xsl:copy-of select="document('extra.xml')"/>
+    <xsl:value-of select="count($copy)"/>
+  </out>
+</xsl:template>
+</xsl:stylesheet>`,
+		"common.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:template name="common"><xsl:apply-templates select="doc/item"/></xsl:template>
+<xsl:template match="item"><copy><xsl:copy-of select="."/></copy></xsl:template>
+</xsl:stylesheet>`,
+		"extra.xml": "<extra>" + strings.Join(items, "") + "</extra>",
+	}
+	input, _ := xml.Parse([]byte("<doc>"+strings.Join(items, "")+"</doc>"), nil, nil, xml.StrictParseOption, nil)
+	defer input.Free()
+
+	run := func(n int) {
+		for i := 0; i < n; i++ {
+			style, _ := loadDocument(resolver, "main.xsl")
+			stylesheet, err := ParseStylesheetWithResolver(style, "main.xsl", resolver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = stylesheet.Process(input, StylesheetOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			stylesheet.Close()
+			style.Free()
+		}
+		runtime.GC()
+	}
+	// let the allocators reach a steady state before measuring
+	run(10)
+	before := liveNodes()
+	run(50)
+	if leaked := liveNodes() - before; leaked != 0 {
+		t.Errorf("%d libxml2 nodes were not freed after 50 transformations", leaked)
+	}
+}
@@ -0,0 +1,191 @@
+package xslt
+
+/*
+#cgo pkg-config: libxml-2.0
+
+#include <stdint.h>
+#include <stdlib.h>
+#include <libxml/xmlsave.h>
+#include <libxml/encoding.h>
+#include <libxml/xpath.h>
+#include <libxml/xpathInternals.h>
+#include <libxml/globals.h>
+#include <libxml/hash.h>
+#include <libxml/tree.h>
+
+// gokogiri doesn't expose the context node of an XPath evaluation.
+static xmlNodePtr xpath_context_node(xmlXPathContextPtr ctxt) {
+	return ctxt->node;
+}
+
+// libxml2 caches the namespace URI of a function call in the compiled
+// expression, pointing at the string registered with the XPath context where
+// it was first evaluated. xmlXPathRegisterNs frees that string when the prefix
+// is registered again or the context is freed, so we register strings owned
+// by the stylesheet instead, which last as long as its expressions do.
+static void register_ns(xmlXPathContextPtr ctxt, const char *prefix, const char *uri) {
+	if (ctxt->nsHash == NULL)
+		ctxt->nsHash = xmlHashCreate(10);
+	xmlHashUpdateEntry(ctxt->nsHash, (const xmlChar *) prefix, (void *) uri, NULL);
+}
+
+// Unregister the namespaces without freeing their URIs.
+static void forget_ns(xmlXPathContextPtr ctxt) {
+	xmlHashFree(ctxt->nsHash, NULL);
+	ctxt->nsHash = NULL;
+}
+
+extern int ratagoWriteOutput(uintptr_t writer, char *buf, int len);
+
+static int write_output(void *writer, const char *buf, int len) {
+	return ratagoWriteOutput((uintptr_t) writer, (char *) buf, len);
+}
+
+// Serialize node, passing each chunk to the Go writer as libxml produces it.
+static int save_node(xmlNodePtr node, const char *encoding, int options, uintptr_t writer) {
+	xmlSaveCtxtPtr save = xmlSaveToIO(write_output, NULL, (void *) writer, encoding, options);
+	if (save == NULL)
+		return -1;
+	xmlSaveTree(save, node);
+	return xmlSaveClose(save);
+}
+
+static int encoding_supported(const char *name) {
+	xmlCharEncodingHandlerPtr handler = xmlFindCharEncodingHandler(name);
+	if (handler == NULL)
+		return 0;
+	xmlCharEncCloseFunc(handler);
+	return 1;
+}
+
+static long live_nodes;
+
+static void register_node(xmlNodePtr node) {
+	__atomic_add_fetch(&live_nodes, 1, __ATOMIC_RELAXED);
+}
+
+static void deregister_node(xmlNodePtr node) {
+	__atomic_sub_fetch(&live_nodes, 1, __ATOMIC_RELAXED);
+}
+
+static void count_nodes(int on) {
+	xmlRegisterNodeDefault(on ? register_node : NULL);
+	xmlDeregisterNodeDefault(on ? deregister_node : NULL);
+}
+
+static long counted_nodes(void) {
+	return __atomic_load_n(&live_nodes, __ATOMIC_RELAXED);
+}
+*/
+import "C"
+
+import (
+	"github.com/jbowtie/gokogiri/xml"
+	"github.com/jbowtie/gokogiri/xpath"
+	"unsafe"
+)
+
+// The context node of the expression being evaluated with the libxml2
+// XPath context ctxt, or nil if there is none.
+func xpathContextNodePtr(ctxt unsafe.Pointer) unsafe.Pointer {
+	return unsafe.Pointer(C.xpath_context_node((C.xmlXPathContextPtr)(ctxt)))
+}
+
+// Bind prefix to uri in the XPath context x, using the stylesheet's copy of
+// the URI. A default namespace doesn't apply to XPath, so it is ignored.
+func (style *Stylesheet) registerXPathNamespace(x *xpath.XPath, prefix, uri string) {
+	if prefix == "" {
+		return
+	}
+	p := C.CString(prefix)
+	defer C.free(unsafe.Pointer(p))
+	C.register_ns((C.xmlXPathContextPtr)(unsafe.Pointer(x.ContextPtr)), p, style.namespaceURI(uri))
+}
+
+// The stylesheet's C copy of a namespace URI, which is freed by Close.
+func (style *Stylesheet) namespaceURI(uri string) *C.char {
+	style.nsLock.Lock()
+	defer style.nsLock.Unlock()
+	if p, ok := style.nsURIs[uri]; ok {
+		return (*C.char)(p)
+	}
+	if style.nsURIs == nil {
+		style.nsURIs = make(map[string]unsafe.Pointer)
+	}
+	p := C.CString(uri)
+	style.nsURIs[uri] = unsafe.Pointer(p)
+	return p
+}
+
+func (style *Stylesheet) freeNamespaceURIs() {
+	style.nsLock.Lock()
+	defer style.nsLock.Unlock()
+	for _, p := range style.nsURIs {
+		C.free(p)
+	}
+	style.nsURIs = nil
+}
+
+// Free an XPath context whose namespaces were registered with
+// registerXPathNamespace, leaving the URIs to the stylesheet.
+func freeXPath(x *xpath.XPath) {
+	if x.ContextPtr != nil {
+		C.forget_ns((C.xmlXPathContextPtr)(unsafe.Pointer(x.ContextPtr)))
+	}
+	x.Free()
+}
+
+// Serialize node with the libxml save options, passing the output to the
+// outputWriter registered as writer. Returns a negative number on failure.
+func saveNode(node unsafe.Pointer, encoding string, options int, writer uintptr) int {
+	var e *C.char
+	if encoding != "" {
+		e = C.CString(encoding)
+		defer C.free(unsafe.Pointer(e))
+	}
+	return int(C.save_node((C.xmlNodePtr)(node), e, C.int(options), C.uintptr_t(writer)))
+}
+
+// Returns true if libxml is able to serialize to the named encoding.
+func encodingSupported(encoding string) bool {
+	e := C.CString(encoding)
+	defer C.free(unsafe.Pointer(e))
+	return C.encoding_supported(e) != 0
+}
+
+// A copy of the document, including its DTD and IDs, which the caller must
+// free.
+func copyDocument(doc *xml.XmlDocument) *xml.XmlDocument {
+	p := unsafe.Pointer(C.xmlCopyDoc((C.xmlDocPtr)(doc.DocPtr()), 1))
+	if p == nil {
+		return nil
+	}
+	return xml.NewDocument(p, 0, doc.InputEncoding(), doc.OutputEncoding())
+}
+
+// Start or stop counting the documents, nodes and attributes libxml2
+// creates and frees, so the tests can check that nothing is left behind.
+// libxml2 keeps the callbacks per thread, so the caller should be locked
+// to its OS thread.
+func countNodes(on bool) {
+	c := C.int(0)
+	if on {
+		c = 1
+	}
+	C.count_nodes(c)
+}
+
+// A new libxml2 XPath boolean object, owned by whoever it is returned to.
+// gokogiri can only hand numbers, strings and node-sets back to libxml.
+func xpathBoolean(b bool) unsafe.Pointer {
+	v := C.int(0)
+	if b {
+		v = 1
+	}
+	return unsafe.Pointer(C.xmlXPathNewBoolean(v))
+}
+
+// The number of nodes created but not yet freed while counting.
+func liveNodes() int {
+	return int(C.counted_nodes())
+}
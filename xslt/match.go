@@ -1,669 +1,819 @@
 package xslt
 
 import (
-	"container/list"
+	"fmt"
 	"github.com/jbowtie/gokogiri/xml"
 	"github.com/jbowtie/gokogiri/xpath"
-	"strconv"
 	"strings"
+	"unicode"
 	"unicode/utf8"
 )
 
-type StepOperation int
+// The compiled match pattern. A pattern such as "a | b" is compiled to
+// one CompiledMatch for each alternative, since each has its own default
+// priority.
+type CompiledMatch struct {
+	pattern  string
+	path     *pathPattern
+	Template *Template
+	node     xml.Node // the stylesheet element holding the pattern
+	priority float64  // the priority of this alternative of the template's pattern
+}
+
+// A location path pattern (section 5.2 of the XSLT 1.0 spec).
+//
+// The steps are stored last step first, since the last step is the one
+// tested against the candidate node; each preceding step is then tested
+// against its parent or one of its ancestors.
+type pathPattern struct {
+	steps []*stepPattern
+	root  bool          // the pattern starts with / or //
+	idKey *idKeyPattern // the pattern starts with id() or key()
+}
+
+type patternAxis int
 
 const (
-	OP_END StepOperation = iota
-	OP_ROOT
-	OP_ELEM
-	OP_ATTR
-	OP_PARENT
-	OP_ANCESTOR
-	OP_ID
-	OP_KEY
-	OP_NS
-	OP_ALL
-	OP_PI
-	OP_COMMENT
-	OP_TEXT
-	OP_NODE
-	OP_PREDICATE
-	OP_OR
-	OP_ERROR
+	childAxis patternAxis = iota
+	attributeAxis
 )
 
-// An individual step in the pattern
-type MatchStep struct {
-	Op    StepOperation
-	Value string
+// A step in a location path pattern.
+type stepPattern struct {
+	axis       patternAxis
+	test       nodeTest
+	predicates []*xpath.Expression
+	ancestor   bool // separated from what precedes it by // rather than /
 }
 
-// The compiled match pattern
-type CompiledMatch struct {
-	pattern  string
-	Steps    []*MatchStep
-	Template *Template
-}
+type nodeTestKind int
+
+const (
+	nameTest nodeTestKind = iota
+	anyNodeTest
+	textTest
+	commentTest
+	piTest
+)
 
-type stateFn func(*lexer) stateFn
+type nodeTest struct {
+	kind      nodeTestKind
+	prefix    string
+	namespace string // the namespace bound to prefix where the pattern was declared
+	name      string // the local name or *; for processing-instruction(), the target, if any
+}
 
-type lexer struct {
-	input string
-	start int
-	pos   int
-	width int //really?
-	steps chan *MatchStep
+// A call to id() or key() at the start of a pattern. Unlike XSLT 1.0,
+// which only allows literal arguments, the arguments may be any expression
+// (such as a variable reference).
+type idKeyPattern struct {
+	function string
+	args     []*xpath.Expression
 }
 
-func (l *lexer) run() {
-	for state := lexNodeTest; state != nil; {
-		state = state(l)
+// CompileMatch compiles a pattern, returning one CompiledMatch for each
+// alternative of the pattern. Prefixes are resolved using the namespaces
+// in scope for the template, if there is one.
+//
+// If the pattern is not valid, or uses a prefix that isn't in scope, nil
+// is returned.
+func CompileMatch(s string, t *Template) (matches []*CompiledMatch) {
+	var node xml.Node
+	if t != nil {
+		node = t.Node
 	}
-	close(l.steps)
+	if s == "" {
+		return
+	}
+	paths, err := parsePattern(s)
+	if err != nil {
+		return
+	}
+	if prefix := resolvePrefixes(paths, node); prefix != "" {
+		freePaths(paths)
+		return
+	}
+	return newMatches(paths, s, node, t)
+}
 
-	// the | operator
+// Compile the pattern held by the named attribute of a stylesheet element.
+// Prefixes in name tests are resolved using the namespaces in scope on the
+// element.
+//
+// A pattern that cannot be parsed is a static error; the panic is recovered
+// by ParseStylesheet, which returns the error.
+func compileMatch(inst xml.Node, attr, s string, t *Template) []*CompiledMatch {
+	if s == "" {
+		return nil
+	}
+	paths, err := parsePattern(s)
+	if err != nil {
+		panic(newTransformError("XTSE0340", inst, nil, err, "invalid pattern in %s=%q", attr, s))
+	}
+	if prefix := resolvePrefixes(paths, inst); prefix != "" {
+		freePaths(paths)
+		panic(newTransformError("XTSE0280", inst, nil, nil, "undeclared namespace prefix %s in %s=%q", prefix, attr, s))
+	}
+	return newMatches(paths, s, inst, t)
+}
 
-	// see a ::, either set axis or emit error
-	// see a :, emit op_NS?  or just modify next op?
-	// inside a () consume to close, check for validity of arguments
+func newMatches(paths []*pathPattern, s string, inst xml.Node, t *Template) (matches []*CompiledMatch) {
+	for _, path := range paths {
+		matches = append(matches, &CompiledMatch{pattern: s, path: path, Template: t, node: inst})
+	}
+	return
 }
 
-const eof = -1
+// Bind the prefixes of the name tests to the namespaces declared in scope
+// on node. As in XPath, unprefixed names are in no namespace. Returns the
+// first prefix that isn't declared, if any.
+func resolvePrefixes(paths []*pathPattern, node xml.Node) (undeclared string) {
+	for _, path := range paths {
+		for _, step := range path.steps {
+			test := &step.test
+			if test.kind != nameTest || test.prefix == "" {
+				continue
+			}
+			if test.prefix == "xml" {
+				test.namespace = XML_NAMESPACE
+			} else if node != nil {
+				test.namespace = lookupPrefix(node, test.prefix)
+			}
+			if test.namespace == "" {
+				return test.prefix
+			}
+		}
+	}
+	return
+}
 
-// emit passes an item back to the client.
-func (l *lexer) emit(t StepOperation) {
-	l.steps <- &MatchStep{t, l.input[l.start:l.pos]}
-	l.start = l.pos
+// Release the compiled expressions in the predicates and id() or key()
+// arguments.
+func (path *pathPattern) free() {
+	for _, step := range path.steps {
+		for _, e := range step.predicates {
+			freeExpression(e)
+		}
+	}
+	if path.idKey != nil {
+		for _, e := range path.idKey.args {
+			freeExpression(e)
+		}
+	}
 }
 
-func (l *lexer) next() (r rune) {
-	if l.pos >= len(l.input) {
-		l.width = 0
-		return eof
+func freePaths(paths []*pathPattern) {
+	for _, path := range paths {
+		path.free()
 	}
-	r, l.width = utf8.DecodeRuneInString(l.input[l.pos:])
-	l.pos += l.width
-	return r
 }
 
-// ignore skips over the pending input before this point.
-func (l *lexer) ignore() {
-	l.start = l.pos
+func (m *CompiledMatch) free() {
+	m.path.free()
 }
 
-// backup steps back one rune.
-// Can be called only once per call of next.
-func (l *lexer) backup() {
-	l.pos -= l.width
+func freeMatches(matches []*CompiledMatch) {
+	for _, m := range matches {
+		m.free()
+	}
 }
 
-// peek returns but does not consume
-// the next rune in the input.
-func (l *lexer) peek() rune {
-	r := l.next()
-	l.backup()
-	return r
+// A syntax error found while parsing a pattern.
+type patternSyntaxError struct {
+	error
 }
 
-func lexNodeTest(l *lexer) stateFn {
-	attr := false
-	for {
-		r := l.next()
-		switch r {
-		case '/':
-			l.backup()
-			if l.pos > l.start {
-				if attr {
-					l.emit(OP_ATTR)
-				} else {
-					l.emit(OP_ELEM)
-				}
-			}
-			return lexParent
-		case '(':
-			l.backup()
-			if attr {
-				return lexAttrNodeTest
-			} else {
-				return lexFunctionCall
-			}
-		case '[':
-			l.backup()
-			if l.pos > l.start {
-				if attr {
-					l.emit(OP_ATTR)
-				} else {
-					l.emit(OP_ELEM)
-				}
-			}
-			return lexPredicate
-		case '@':
-			l.ignore()
-			attr = true
-		case '*':
-			if attr {
-				l.emit(OP_ATTR)
-			} else {
-				return lexAll
-			}
-		case ':':
-			if l.peek() == ':' {
-				//axis specifier
-				_ = l.next()
-				axisName := l.input[l.start:l.pos]
-				if axisName == "attribute::" {
-					attr = true
-				}
-				//TODO: only child and attribute axes allowed in pattern
-				l.ignore()
-			} else {
-				l.backup()
-				l.emit(OP_NS)
-				_ = l.next()
-				l.ignore()
+// A recursive descent parser for the pattern grammar:
+//
+//	Pattern             ::= LocationPathPattern ('|' LocationPathPattern)*
+//	LocationPathPattern ::= '/' RelativePathPattern?
+//	                      | IdKeyPattern (('/' | '//') RelativePathPattern)?
+//	                      | '//'? RelativePathPattern
+//	RelativePathPattern ::= StepPattern (('/' | '//') StepPattern)*
+//	StepPattern         ::= ChildOrAttributeAxisSpecifier NodeTest Predicate*
+type patternParser struct {
+	src   string
+	pos   int
+	exprs []*xpath.Expression // compiled so far, to be freed on error
+}
+
+func parsePattern(s string) (paths []*pathPattern, err error) {
+	p := &patternParser{src: s}
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(patternSyntaxError)
+			if !ok {
+				panic(r)
 			}
-		case '|':
-			l.backup()
-			if l.pos > l.start {
-				if attr {
-					l.emit(OP_ATTR)
-				} else {
-					l.emit(OP_ELEM)
-				}
+			for _, x := range p.exprs {
+				x.Free()
 			}
-			_ = l.next()
-			l.emit(OP_OR)
-			l.ignore()
-			return lexNodeTest
-		case ' ', '\t', '\r':
-			l.ignore()
-		default:
+			paths, err = nil, e.error
 		}
-		//switch?
-		if r == eof {
+	}()
+	for {
+		paths = append(paths, p.pathPattern())
+		if !p.accept("|") {
 			break
 		}
 	}
-	if l.pos > l.start {
-		if attr {
-			l.emit(OP_ATTR)
-		} else {
-			l.emit(OP_ELEM)
-		}
+	if p.skipSpace(); p.pos < len(p.src) {
+		p.fail("unexpected %q", p.src[p.pos:])
 	}
-	return nil
+	return
 }
 
-func lexFunctionCall(l *lexer) stateFn {
-	fnName := l.input[l.start:l.pos]
-	op := OP_ERROR
-	switch fnName {
-	case "comment":
-		op = OP_COMMENT
-	case "text":
-		op = OP_TEXT
-	case "node":
-		op = OP_NODE
-	case "id":
-		op = OP_ID
-	case "key":
-		op = OP_KEY
-	case "processing-instruction":
-		op = OP_PI
+func (p *patternParser) fail(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	panic(patternSyntaxError{fmt.Errorf("%s at position %d", msg, p.pos+1)})
+}
+
+func (p *patternParser) skipSpace() {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\r\n", p.src[p.pos]) >= 0 {
+		p.pos++
 	}
-	l.ignore()
-	depth := 0
-	for {
-		r := l.next()
-		if r == eof {
-			//TODO: parse error
-			break
-		}
-		if r == '(' {
-			depth = depth + 1
-		}
-		if r == ')' {
-			depth = depth - 1
-			if depth == 0 {
-				l.emit(op)
-			}
-		}
+}
+
+// Consume the token if it comes next, skipping any whitespace before it.
+func (p *patternParser) accept(token string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.src[p.pos:], token) {
+		p.pos += len(token)
+		return true
 	}
-	return lexNodeTest
+	return false
 }
 
-func lexAttrNodeTest(l *lexer) stateFn {
-	fnName := l.input[l.start:l.pos]
-	op := OP_ERROR
-	switch fnName {
-	case "node":
-		op = OP_ATTR
+func (p *patternParser) expect(token string) {
+	if !p.accept(token) {
+		p.fail("expected %q", token)
 	}
-	l.ignore()
-	depth := 0
-	for {
-		r := l.next()
-		if r == eof {
-			//TODO: parse error
+}
+
+// Consume an NCName, returning the empty string if there isn't one.
+func (p *patternParser) ncname() string {
+	start := p.pos
+	for p.pos < len(p.src) {
+		r, width := utf8.DecodeRuneInString(p.src[p.pos:])
+		if !isNameChar(r) || (p.pos == start && !isNameStartChar(r)) {
 			break
 		}
-		if r == '(' {
-			depth = depth + 1
+		p.pos += width
+	}
+	return p.src[start:p.pos]
+}
+
+func isNameStartChar(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isNameChar(r rune) bool {
+	return isNameStartChar(r) || unicode.IsDigit(r) || r == '.' || r == '-' ||
+		unicode.In(r, unicode.Mn, unicode.Mc)
+}
+
+func (p *patternParser) pathPattern() (path *pathPattern) {
+	path = &pathPattern{}
+	var steps []*stepPattern
+	ancestor := false
+	switch {
+	case p.accept("//"):
+		path.root, ancestor = true, true
+	case p.accept("/"):
+		path.root = true
+		if !p.startsStep() {
+			// the pattern "/" matches the root node
+			return
 		}
-		if r == ')' {
-			depth = depth - 1
-			if depth == 0 {
-				l.steps <- &MatchStep{op, "*"}
-				l.start = l.pos
+	default:
+		if path.idKey = p.idKeyPattern(); path.idKey != nil {
+			if p.accept("//") {
+				ancestor = true
+			} else if !p.accept("/") {
+				return
 			}
 		}
 	}
-	return lexNodeTest
+	for {
+		step := p.stepPattern()
+		step.ancestor = ancestor
+		steps = append([]*stepPattern{step}, steps...)
+		if p.accept("//") {
+			ancestor = true
+		} else if p.accept("/") {
+			ancestor = false
+		} else {
+			break
+		}
+	}
+	path.steps = steps
+	return
 }
 
-func lexPredicate(l *lexer) stateFn {
-	depth := 0
+// Returns true if a step pattern (rather than the end of the pattern or
+// the start of another alternative) comes next.
+func (p *patternParser) startsStep() bool {
+	p.skipSpace()
+	if p.pos == len(p.src) {
+		return false
+	}
+	r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+	return r == '@' || r == '*' || isNameStartChar(r)
+}
+
+// Parse a call to id() or key(), returning nil if the pattern doesn't
+// start with one.
+func (p *patternParser) idKeyPattern() *idKeyPattern {
+	p.skipSpace()
+	start := p.pos
+	name := p.ncname()
+	if (name != "id" && name != "key") || !p.accept("(") {
+		p.pos = start
+		return nil
+	}
+	idKey := &idKeyPattern{function: name}
 	for {
-		r := l.next()
-		if r == '[' {
-			depth = depth + 1
-		}
-		if r == ']' {
-			depth = depth - 1
-			if depth == 0 {
-				l.emit(OP_PREDICATE)
+		src, end := p.expression(",)")
+		if src == "" {
+			if end == ')' && len(idKey.args) == 0 {
 				break
 			}
+			p.fail("missing argument to %s()", name)
 		}
-		if r == eof {
-			//TODO: parse error
+		idKey.args = append(idKey.args, p.compile(src))
+		if end == ')' {
 			break
 		}
 	}
-	return lexNodeTest
+	if want := map[string]int{"id": 1, "key": 2}[name]; len(idKey.args) != want {
+		p.fail("%s() takes %d argument(s), not %d", name, want, len(idKey.args))
+	}
+	return idKey
 }
 
-func lexParent(l *lexer) stateFn {
-	_ = l.next()
-	if l.peek() == '/' {
-		_ = l.next()
-		//we can ignore it at the root!
-		if l.start == 0 {
-			l.ignore()
+func (p *patternParser) stepPattern() (step *stepPattern) {
+	step = &stepPattern{axis: childAxis}
+	if p.accept("@") {
+		step.axis = attributeAxis
+	} else {
+		p.skipSpace()
+		start := p.pos
+		axis := p.ncname()
+		if axis != "" && p.accept("::") {
+			switch axis {
+			case "child":
+			case "attribute":
+				step.axis = attributeAxis
+			default:
+				p.pos = start
+				p.fail("the %s axis cannot be used in a pattern", axis)
+			}
 		} else {
-			l.emit(OP_ANCESTOR)
+			p.pos = start
 		}
-		return lexNodeTest
 	}
-	if l.start == 0 {
-		l.emit(OP_ROOT)
-		//return lexNodeTest
+	step.test = p.nodeTest()
+	for p.accept("[") {
+		src, _ := p.expression("]")
+		if src == "" {
+			p.fail("empty predicate")
+		}
+		step.predicates = append(step.predicates, p.compile(src))
 	}
-	l.emit(OP_PARENT)
-	return lexNodeTest
-}
-
-func lexAll(l *lexer) stateFn {
-	l.emit(OP_ALL)
-	return lexNodeTest
+	return
 }
 
-func parseMatchPattern(s string) (steps []*MatchStep) {
-	//create a lexer
-	//run the state machine
-	// each state emits steps into the stream
-	// when it recognizes new state returns new state
-	// state returns nil when out of input
-	// break out of loop and close channel
-	//get the channel of steps
-
-	//range over the steps until we have them all
-	//reverse the array for fast matching?
-	//assign priority/mode
-
-	// for now shortcut the common ROOT
-	if s == "/" {
-		steps = []*MatchStep{{Op: OP_ROOT, Value: s}, {Op: OP_END}}
+func (p *patternParser) nodeTest() (test nodeTest) {
+	if p.accept("*") {
+		test.name = "*"
 		return
 	}
-
-	ls := list.New()
-	ls.PushFront(&MatchStep{Op: OP_END})
-
-	// parse the expression
-	l := &lexer{input: s, steps: make(chan *MatchStep)}
-	go l.run()
-
-	// prepend steps to avoid reversing later
-	for step := range l.steps {
-		//we don't want predicates at the front
-		if step.Op == OP_PREDICATE {
-			//TODO: fix lexer to trim outer braces
-			step.Value = step.Value[1 : len(step.Value)-1]
-			ls.InsertAfter(step, ls.Front())
-		} else {
-			ls.PushFront(step)
+	p.skipSpace()
+	start := p.pos
+	name := p.ncname()
+	if name == "" {
+		if p.pos == len(p.src) {
+			p.fail("missing node test")
 		}
+		p.fail("expected a node test but found %q", p.src[p.pos:])
 	}
-
-	for i := ls.Front(); i != nil; i = i.Next() {
-		steps = append(steps, i.Value.(*MatchStep))
+	// a QName or prefix:* doesn't allow whitespace around the colon
+	if strings.HasPrefix(p.src[p.pos:], ":") && !strings.HasPrefix(p.src[p.pos:], "::") {
+		p.pos++
+		test.prefix = name
+		if strings.HasPrefix(p.src[p.pos:], "*") {
+			p.pos++
+			test.name = "*"
+			return
+		}
+		if test.name = p.ncname(); test.name == "" {
+			p.fail("expected a local name after %q", name+":")
+		}
+		return
+	}
+	if !p.accept("(") {
+		test.name = name
+		return
+	}
+	switch name {
+	case "node":
+		test.kind = anyNodeTest
+	case "text":
+		test.kind = textTest
+	case "comment":
+		test.kind = commentTest
+	case "processing-instruction":
+		test.kind = piTest
+		test.name = p.literal()
+	case "id", "key":
+		p.pos = start
+		p.fail("%s() can only be used at the start of a pattern", name)
+	default:
+		p.pos = start
+		p.fail("%s() is not a node test", name)
 	}
+	p.expect(")")
 	return
 }
 
-func CompileMatch(s string, t *Template) (matches []*CompiledMatch) {
-	if s == "" {
-		return
+// Consume a string literal if one comes next, returning its value.
+func (p *patternParser) literal() string {
+	p.skipSpace()
+	if p.pos == len(p.src) || (p.src[p.pos] != '\'' && p.src[p.pos] != '"') {
+		return ""
 	}
-	steps := parseMatchPattern(s)
-	start := 0
-	for i, step := range steps {
-		if step.Op == OP_OR {
-			matches = append(matches, &CompiledMatch{s, steps[start:i], t})
-			start = i + 1
+	end := strings.IndexByte(p.src[p.pos+1:], p.src[p.pos])
+	if end < 0 {
+		p.fail("unterminated string literal")
+	}
+	s := p.src[p.pos+1 : p.pos+1+end]
+	p.pos += end + 2
+	return s
+}
+
+// Consume the source of an XPath expression up to (and including) the
+// first of the terminating characters that isn't inside a string literal,
+// parentheses or brackets. Returns the expression, with surrounding
+// whitespace removed, and the terminator.
+func (p *patternParser) expression(terminators string) (src string, end byte) {
+	start := p.pos
+	var nesting []byte
+	for ; p.pos < len(p.src); p.pos++ {
+		c := p.src[p.pos]
+		switch {
+		case c == '\'' || c == '"':
+			close := strings.IndexByte(p.src[p.pos+1:], c)
+			if close < 0 {
+				p.fail("unterminated string literal")
+			}
+			p.pos += close + 1
+		case len(nesting) == 0 && strings.IndexByte(terminators, c) >= 0:
+			src = strings.TrimSpace(p.src[start:p.pos])
+			p.pos++
+			return src, c
+		case c == '(':
+			nesting = append(nesting, ')')
+		case c == '[':
+			nesting = append(nesting, ']')
+		case c == ')' || c == ']':
+			if len(nesting) == 0 || nesting[len(nesting)-1] != c {
+				p.fail("unexpected %q", string(c))
+			}
+			nesting = nesting[:len(nesting)-1]
 		}
 	}
-	matches = append(matches, &CompiledMatch{s, steps[start:], t})
+	p.fail("expected %q", terminators[len(terminators)-1:])
 	return
 }
 
+func (p *patternParser) compile(src string) *xpath.Expression {
+	e := xpath.Compile(src)
+	if e == nil {
+		p.fail("invalid expression %q (%v)", src, xpath.Check(src))
+	}
+	p.exprs = append(p.exprs, e)
+	return e
+}
+
 // Returns true if the node matches the pattern
 func (m *CompiledMatch) EvalMatch(node xml.Node, mode string, context *ExecutionContext) bool {
-	cur := node
 	//false if wrong mode
-	// #all is an XSLT 2.0 feature
-	if m.Template != nil && mode != m.Template.Mode && m.Template.Mode != "#all" {
+	if m.Template != nil && mode != m.Template.Mode {
+		return false
+	}
+	return m.matchSteps(node, 0, context)
+}
+
+// Returns true if node matches the i'th step from the end of the pattern,
+// and its parent or one of its ancestors matches the rest of the pattern.
+func (m *CompiledMatch) matchSteps(node xml.Node, i int, context *ExecutionContext) bool {
+	path := m.path
+	if i == len(path.steps) {
+		switch {
+		case path.idKey != nil:
+			return m.matchIdKey(node, context)
+		case path.root:
+			t := node.NodeType()
+			return t == xml.XML_DOCUMENT_NODE || t == xml.XML_HTML_DOCUMENT_NODE
+		}
+		return true
+	}
+	step := path.steps[i]
+	if !step.test.matches(node, step.axis) || !m.matchPredicates(node, step, context) {
 		return false
 	}
+	if i+1 == len(path.steps) && !path.root && path.idKey == nil {
+		return true
+	}
+	if !step.ancestor {
+		parent := node.Parent()
+		return parent != nil && m.matchSteps(parent, i+1, context)
+	}
+	for cur := node.Parent(); cur != nil; cur = cur.Parent() {
+		if m.matchSteps(cur, i+1, context) {
+			return true
+		}
+	}
+	return false
+}
 
-	for i, step := range m.Steps {
-		switch step.Op {
-		case OP_END:
+func (test *nodeTest) matches(node xml.Node, axis patternAxis) bool {
+	t := node.NodeType()
+	if axis == attributeAxis {
+		if t != xml.XML_ATTRIBUTE_NODE {
+			return false
+		}
+		return test.kind == anyNodeTest || (test.kind == nameTest && test.matchesName(node))
+	}
+	switch test.kind {
+	case nameTest:
+		return t == xml.XML_ELEMENT_NODE && test.matchesName(node)
+	case anyNodeTest:
+		switch t {
+		case xml.XML_ELEMENT_NODE, xml.XML_CDATA_SECTION_NODE, xml.XML_TEXT_NODE, xml.XML_COMMENT_NODE, xml.XML_PI_NODE:
 			return true
-		case OP_ROOT:
-			if cur.NodeType() != xml.XML_DOCUMENT_NODE {
-				return false
-			}
-		case OP_ELEM:
-			if cur.NodeType() != xml.XML_ELEMENT_NODE {
-				return false
-			}
-			if step.Value != cur.Name() && step.Value != "*" {
-				return false
-			}
-		case OP_NS:
-			uri := ""
-			// m.Template.Node
-			if m.Template != nil {
-				uri = context.LookupNamespace(step.Value, m.Template.Node)
-			} else {
-				uri = context.LookupNamespace(step.Value, nil)
-			}
-			if uri != cur.Namespace() {
-				return false
-			}
-		case OP_ATTR:
-			if cur.NodeType() != xml.XML_ATTRIBUTE_NODE {
-				return false
-			}
-			if step.Value != cur.Name() && step.Value != "*" {
-				return false
-			}
-		case OP_TEXT:
-			if cur.NodeType() != xml.XML_TEXT_NODE && cur.NodeType() != xml.XML_CDATA_SECTION_NODE {
-				return false
-			}
-		case OP_COMMENT:
-			if cur.NodeType() != xml.XML_COMMENT_NODE {
-				return false
-			}
-		case OP_ALL:
-			if cur.NodeType() != xml.XML_ELEMENT_NODE {
-				return false
-			}
-		case OP_PI:
-			if cur.NodeType() != xml.XML_PI_NODE {
-				return false
-			}
-		case OP_NODE:
-			switch cur.NodeType() {
-			case xml.XML_ELEMENT_NODE, xml.XML_CDATA_SECTION_NODE, xml.XML_TEXT_NODE, xml.XML_COMMENT_NODE, xml.XML_PI_NODE:
-				// matches any of these node types
-			default:
-				return false
-			}
-		case OP_PARENT:
-			cur = cur.Parent()
-			if cur == nil {
-				return false
+		}
+	case textTest:
+		return t == xml.XML_TEXT_NODE || t == xml.XML_CDATA_SECTION_NODE
+	case commentTest:
+		return t == xml.XML_COMMENT_NODE
+	case piTest:
+		return t == xml.XML_PI_NODE && (test.name == "" || test.name == node.Name())
+	}
+	return false
+}
+
+// Compare the expanded names; * matches any name in any namespace, while
+// prefix:* matches any name in the prefix's namespace.
+func (test *nodeTest) matchesName(node xml.Node) bool {
+	if test.name == "*" && test.prefix == "" {
+		return true
+	}
+	if test.name != "*" && test.name != node.Name() {
+		return false
+	}
+	return test.namespace == node.Namespace()
+}
+
+// Evaluate the predicates of a step for a node that passes its node test.
+// As in a location path, each predicate filters the nodes that pass the
+// node test and the earlier predicates, so positions are relative to the
+// siblings (or, for attributes, the other attributes) that remain.
+func (m *CompiledMatch) matchPredicates(node xml.Node, step *stepPattern, context *ExecutionContext) bool {
+	if len(step.predicates) == 0 {
+		return true
+	}
+	if context == nil {
+		return false
+	}
+	var candidates []xml.Node
+	if parent := node.Parent(); parent == nil {
+		candidates = []xml.Node{node}
+	} else if step.axis == attributeAxis {
+		for _, attr := range parent.AttributeList() {
+			candidates = append(candidates, attr)
+		}
+	} else {
+		candidates = context.ChildrenOf(parent)
+	}
+	kept := candidates[:0]
+	for _, c := range candidates {
+		if step.test.matches(c, step.axis) {
+			kept = append(kept, c)
+		}
+	}
+	candidates = kept
+
+	if m.node != nil {
+		context.RegisterXPathNamespaces(m.node)
+	}
+	oldpos, oldsize := context.XPathContext.GetContextPosition()
+	defer context.XPathContext.SetContextPosition(oldpos, oldsize)
+	for i, pred := range step.predicates {
+		if i == 0 {
+			// the first predicate only needs to be evaluated for node
+			pos := 0
+			for j, c := range candidates {
+				if c.NodePtr() == node.NodePtr() {
+					pos = j + 1
+				}
 			}
-		case OP_ANCESTOR:
-			next := m.Steps[i+1]
-			if next.Op != OP_ELEM {
+			if pos == 0 || !m.evalPredicate(node, pred, pos, len(candidates), context) {
 				return false
 			}
-			for {
-				cur = cur.Parent()
-				if cur == nil {
-					return false
-				}
-				if next.Value == cur.Name() {
-					break
-				}
-			}
-		case OP_PREDICATE:
-			// see test REC/5.2-16
-			// see test REC/5.2-22
-			evalFull := true
-			if context != nil {
-
-				prev := m.Steps[i-1]
-				if prev.Op == OP_PREDICATE {
-					prev = m.Steps[i-2]
-				}
-				if prev.Op == OP_ELEM || prev.Op == OP_ALL {
-					parent := cur.Parent()
-					sibs := context.ChildrenOf(parent)
-					var clen, pos int
-					for _, n := range sibs {
-						if n.NodePtr() == cur.NodePtr() {
-							pos = clen + 1
-							clen = clen + 1
-						} else {
-							if n.NodeType() == xml.XML_ELEMENT_NODE {
-								if n.Name() == cur.Name() || prev.Op == OP_ALL {
-									clen = clen + 1
-								}
-							}
-						}
-					}
-					if step.Value == "last()" {
-						if pos != clen {
-							return false
-						}
-					}
-					//eval predicate should do special number handling
-					postest, err := strconv.Atoi(step.Value)
-					if err == nil {
-						if pos != postest {
-							return false
-						}
-					}
-					opos, olen := context.XPathContext.GetContextPosition()
-					context.XPathContext.SetContextPosition(pos, clen)
-					result := cur.EvalXPathAsBoolean(step.Value, context)
-					context.XPathContext.SetContextPosition(opos, olen)
-					if result == false {
-						return false
-					}
-					evalFull = false
-				}
+			if len(step.predicates) == 1 {
+				return true
 			}
-			if evalFull {
-				//if we made it this far, fall back to the more expensive option of evaluating
-				// the entire pattern globally
-				//TODO: cache results on first run for given document
-				xp := m.pattern
-				if m.pattern[0] != '/' {
-					xp = "//" + m.pattern
-				}
-				e := xpath.Compile(xp)
-				o, err := node.Search(e)
-				if err != nil {
-					//fmt.Println("ERROR",err)
-				}
-				for _, n := range o {
-					if cur.NodePtr() == n.NodePtr() {
-						return true
-					}
-				}
-				return false
+		}
+		found := false
+		kept := []xml.Node{}
+		for j, c := range candidates {
+			if m.evalPredicate(c, pred, j+1, len(candidates), context) {
+				kept = append(kept, c)
+				found = found || c.NodePtr() == node.NodePtr()
 			}
+		}
+		if !found {
+			return false
+		}
+		candidates = kept
+	}
+	return true
+}
 
-		case OP_ID:
-			//TODO: fix lexer to only put literal inside step value
-			val := strings.Trim(step.Value, "()\"'")
-			id := cur.MyDocument().NodeById(val)
-			if id == nil || node.NodePtr() != id.NodePtr() {
-				return false
+// Evaluate a predicate; a number is true if it equals the context position.
+func (m *CompiledMatch) evalPredicate(node xml.Node, pred *xpath.Expression, pos, size int, context *ExecutionContext) bool {
+	context.XPathContext.SetContextPosition(pos, size)
+	result, err := context.EvalXPath(node, pred)
+	if err != nil {
+		context.reportError(newTransformError("", m.node, node, err, "cannot evaluate predicate in pattern %q", m.pattern))
+		return false
+	}
+	switch r := result.(type) {
+	case float64:
+		return r == float64(pos)
+	case bool:
+		return r
+	case string:
+		return r != ""
+	case []xml.Node:
+		return len(r) > 0
+	}
+	return false
+}
+
+// Returns true if node is selected by the id() or key() call that starts
+// the pattern. The arguments are evaluated with node as the context node.
+func (m *CompiledMatch) matchIdKey(node xml.Node, context *ExecutionContext) bool {
+	if context == nil {
+		return false
+	}
+	idKey := m.path.idKey
+	if m.node != nil {
+		context.RegisterXPathNamespaces(m.node)
+	}
+	values := func(e *xpath.Expression) (vals []string) {
+		result, err := context.EvalXPath(node, e)
+		if err != nil {
+			context.reportError(newTransformError("", m.node, node, err, "cannot evaluate %s() in pattern %q", idKey.function, m.pattern))
+			return
+		}
+		if nodes, ok := result.([]xml.Node); ok {
+			for _, n := range nodes {
+				vals = append(vals, n.Content())
 			}
-		case OP_KEY:
-			//  TODO: make this robust
-			if context != nil {
-				val := strings.Trim(step.Value, "()")
-				v := strings.Split(val, ",")
-				keyname := strings.Trim(v[0], "\"'")
-				keyval := strings.Trim(v[1], "\"'")
-				key, _ := context.Style.Keys[keyname]
-				if key != nil {
-					o, _ := key.nodes[keyval]
-					for _, n := range o {
-						if cur.NodePtr() == n.NodePtr() {
-							return true
-						}
-					}
+			return
+		}
+		return []string{argValToString(result)}
+	}
+
+	if idKey.function == "id" {
+		doc := node.MyDocument()
+		for _, v := range values(idKey.args[0]) {
+			for _, id := range strings.Fields(v) {
+				if e := doc.NodeById(id); e != nil && e.NodePtr() == node.NodePtr() {
+					return true
 				}
 			}
-			return false
-		default:
-			return false
 		}
+		return false
 	}
-	//in theory, OP_END means we never reach here
-	// in practice, we can generate match patterns
-	// that are missing OP_END due to how we handle OP_OR
-	return true
+	name := values(idKey.args[0])
+	if len(name) == 0 {
+		return false
+	}
+	index := context.keyIndex(node, name[0])
+	if index == nil {
+		return false
+	}
+	for _, n := range index.lookup(values(idKey.args[1])) {
+		if n.NodePtr() == node.NodePtr() {
+			return true
+		}
+	}
+	return false
 }
 
+// The last step of the pattern, or nil for patterns such as / or id('x').
+func (m *CompiledMatch) lastStep() *stepPattern {
+	if len(m.path.steps) == 0 {
+		return nil
+	}
+	return m.path.steps[0]
+}
+
+// Hash returns the name of the elements or attributes the pattern can
+// match: a local name, * if it matches any name, or / for the root node.
 func (m *CompiledMatch) Hash() (hash string) {
-	base := m.Steps[0]
-	switch base.Op {
-	case OP_ATTR:
-		return base.Value
-	case OP_ELEM:
-		return base.Value
-	case OP_ALL:
+	step := m.lastStep()
+	if step == nil {
+		if m.path.root {
+			return "/"
+		}
+		return
+	}
+	if step.test.kind == anyNodeTest && step.axis == attributeAxis {
 		return "*"
-	case OP_ROOT:
-		return "/"
+	}
+	if step.test.kind == nameTest {
+		return step.test.name
 	}
 	return
 }
 
 func (m *CompiledMatch) IsElement() bool {
-	op := m.Steps[0].Op
-	if op == OP_ELEM || op == OP_ROOT || op == OP_ALL {
-		return true
+	step := m.lastStep()
+	if step == nil {
+		return m.path.root
 	}
-	return false
+	return step.axis == childAxis && step.test.kind == nameTest
 }
 
 func (m *CompiledMatch) IsAttr() bool {
-	op := m.Steps[0].Op
-	return op == OP_ATTR
+	step := m.lastStep()
+	if step == nil || step.axis != attributeAxis {
+		return false
+	}
+	return step.test.kind == nameTest || step.test.kind == anyNodeTest
 }
 
 func (m *CompiledMatch) IsNode() bool {
-	op := m.Steps[0].Op
-	return op == OP_NODE
+	return m.isChildTest(anyNodeTest)
 }
 
 func (m *CompiledMatch) IsPI() bool {
-	op := m.Steps[0].Op
-	return op == OP_PI
+	return m.isChildTest(piTest)
 }
 
 func (m *CompiledMatch) IsIdKey() bool {
-	op := m.Steps[0].Op
-	return op == OP_ID || op == OP_KEY
+	return m.lastStep() == nil && m.path.idKey != nil
 }
 
 func (m *CompiledMatch) IsText() bool {
-	op := m.Steps[0].Op
-	return op == OP_TEXT
+	return m.isChildTest(textTest)
 }
 
 func (m *CompiledMatch) IsComment() bool {
-	op := m.Steps[0].Op
-	return op == OP_COMMENT
+	return m.isChildTest(commentTest)
 }
 
-func (m *CompiledMatch) endsAfter(n int) bool {
-	steps := len(m.Steps)
-	if n == steps {
-		return true
-	}
-	if n+1 == steps && m.Steps[n].Op == OP_END {
-		return true
+func (m *CompiledMatch) isChildTest(kind nodeTestKind) bool {
+	step := m.lastStep()
+	return step != nil && step.axis == childAxis && step.test.kind == kind
+}
+
+// Returns true if m should be chosen over o when both match a node: it has
+// a higher priority, or the same priority and comes later in the stylesheet.
+func (m *CompiledMatch) outranks(o *CompiledMatch) bool {
+	if m.priority != o.priority {
+		return m.priority > o.priority
 	}
-	return false
+	return m.Template.position > o.Template.position
 }
 
+// DefaultPriority returns the priority of the pattern when the template
+// doesn't specify one (see section 5.5 of the XSLT 1.0 spec). Only patterns
+// consisting of a single step without predicates have a priority below 0.5.
 func (m *CompiledMatch) DefaultPriority() (priority float64) {
-	//TODO: calculate defaults according to spec
-	step := m.Steps[0]
-	// *
-	if step.Op == OP_ALL {
-		if m.endsAfter(1) {
-			return -0.5
-		}
-		// ns:*
-		if m.endsAfter(2) && m.Steps[1].Op == OP_NS {
-			return -0.25
-		}
+	path := m.path
+	if path.root || path.idKey != nil || len(path.steps) != 1 || len(path.steps[0].predicates) > 0 {
+		return 0.5
 	}
-	// @*
-	if step.Op == OP_ATTR && step.Value == "*" {
-		if m.endsAfter(1) {
-			return -0.5
-		}
-		if m.endsAfter(2) && m.Steps[1].Op == OP_NS {
-			return -0.25
-		}
+	test := path.steps[0].test
+	switch {
+	case test.kind == piTest && test.name != "":
+		// processing-instruction('name')
+		return 0
+	case test.kind != nameTest:
+		// node(), text(), comment(), processing-instruction()
+		return -0.5
+	case test.name != "*":
+		// QName
+		return 0
+	case test.prefix != "":
+		// prefix:*
+		return -0.25
 	}
-	// text(), node(), comment()
-	if step.Op == OP_TEXT || step.Op == OP_NODE || step.Op == OP_COMMENT {
-		if m.endsAfter(1) {
-			return -0.5
-		}
-	}
-	// QName
-	if step.Op == OP_ELEM {
-		if m.endsAfter(1) {
-			return 0
-		}
-		if m.endsAfter(2) && m.Steps[1].Op == OP_NS {
-			return 0
-		}
-	}
-	// @QName
-	if step.Op == OP_ATTR && step.Value != "*" {
-		if m.endsAfter(1) {
-			return 0
-		}
-		if m.endsAfter(2) && m.Steps[1].Op == OP_NS {
-			return 0
-		}
-	}
-	return 0.5
+	// *
+	return -0.5
 }
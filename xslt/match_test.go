@@ -1,165 +1,323 @@
 package xslt
 
-//import "github.com/jbowtie/gokogiri/xml"
-//import "unicode/utf8"
-import "testing"
+import (
+	"github.com/jbowtie/gokogiri/xml"
+	"github.com/jbowtie/gokogiri/xpath"
+	"strings"
+	"testing"
+)
 
-func compareStep(t *testing.T, m *MatchStep, op StepOperation, val string) {
-	if m.Op != op || val != m.Value {
-		t.Error("Expected", op, "=", val, "\nActual  ", m.Op, "=", m.Value)
+// Render the parsed pattern in a canonical form, with every step written
+// out in full: "foo/@bar" is "child::foo/attribute::bar".
+func patternString(paths []*pathPattern) string {
+	var alts []string
+	for _, path := range paths {
+		s := ""
+		if path.idKey != nil {
+			var args []string
+			for _, a := range path.idKey.args {
+				args = append(args, a.String())
+			}
+			s = path.idKey.function + "(" + strings.Join(args, ", ") + ")"
+		}
+		if path.root && len(path.steps) == 0 {
+			s = "/"
+		}
+		for i := len(path.steps) - 1; i >= 0; i-- {
+			step := path.steps[i]
+			switch {
+			case step.ancestor:
+				s = s + "//"
+			case path.root || path.idKey != nil || i < len(path.steps)-1:
+				s = s + "/"
+			}
+			if step.axis == attributeAxis {
+				s = s + "attribute::"
+			} else {
+				s = s + "child::"
+			}
+			switch step.test.kind {
+			case nameTest:
+				if step.test.prefix != "" {
+					s = s + step.test.prefix + ":"
+				}
+				s = s + step.test.name
+			case anyNodeTest:
+				s = s + "node()"
+			case textTest:
+				s = s + "text()"
+			case commentTest:
+				s = s + "comment()"
+			case piTest:
+				s = s + "processing-instruction(" + step.test.name + ")"
+			}
+			for _, pred := range step.predicates {
+				s = s + "[" + pred.String() + "]"
+			}
+		}
+		alts = append(alts, s)
 	}
+	return strings.Join(alts, " | ")
 }
 
-func TestPatternSimple(t *testing.T) {
-	steps := parseMatchPattern("test")
-	compareStep(t, steps[0], OP_ELEM, "test")
-}
-
-func TestPatternParent(t *testing.T) {
-	steps := parseMatchPattern("foo/bar")
-	compareStep(t, steps[0], OP_ELEM, "bar")
-	compareStep(t, steps[1], OP_PARENT, "/")
-	compareStep(t, steps[2], OP_ELEM, "foo")
-}
-
-func TestPatternRootParent(t *testing.T) {
-	steps := parseMatchPattern("/bar")
-	compareStep(t, steps[0], OP_ELEM, "bar")
-	compareStep(t, steps[1], OP_PARENT, "")
-	compareStep(t, steps[2], OP_ROOT, "/")
-	compareStep(t, steps[3], OP_END, "")
-}
-
-func TestPatternRootWildcard(t *testing.T) {
-	steps := parseMatchPattern("/*")
-	compareStep(t, steps[0], OP_ALL, "*")
-	compareStep(t, steps[1], OP_PARENT, "")
-	compareStep(t, steps[2], OP_ROOT, "/")
-	compareStep(t, steps[3], OP_END, "")
-}
-
-func TestPatternAncestor(t *testing.T) {
-	steps := parseMatchPattern("foo//bar")
-	compareStep(t, steps[0], OP_ELEM, "bar")
-	compareStep(t, steps[1], OP_ANCESTOR, "//")
-	compareStep(t, steps[2], OP_ELEM, "foo")
-}
-
-func TestPatternRootAncestor(t *testing.T) {
-	steps := parseMatchPattern("//bar")
-	compareStep(t, steps[0], OP_ELEM, "bar")
-	compareStep(t, steps[1], OP_END, "")
-}
-
-func TestPatternAttrib(t *testing.T) {
-	steps := parseMatchPattern("@test")
-	compareStep(t, steps[0], OP_ATTR, "test")
-}
-
-func TestPatternWildcardAttrib(t *testing.T) {
-	steps := parseMatchPattern("@*")
-	compareStep(t, steps[0], OP_ATTR, "*")
-	compareStep(t, steps[1], OP_END, "")
-}
-
-func TestPatternNodeTestAttrib(t *testing.T) {
-	steps := parseMatchPattern("@node()")
-	compareStep(t, steps[0], OP_ATTR, "*")
-	compareStep(t, steps[1], OP_END, "")
-}
-
-func TestPatternAttribWithParent(t *testing.T) {
-	steps := parseMatchPattern("foo/@bar")
-	compareStep(t, steps[0], OP_ATTR, "bar")
-	compareStep(t, steps[1], OP_PARENT, "/")
-	compareStep(t, steps[2], OP_ELEM, "foo")
-}
-
-func TestPatternNodeType(t *testing.T) {
-	steps := parseMatchPattern("node()")
-	compareStep(t, steps[0], OP_NODE, "()")
-}
-func TestPatternCommentType(t *testing.T) {
-	steps := parseMatchPattern("comment()")
-	compareStep(t, steps[0], OP_COMMENT, "()")
-}
-func TestPatternTextType(t *testing.T) {
-	steps := parseMatchPattern("text()")
-	compareStep(t, steps[0], OP_TEXT, "()")
-}
-func TestPatternPiType(t *testing.T) {
-	steps := parseMatchPattern("processing-instruction()")
-	compareStep(t, steps[0], OP_PI, "()")
-}
-func TestPatternAll(t *testing.T) {
-	steps := parseMatchPattern("*")
-	compareStep(t, steps[0], OP_ALL, "*")
-}
-func TestPatternParentAll(t *testing.T) {
-	steps := parseMatchPattern("foo/*")
-	compareStep(t, steps[0], OP_ALL, "*")
-	compareStep(t, steps[1], OP_PARENT, "/")
-	compareStep(t, steps[2], OP_ELEM, "foo")
+func TestParsePattern(t *testing.T) {
+	for _, test := range []struct{ pattern, parsed string }{
+		{"test", "child::test"},
+		{"foo/bar", "child::foo/child::bar"},
+		{"/", "/"},
+		{"/bar", "/child::bar"},
+		{"/*", "/child::*"},
+		{"foo//bar", "child::foo//child::bar"},
+		{"//bar", "//child::bar"},
+		{"@test", "attribute::test"},
+		{"@*", "attribute::*"},
+		{"@node()", "attribute::node()"},
+		{"foo/@bar", "child::foo/attribute::bar"},
+		{"node()", "child::node()"},
+		{"comment()", "child::comment()"},
+		{"text()", "child::text()"},
+		{"processing-instruction()", "child::processing-instruction()"},
+		{"processing-instruction('xml-stylesheet')", "child::processing-instruction(xml-stylesheet)"},
+		{"*", "child::*"},
+		{"foo/*", "child::foo/child::*"},
+		{"item[position()=1]", "child::item[position()=1]"},
+		{"item[position()=1]/foo", "child::item[position()=1]/child::foo"},
+		{"list[item[@foo='bar']]", "child::list[item[@foo='bar']]"},
+		{"item[@a][2]", "child::item[@a][2]"},
+		{"E/text()[ 1 ]", "child::E/child::text()[1]"},
+		{"p[contains(., ']')]", "child::p[contains(., ']')]"},
+		{"foo:bar", "child::foo:bar"},
+		{"foo:*", "child::foo:*"},
+		{"@foo:*", "attribute::foo:*"},
+		{"foo/child::bar", "child::foo/child::bar"},
+		{"foo/attribute::bar", "child::foo/attribute::bar"},
+		{"child::bar", "child::bar"},
+		{"foo|bar", "child::foo | child::bar"},
+		{"@foo | bar", "attribute::foo | child::bar"},
+		{"/ | *", "/ | child::*"},
+		{"id('a')", "id('a')"},
+		{"id($ids)/b", "id($ids)/child::b"},
+		{"key('k', concat('a', 'b'))//c", "key('k', concat('a', 'b'))//child::c"},
+		{"id", "child::id"},
+		{"key/id", "child::key/child::id"},
+	} {
+		paths, err := parsePattern(test.pattern)
+		if err != nil {
+			t.Errorf("%q: %v", test.pattern, err)
+			continue
+		}
+		if s := patternString(paths); s != test.parsed {
+			t.Errorf("%q parsed as %q, want %q", test.pattern, s, test.parsed)
+		}
+		for _, path := range paths {
+			path.free()
+		}
+	}
 }
 
-func TestPatternPred(t *testing.T) {
-	steps := parseMatchPattern("item[position()=1]")
-	compareStep(t, steps[0], OP_ELEM, "item")
-	compareStep(t, steps[1], OP_PREDICATE, "position()=1")
+func TestPatternSyntaxErrors(t *testing.T) {
+	for _, test := range []struct{ pattern, err string }{
+		{"|", `expected a node test but found "|" at position 1`},
+		{"foo/", "missing node test at position 5"},
+		{"foo]", `unexpected "]" at position 4`},
+		{"item[1", `expected "]" at position 7`},
+		{"item[]", "empty predicate at position 7"},
+		{"item[1]]", `unexpected "]" at position 8`},
+		{"ancestor::foo", "the ancestor axis cannot be used in a pattern at position 1"},
+		{"foo/..", `expected a node test but found ".." at position 5`},
+		{"a/id('x')", "id() can only be used at the start of a pattern at position 3"},
+		{"count()", "count() is not a node test at position 1"},
+		{"key('k')", "key() takes 2 argument(s), not 1 at position 9"},
+		{"id('a', )", "missing argument to id() at position 10"},
+		{"foo:", `expected a local name after "foo:" at position 5`},
+		{"item[position(]", `unexpected "]" at position 15`},
+		{"processing-instruction('a)", "unterminated string literal at position 24"},
+	} {
+		_, err := parsePattern(test.pattern)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%q: got error %v, want %v", test.pattern, err, test.err)
+		}
+	}
 }
 
-func TestPatternNonTerminalPred(t *testing.T) {
-	steps := parseMatchPattern("item[position()=1]/foo")
-	compareStep(t, steps[0], OP_ELEM, "foo")
-	compareStep(t, steps[1], OP_PARENT, "/")
-	compareStep(t, steps[2], OP_ELEM, "item")
-	compareStep(t, steps[3], OP_PREDICATE, "position()=1")
+func TestDefaultPriority(t *testing.T) {
+	for _, test := range []struct {
+		pattern  string
+		priority float64
+	}{
+		{"foo", 0}, {"@foo", 0}, {"child::p:foo", 0}, {"processing-instruction('x')", 0},
+		{"p:*", -0.25}, {"@p:*", -0.25},
+		{"*", -0.5}, {"@*", -0.5}, {"node()", -0.5}, {"text()", -0.5}, {"comment()", -0.5},
+		{"processing-instruction()", -0.5}, {"@node()", -0.5},
+		{"/", 0.5}, {"/foo", 0.5}, {"//foo", 0.5}, {"foo/bar", 0.5}, {"foo[1]", 0.5},
+		{"*[1]", 0.5}, {"id('x')", 0.5},
+	} {
+		paths, err := parsePattern(test.pattern)
+		if err != nil || len(paths) != 1 {
+			t.Errorf("%q: parsed to %d alternatives (%v)", test.pattern, len(paths), err)
+			continue
+		}
+		m := &CompiledMatch{path: paths[0]}
+		if p := m.DefaultPriority(); p != test.priority {
+			t.Errorf("%q: default priority %v, want %v", test.pattern, p, test.priority)
+		}
+		m.free()
+	}
 }
 
-func TestPatternNestedPred(t *testing.T) {
-	steps := parseMatchPattern("list[item[@foo='bar']]")
-	compareStep(t, steps[0], OP_ELEM, "list")
-	compareStep(t, steps[1], OP_PREDICATE, "item[@foo='bar']")
-}
+// Patterns are matched against the node and its ancestors without
+// searching the whole document.
+func TestPatternMatching(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:key name="k" match="item" use="@k"/>
+</xsl:stylesheet>`
+	input := `<!DOCTYPE doc [<!ATTLIST item id ID #IMPLIED>]>
+<doc>
+  <list><item id="i1" a="1" k="x">one</item><other/><item id="i2" k="y">two</item><item id="i3" a="1">three</item></list>
+  <list><item id="i4" k="x"><?pi data?><!--c--></item><item id="i5" a="2">five<b/></item></list>
+</doc>`
+	style, doc := parseTransformTest(t, xsl, input)
+	defer style.Close()
+	defer doc.Free()
+	context := &ExecutionContext{Style: style, Source: doc}
+	context.XPathContext = xpath.NewXPath(doc.DocPtr())
+	defer freeXPath(context.XPathContext)
 
-func TestPatternNamespace(t *testing.T) {
-	steps := parseMatchPattern("foo:bar")
-	compareStep(t, steps[0], OP_ELEM, "bar")
-	compareStep(t, steps[1], OP_NS, "foo")
+	for _, test := range []struct{ pattern, matches string }{
+		// the positions are among the siblings that pass the node test
+		{"item[2]", "i2 i5"},
+		{"item[last()]", "i3 i5"},
+		// each predicate filters the nodes left by the previous one
+		{"item[@a][2]", "i3"},
+		{"item[2][@a]", "i5"},
+		{"item[@a][position() = last()]", "i3 i5"},
+		{"list[2]/item", "i4 i5"},
+		{"list//item[1]", "i1 i4"},
+		{"/doc//item[@k='x']", "i1 i4"},
+		{"id(//item[@a = 2]/@id)", "i5"},
+		{"key('k', 'x')", "i1 i4"},
+		{"key('k', //item[@id = 'i2' or @id = 'i4']/@k)", "i1 i2 i4"},
+		{"id('i4 i5')/node()", "pi c five b"},
+		{"key('k', 'x')//processing-instruction('pi')", "pi"},
+		{"doc/list[item/@a]//@a", "1 1 2"},
+		{"/doc | comment()", "doc c"},
+	} {
+		matches := CompileMatch(test.pattern, nil)
+		if matches == nil {
+			t.Errorf("%q did not compile", test.pattern)
+			continue
+		}
+		var found []string
+		var visit func(node xml.Node)
+		visit = func(node xml.Node) {
+			if matchesOne(node, matches, context) {
+				found = append(found, describeNode(node))
+			}
+			for _, attr := range node.Attributes() {
+				if attr.Name() != "id" && matchesOne(attr, matches, context) {
+					found = append(found, describeNode(attr))
+				}
+			}
+			for cur := node.FirstChild(); cur != nil; cur = cur.NextSibling() {
+				visit(cur)
+			}
+		}
+		visit(doc.Root())
+		if s := strings.Join(found, " "); s != test.matches {
+			t.Errorf("%q matched %q, want %q", test.pattern, s, test.matches)
+		}
+		freeMatches(matches)
+	}
 }
 
-func TestPatternAxis(t *testing.T) {
-	steps := parseMatchPattern("foo/child::bar")
-	compareStep(t, steps[0], OP_ELEM, "bar")
-	compareStep(t, steps[1], OP_PARENT, "/")
-	compareStep(t, steps[2], OP_ELEM, "foo")
+// A short name for a node in the document used by TestPatternMatching.
+func describeNode(node xml.Node) string {
+	switch node.NodeType() {
+	case xml.XML_ELEMENT_NODE:
+		if id := node.Attr("id"); id != "" {
+			return id
+		}
+		return node.Name()
+	case xml.XML_PI_NODE:
+		return node.Name()
+	}
+	return node.Content()
 }
 
-func TestPatternAttributeAxis(t *testing.T) {
-	steps := parseMatchPattern("foo/attribute::bar")
-	compareStep(t, steps[0], OP_ATTR, "bar")
-	compareStep(t, steps[1], OP_PARENT, "/")
-	compareStep(t, steps[2], OP_ELEM, "foo")
+// The arguments to id() and key() in a pattern may be variable references.
+func TestIdKeyPatternVariables(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:key name="k" match="item" use="@k"/>
+<xsl:variable name="ids" select="'i1 i3'"/>
+<xsl:variable name="keys" select="//item[@id = 'i3']/@k"/>
+<xsl:template match="id($ids)">[id <xsl:value-of select="."/>]</xsl:template>
+<xsl:template match="key('k', $keys)">[key <xsl:value-of select="."/>]</xsl:template>
+<xsl:template match="item"/>
+</xsl:stylesheet>`
+	input := `<!DOCTYPE doc [<!ATTLIST item id ID #IMPLIED>]>
+<doc><item id="i1">1</item><item id="i2" k="x">2</item><item id="i3" k="x">3</item><item id="i4">4</item></doc>`
+	style, doc := parseTransformTest(t, xsl, input)
+	defer style.Close()
+	defer doc.Free()
+	output, err := style.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// id($ids) and key('k', $keys) both match i3; the last template wins
+	if want := "[id 1][key 2][key 3]"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
 }
 
-func TestPatternChildAxis(t *testing.T) {
-	steps := parseMatchPattern("child::bar")
-	compareStep(t, steps[0], OP_ELEM, "bar")
-	compareStep(t, steps[1], OP_END, "")
+func TestPatternSyntaxErrorIsStatic(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:template match="item[1"/>
+</xsl:stylesheet>`
+	style, _ := xml.Parse([]byte(xsl), nil, nil, xml.StrictParseOption, nil)
+	defer style.Free()
+	_, err := ParseStylesheet(style, "")
+	terr, ok := err.(*TransformError)
+	if !ok || terr.Code != "XTSE0340" || terr.Line != 2 {
+		t.Errorf("got %v, want XTSE0340 on line 2", err)
+	}
 }
 
-func TestPatternOr(t *testing.T) {
-	steps := parseMatchPattern("foo|bar")
-	compareStep(t, steps[0], OP_ELEM, "bar")
-	compareStep(t, steps[1], OP_OR, "|")
-	compareStep(t, steps[2], OP_ELEM, "foo")
-	compareStep(t, steps[3], OP_END, "")
+// Name tests compare expanded names, with prefixes bound by the namespace
+// declarations in scope where the pattern is declared.
+func TestPatternNamespaces(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform" xmlns:a="urn:atom">
+<xsl:output method="text"/>
+<xsl:key name="k" match="a:entry" use="@id"/>
+<xsl:template match="/doc"><xsl:value-of select="count(key('k', '1'))"/><xsl:apply-templates select="*"/></xsl:template>
+<xsl:template match="title">[title]</xsl:template>
+<xsl:template match="a:title">[a:title]</xsl:template>
+<xsl:template match="*">[other <xsl:value-of select="local-name()"/>]</xsl:template>
+<xsl:template match="e:entry" xmlns:e="urn:atom">[entry <xsl:number level="any" count="e:entry"/>]</xsl:template>
+</xsl:stylesheet>`
+	input := `<doc xmlns:x="urn:atom">
+<title/><x:title/><title xmlns="urn:other"/><x:entry id="1"/><entry id="1"/><x:entry id="2"/>
+</doc>`
+	style, doc := parseTransformTest(t, xsl, input)
+	defer style.Close()
+	defer doc.Free()
+	output, err := style.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1[title][a:title][other title][entry 1][other entry][entry 2]"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
 }
 
-func TestPatternOrAtrr(t *testing.T) {
-	steps := parseMatchPattern("@foo|bar")
-	compareStep(t, steps[0], OP_ELEM, "bar")
-	compareStep(t, steps[1], OP_OR, "|")
-	compareStep(t, steps[2], OP_ATTR, "foo")
-	compareStep(t, steps[3], OP_END, "")
+func TestPatternUndeclaredPrefix(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:template match="doc/q:item"/>
+</xsl:stylesheet>`
+	style, _ := xml.Parse([]byte(xsl), nil, nil, xml.StrictParseOption, nil)
+	defer style.Free()
+	_, err := ParseStylesheet(style, "")
+	if terr, ok := err.(*TransformError); !ok || terr.Code != "XTSE0280" {
+		t.Errorf("got %v, want XTSE0280", err)
+	}
 }
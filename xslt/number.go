@@ -1,19 +1,16 @@
 package xslt
 
 import (
-	"fmt"
 	"github.com/jbowtie/gokogiri/xml"
+	"math"
 	"strconv"
 	"strings"
 	"unicode"
 )
 
-var numLetter = "- a b c d e f g h i j k l m n o p q r s t u v w x y z"
-var aLetter = strings.Split(numLetter, " ")
-
 var units = []string{"", "one", "two", "three", "four", "five",
 	"six", "seven", "eight", "nine"}
-var teens = []string{"", "eleven", "twelve", "thirteen", "fourteen",
+var teens = []string{"ten", "eleven", "twelve", "thirteen", "fourteen",
 	"fifteen", "sixteen", "seventeen", "eighteen", "nineteen"}
 var tens = []string{"", "ten", "twenty", "thirty", "forty",
 	"fifty", "sixty", "seventy", "eighty", "ninety"}
@@ -57,92 +54,137 @@ func (n RomanNumber) String() (out string) {
 	return out
 }
 
-//TODO: breaks after 701
-func toAlphaIndex(n int) (out string) {
-	w := n
-	for w > 26 {
-		i := w / 26
-		w = w - (i * 26)
-		out = out + aLetter[i]
-	}
-	out = out + aLetter[w]
-	return
+// Number using the lower-case alphabetic sequence a, b, ... z, aa, ab ...
+func toAlphaIndex(n int) string {
+	return alphabetic(n, latinLetters)
 }
 
+// Spell out a number in English.
 func toWords(num int) (out string) {
 	if num == 0 {
 		return "zero"
 	}
+	if num < 0 {
+		return "minus " + toWords(-num)
+	}
 	var words []string
-	numStr := fmt.Sprintf("%d", num)
-	numStrLen := len(numStr)
-	groups := (numStrLen + 2) / 3
-	if numStrLen < groups*3 {
-		numStr = strings.Repeat("0", groups*3-numStrLen) + numStr
-	}
-	for i := 0; i < len(numStr); i = i + 3 {
-		h, _ := strconv.Atoi(numStr[i : i+1])
-		t, _ := strconv.Atoi(numStr[i+1 : i+2])
-		u, _ := strconv.Atoi(numStr[i+2 : i+3])
-		g := groups - (i/3 + 1)
-		if h >= 1 {
-			words = append(words, units[h])
-			words = append(words, "hundred")
+	// work up from the least significant group of three digits
+	for g := 0; num > 0; g, num = g+1, num/1000 {
+		group := num % 1000
+		if group == 0 {
+			continue
 		}
-		if t > 1 {
-			words = append(words, tens[t])
-			if u >= 1 {
-				words = append(words, units[u])
-			}
-		} else {
-			if t == 1 {
-				if u >= 1 {
-					words = append(words, teens[u])
-				} else {
-					words = append(words, tens[t])
-				}
-			} else {
-				if u >= 1 {
-					words = append(words, units[u])
-				}
-			}
-			if g >= 1 && (h+t+u) > 0 {
-				words = append(words, thousands[g])
+		var w []string
+		h, t, u := group/100, group/10%10, group%10
+		if h > 0 {
+			w = append(w, units[h], "hundred")
+		}
+		switch {
+		case t == 1:
+			w = append(w, teens[u])
+		case t > 1:
+			w = append(w, tens[t])
+			if u > 0 {
+				w = append(w, units[u])
 			}
-
+		case u > 0:
+			w = append(w, units[u])
+		}
+		if g > 0 {
+			w = append(w, thousands[g])
 		}
+		words = append(w, words...)
 	}
 	out = strings.Join(words, " ")
 	return
 }
 
-func formatNumber(n int, format string) (out string) {
-	if format == "Ww" {
-		out = strings.Title(toWords(n))
+// The attributes of xsl:number that control how each number is formatted,
+// after evaluating any attribute value templates.
+type numberFormat struct {
+	lang              string
+	letterValue       string // "alphabetic" or "traditional"
+	groupingSeparator string
+	groupingSize      int
+}
+
+// Format a single number with a format token.
+//
+// A token made up of decimal digits in any script, such as 1, 01 or the
+// Arabic-Indic one, formats the number with those digits; the number of
+// digits in the token gives the minimum width. Other tokens are looked up
+// in the registry of numbering sequences (see RegisterNumbering), and
+// anything we don't recognize is treated as 1.
+func formatNumber(n int, token string, f *numberFormat) (out string) {
+	zero, width, ok := decimalToken(token)
+	if !ok {
+		zero, width = '0', 1
+		if n > 0 {
+			// there are no letters or numerals for zero
+			if numbering := lookupNumbering(f.lang, token); numbering != nil {
+				return numbering(n, f.letterValue)
+			}
+		}
+	}
+	digits := []rune(strconv.Itoa(n))
+	sign := ""
+	if n < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	for len(digits) < width {
+		digits = append([]rune{'0'}, digits...)
+	}
+	for i, d := range digits {
+		digits[i] = zero + d - '0'
+	}
+	return sign + f.group(digits)
+}
+
+// Returns the zero digit and width of a token that is a series of zeros
+// followed by a one, all from the same set of decimal digits.
+func decimalToken(token string) (zero rune, width int, ok bool) {
+	digits := []rune(token)
+	if len(digits) == 0 {
 		return
 	}
-	switch format[0] {
-	case '1':
-		out = fmt.Sprintf("%d", n)
-	case '0':
-		z := fmt.Sprintf("%%0%dd", len(format))
-		out = fmt.Sprintf(z, n)
-	case 'I':
-		out = RomanNumber(n).String()
-	case 'i':
-		out = strings.ToLower(RomanNumber(n).String())
-	case 'a':
-		out = toAlphaIndex(n)
-	case 'A':
-		out = strings.ToUpper(toAlphaIndex(n))
-	case 'w':
-		out = toWords(n)
-	case 'W':
-		out = strings.ToUpper(toWords(n))
-	default:
-		out = fmt.Sprintf("%d", n)
+	one := digits[len(digits)-1]
+	if digitValue(one) != 1 {
+		return
 	}
-	return
+	for _, d := range digits[:len(digits)-1] {
+		if d != one-1 {
+			return
+		}
+	}
+	return one - 1, len(digits), true
+}
+
+// Returns the value of a decimal digit, or -1 if r is not a digit. Unicode
+// encodes each set of decimal digits as a run of ten consecutive code
+// points starting with zero, so the value is the offset into the run.
+func digitValue(r rune) int {
+	if !unicode.IsDigit(r) {
+		return -1
+	}
+	start := r
+	for unicode.IsDigit(start - 1) {
+		start--
+	}
+	return int(r-start) % 10
+}
+
+// Insert the grouping separator between groups of digits.
+func (f *numberFormat) group(digits []rune) string {
+	if f.groupingSize <= 0 || f.groupingSeparator == "" {
+		return string(digits)
+	}
+	var groups []string
+	for len(digits) > f.groupingSize {
+		groups = append([]string{string(digits[len(digits)-f.groupingSize:])}, groups...)
+		digits = digits[:len(digits)-f.groupingSize]
+	}
+	groups = append([]string{string(digits)}, groups...)
+	return strings.Join(groups, f.groupingSeparator)
 }
 
 type fmtToken struct {
@@ -150,189 +192,244 @@ type fmtToken struct {
 	isNumber bool
 }
 
-func formatNumbers(numbers []int, format string) (out string) {
-	//TODO: special cases: no numbers, punctuation-only format token
-	if format == "" {
-		format = "1"
-	}
+// Format a list of numbers using the format attribute of xsl:number.
+//
+// The format string is split into alphanumeric format tokens separated by
+// punctuation. Leading and trailing punctuation is output before and after
+// the numbers. Each number uses the corresponding format token, with the
+// last one being reused once they run out; numbers after the first are
+// preceded by the separator that precedes their format token (or the last
+// separator, or "." if there is none).
+func formatNumbers(numbers []int, format string, f *numberFormat) (out string) {
+	var prefix, suffix string
+	var formats, separators []string
 	tokens := parseFormatString(format)
-
-	// capture the last numeric format token
-	lastNum := 0
-	if tokens[len(tokens)-1].isNumber {
-		lastNum = len(tokens) - 1
-	} else {
-		if len(tokens) > 2 && tokens[len(tokens)-2].isNumber {
-			lastNum = len(tokens) - 2
+	for i, t := range tokens {
+		switch {
+		case t.isNumber:
+			formats = append(formats, t.s)
+		case i == 0:
+			prefix = t.s
+		case i == len(tokens)-1:
+			suffix = t.s
+		default:
+			separators = append(separators, t.s)
 		}
 	}
+	if len(formats) == 0 {
+		formats = []string{"1"}
+	}
 
-	var t fmtToken
-	ti := 0
+	out = prefix
 	for i, n := range numbers {
-		//if there are more numbers than formatting tokens
-		// each extra number is output as "." + last numeric format token
-		if i > 0 && ti >= lastNum {
-			out = out + "."
-			t = tokens[lastNum]
-		} else {
-			t = tokens[ti]
-		}
-		if !t.isNumber {
-			out = out + t.s
-			ti = ti + 1
-			if ti < len(tokens) {
-				t = tokens[ti]
-			} else {
-				t = tokens[lastNum]
+		if i > 0 {
+			switch {
+			case i-1 < len(separators):
+				out = out + separators[i-1]
+			case len(separators) > 0:
+				out = out + separators[len(separators)-1]
+			default:
+				out = out + "."
 			}
 		}
-		if t.isNumber {
-			out = out + formatNumber(n, t.s)
-		} else {
-			out = out + t.s
+		token := formats[len(formats)-1]
+		if i < len(formats) {
+			token = formats[i]
 		}
-		ti = ti + 1
-	}
-	// if there's a punctuation token at the end of the format string, append it
-	suffix := tokens[len(tokens)-1]
-	if !suffix.isNumber {
-		out = out + suffix.s
+		out = out + formatNumber(n, token, f)
 	}
+	out = out + suffix
 	return
 }
 
 func parseFormatString(format string) (tokens []fmtToken) {
-	s := strings.NewReader(format)
-	punct := true
 	start := 0
-	pos := 0
-	for s.Len() > 0 {
-		r, w, _ := s.ReadRune()
-		if unicode.IsDigit(r) || unicode.IsLetter(r) {
-			pos = pos + w
-			if !punct {
-				continue
-			}
-			punct = false
-			s.UnreadRune()
-			pos = pos - w
-			punctok := format[start:pos]
-			if punctok != "" {
-				tokens = append(tokens, fmtToken{punctok, false})
-			}
-			start = pos
-		} else {
-			pos = pos + w
-			if punct {
-				continue
-			}
-			punct = true
-			s.UnreadRune()
-			pos = pos - w
-			punctok := format[start:pos]
-			if punctok != "" {
-				tokens = append(tokens, fmtToken{punctok, true})
-			}
+	alnum := false
+	for pos, r := range format {
+		isAlnum := unicode.IsDigit(r) || unicode.IsLetter(r)
+		if pos > start && isAlnum != alnum {
+			tokens = append(tokens, fmtToken{format[start:pos], alnum})
 			start = pos
 		}
+		alnum = isAlnum
 	}
-	if pos > start {
-		tokens = append(tokens, fmtToken{format[start:], !punct})
+	if start < len(format) {
+		tokens = append(tokens, fmtToken{format[start:], alnum})
 	}
 	return
 }
 
-func matchesOne(node xml.Node, patterns []*CompiledMatch) bool {
-	for _, m := range patterns {
-		if m.EvalMatch(node, "", nil) {
-			return true
-		}
+// The compiled form of xsl:number.
+type numberInstruction struct {
+	level             string
+	count             []*CompiledMatch // if nil, count nodes like the current node
+	from              []*CompiledMatch
+	format            *avt
+	lang              *avt
+	letterValue       *avt
+	groupingSeparator *avt
+	groupingSize      *avt
+}
+
+func compileNumber(node xml.Node) *numberInstruction {
+	n := &numberInstruction{level: node.Attr("level")}
+	if n.level == "" {
+		n.level = "single"
 	}
-	return false
+	if count := node.Attr("count"); count != "" {
+		n.count = compileMatch(node, "count", count, nil)
+	}
+	if from := node.Attr("from"); from != "" {
+		n.from = compileMatch(node, "from", from, nil)
+	}
+	n.format = compileAttributeAVT(node, "format")
+	n.lang = compileAttributeAVT(node, "lang")
+	n.letterValue = compileAttributeAVT(node, "letter-value")
+	n.groupingSeparator = compileAttributeAVT(node, "grouping-separator")
+	n.groupingSize = compileAttributeAVT(node, "grouping-size")
+	return n
 }
 
-func findTarget(node xml.Node, count string) (target xml.Node) {
-	countExpr := CompileMatch(count, nil)
-	for cur := node; cur != nil; cur = cur.Parent() {
-		if matchesOne(cur, countExpr) {
-			return cur
-		}
+func (n *numberInstruction) free() {
+	freeMatches(n.count)
+	freeMatches(n.from)
+	for _, a := range []*avt{n.format, n.lang, n.letterValue, n.groupingSeparator, n.groupingSize} {
+		a.free()
+	}
+}
+
+// Evaluate the attribute value templates that control formatting.
+func (n *numberInstruction) evalFormat(node xml.Node, context *ExecutionContext) (format string, f *numberFormat) {
+	format = n.format.eval(node, context)
+	if format == "" {
+		format = "1"
+	}
+	f = &numberFormat{
+		lang:        n.lang.eval(node, context),
+		letterValue: n.letterValue.eval(node, context),
+	}
+	// grouping is only used when both attributes are present
+	separator := n.groupingSeparator.eval(node, context)
+	size, err := strconv.Atoi(n.groupingSize.eval(node, context))
+	if separator != "" && err == nil && size > 0 {
+		f.groupingSeparator = separator
+		f.groupingSize = size
 	}
 	return
 }
 
-func countNodes(level string, node xml.Node, count string, from string) (num int) {
-	//compile count, from matches
-	countExpr := CompileMatch(count, nil)
-	fromExpr := CompileMatch(from, nil)
-	cur := node
-	for cur != nil {
-		//if matches count, num++
-		if matchesOne(cur, countExpr) {
-			num = num + 1
-		}
-		//if matches from, break
-		if matchesOne(cur, fromExpr) {
-			break
-		}
+// Format the value of the value attribute, which is rounded to an integer.
+// Values that cannot be formatted are output as if by string().
+func formatValue(v float64, format string, f *numberFormat) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) || v < 0.5 || v >= 1<<53 {
+		return numberToString(v)
+	}
+	return formatNumbers([]int{int(math.Floor(v + 0.5))}, format, f)
+}
 
-		t := cur
-		cur = cur.PreviousSibling()
+// Return the numbers that identify node, according to the level, count and
+// from attributes.
+func (n *numberInstruction) placeMarkers(node xml.Node, context *ExecutionContext) (numbers []int) {
+	count := func(cur xml.Node) bool {
+		if n.count == nil {
+			return sameKindAndName(cur, node)
+		}
+		return matchesOne(cur, n.count, context)
+	}
+	from := func(cur xml.Node) bool {
+		return n.from != nil && matchesOne(cur, n.from, context)
+	}
 
-		//for level = 'any' we need walk the preceding axis
-		//this finds the last descendant of our previous sibling
-		if cur != nil && level == "any" {
-			for cur.LastChild() != nil {
-				cur = cur.LastChild()
+	switch n.level {
+	case "any":
+		// count the matching nodes that precede node (or are its
+		// ancestors) back to the last node matching the from pattern
+		num := 0
+		for cur := node; cur != nil; cur = previousInDocument(cur) {
+			if count(cur) {
+				num++
+			}
+			if from(cur) {
+				break
 			}
 		}
-
-		// no preceding node; for level='any' go to ancestor
-		if cur == nil && level == "any" {
-			cur = t.Parent()
+		if num > 0 {
+			numbers = append(numbers, num)
+		}
+	case "multiple":
+		// number each matching ancestor below the nearest from ancestor
+		for cur := node; cur != nil; cur = cur.Parent() {
+			if count(cur) {
+				numbers = append([]int{siblingNumber(cur, count)}, numbers...)
+			}
+			if from(cur) {
+				break
+			}
+		}
+	default:
+		// number the nearest matching ancestor below the nearest from ancestor
+		for cur := node; cur != nil; cur = cur.Parent() {
+			if count(cur) {
+				numbers = append(numbers, siblingNumber(cur, count))
+				break
+			}
+			if from(cur) {
+				break
+			}
 		}
-
-		//break on document node
 	}
 	return
 }
 
-/*
-func main() {
-	formatNumbers([]int{5}, "1.")
-	formatNumbers([]int{5}, "(1)")
-	formatNumbers([]int{5}, "1.A.i>")
-	formatNumbers([]int{5, 2}, "1.A.i>")
-	formatNumbers([]int{5, 2}, "1.")
-	formatNumbers([]int{5, 2}, "1")
-	formatNumbers([]int{1, 2, 3}, "1+1")
+// One plus the number of preceding siblings of node that match count.
+func siblingNumber(node xml.Node, count func(xml.Node) bool) int {
+	num := 1
+	if node.NodeType() == xml.XML_ATTRIBUTE_NODE {
+		// attributes don't have siblings
+		return num
+	}
+	for cur := node.PreviousSibling(); cur != nil; cur = cur.PreviousSibling() {
+		if count(cur) {
+			num++
+		}
+	}
+	return num
 }
-*/
-/*
-public string AddOrdinal(int num)
-{
-    if( num <= 0 ) return num.ToString();
 
-    switch(num % 100)
-    {
-        case 11:
-        case 12:
-        case 13:
-            return num + "th";
-    }
+// The node before this one in document order, which is either the last
+// descendant of the previous sibling or, failing that, the parent.
+func previousInDocument(node xml.Node) xml.Node {
+	if node.NodeType() == xml.XML_ATTRIBUTE_NODE {
+		return node.Parent()
+	}
+	cur := node.PreviousSibling()
+	if cur == nil {
+		return node.Parent()
+	}
+	for cur.LastChild() != nil {
+		cur = cur.LastChild()
+	}
+	return cur
+}
 
-    switch(num % 10)
-    {
-        case 1:
-            return num + "st";
-        case 2:
-            return num + "nd";
-        case 3:
-            return num + "rd";
-        default:
-            return num + "th";
-    }
+// The default count pattern matches nodes of the same type and name
+// as the current node.
+func sameKindAndName(n, node xml.Node) bool {
+	if n.NodeType() != node.NodeType() {
+		return false
+	}
+	switch n.NodeType() {
+	case xml.XML_ELEMENT_NODE, xml.XML_ATTRIBUTE_NODE, xml.XML_PI_NODE:
+		return n.Name() == node.Name() && n.Namespace() == node.Namespace()
+	}
+	return true
+}
 
+func matchesOne(node xml.Node, patterns []*CompiledMatch, context *ExecutionContext) bool {
+	for _, m := range patterns {
+		if m.EvalMatch(node, "", context) {
+			return true
+		}
+	}
+	return false
 }
-*/
@@ -0,0 +1,178 @@
+package xslt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatNumbers(t *testing.T) {
+	grouped := &numberFormat{groupingSeparator: ",", groupingSize: 3}
+	alphabetic := &numberFormat{letterValue: "alphabetic"}
+	tests := []struct {
+		numbers []int
+		format  string
+		f       *numberFormat
+		want    string
+	}{
+		{[]int{5}, "1", nil, "5"},
+		{[]int{5}, "1.", nil, "5."},
+		{[]int{5}, "(1)", nil, "(5)"},
+		{[]int{5, 2}, "1", nil, "5.2"},
+		{[]int{5, 2, 3}, "1.A-i>", nil, "5.B-iii>"},
+		{[]int{1, 2, 3}, "1+1", nil, "1+2+3"},
+		{[]int{7}, "001", nil, "007"},
+		{[]int{1234}, "001", nil, "1234"},
+		{[]int{}, "[1]", nil, "[]"},
+		{[]int{3}, "#", nil, "#3"},
+		{[]int{26}, "a", nil, "z"},
+		{[]int{27}, "a", nil, "aa"},
+		{[]int{701}, "a", nil, "zy"},
+		{[]int{702}, "A", nil, "ZZ"},
+		{[]int{703}, "a", nil, "aaa"},
+		{[]int{1994}, "I", nil, "MCMXCIV"},
+		{[]int{9}, "i", alphabetic, "i"},
+		{[]int{9}, "I", alphabetic, "I"},
+		{[]int{0}, "a", nil, "0"},
+		{[]int{1234567}, "1", grouped, "1,234,567"},
+		{[]int{1234567}, "0001", &numberFormat{groupingSeparator: " ", groupingSize: 2}, "1 23 45 67"},
+		{[]int{123}, "1", grouped, "123"},
+		{[]int{21000}, "w", nil, "twenty one thousand"},
+		{[]int{1000010}, "Ww", nil, "One Million Ten"},
+		{[]int{115}, "W", nil, "ONE HUNDRED FIFTEEN"},
+	}
+	for _, test := range tests {
+		f := test.f
+		if f == nil {
+			f = &numberFormat{}
+		}
+		if got := formatNumbers(test.numbers, test.format, f); got != test.want {
+			t.Errorf("formatNumbers(%v, %q) = %q, want %q", test.numbers, test.format, got, test.want)
+		}
+	}
+}
+
+// Clauses are numbered within their section, sections within their part.
+func TestNumberLevels(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:param name="sep" select="'.'"/>
+<xsl:template match="clause">
+  <xsl:number level="multiple" count="section|clause" from="part" format="1{$sep}a"/>
+  <xsl:text> </xsl:text>
+  <xsl:number level="single" count="clause" from="part" format="(i)" letter-value="{@lv}"/>
+  <xsl:text> </xsl:text>
+  <xsl:number level="any" count="clause" from="part"/>
+  <xsl:text> </xsl:text>
+  <xsl:number level="any"/>
+  <xsl:text>&#10;</xsl:text>
+</xsl:template>
+<xsl:template match="text()"/>
+</xsl:stylesheet>`
+	input := `<doc>
+<part><section><clause/><clause lv="alphabetic"/></section><section><clause/></section></part>
+<part><clause/><section><clause/></section></part>
+</doc>`
+	stylesheet, doc := parseTransformTest(t, xsl, input)
+	output, err := stylesheet.Process(doc, StylesheetOptions{Parameters: map[string]interface{}{"sep": ")"}})
+	if err != nil {
+		t.Error(err)
+	}
+	want := "1)a (i) 1 1\n1)b (b) 2 2\n2)a (i) 3 3\n1 (i) 1 4\n2)a (i) 2 5\n"
+	if output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
+func TestNumberValue(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:template match="/doc">
+  <xsl:for-each select="v">
+    <xsl:number value="." grouping-separator="{../@sep}" grouping-size="{../@size}"/>
+    <xsl:text>,</xsl:text>
+  </xsl:for-each>
+</xsl:template>
+</xsl:stylesheet>`
+	input := `<doc sep="." size="3"><v>2.5</v><v>3.49</v><v>1234567.8</v><v>0.2</v><v>-3</v><v>x</v></doc>`
+	stylesheet, doc := parseTransformTest(t, xsl, input)
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Error(err)
+	}
+	if want := "3,3,1.234.568,0.2,-3,NaN,"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
+func TestLocalizedNumbering(t *testing.T) {
+	tests := []struct {
+		n           int
+		format      string
+		lang        string
+		letterValue string
+		want        string
+	}{
+		{1234, "١", "", "", "١٢٣٤"},
+		{5, "٠١", "ar", "", "٠٥"},
+		{42, "१", "", "", "४२"},
+		{1234567, "۱", "fa", "", "۱۲۳۴۵۶۷"},
+		{25, "α", "", "", "αα"},
+		{2, "Α", "el", "", "Β"},
+		{7, "а", "", "", "ж"},
+		{29, "А", "ru", "", "АА"},
+		{15, "א", "", "", "טו"},
+		{5784, "א", "he", "traditional", "ה׳תשפד"},
+		{23, "א", "", "alphabetic", "אא"},
+		{11, "一", "ja", "", "十一"},
+		{110, "一", "", "", "百十"},
+		{2023, "一", "ja", "", "二千二十三"},
+		{10000, "一", "", "", "一万"},
+		{110, "一", "zh", "", "一百一十"},
+		{10001, "一", "zh-CN", "", "一万零一"},
+		{2023, "一", "zh", "", "二千零二十三"},
+		{21, "w", "fr", "", "vingt et un"},
+		{71, "w", "fr", "", "soixante et onze"},
+		{80, "w", "fr-CA", "", "quatre-vingts"},
+		{81, "w", "fr", "", "quatre-vingt-un"},
+		{201, "w", "fr", "", "deux cent un"},
+		{80200, "w", "fr", "", "quatre-vingt mille deux cents"},
+		{2000000, "Ww", "fr", "", "Deux Millions"},
+		{1001, "w", "de", "", "eintausendeins"},
+		{3456, "w", "de", "", "dreitausendvierhundertsechsundfünfzig"},
+		{2000001, "w", "de", "", "zwei millionen eins"},
+		{1000000, "W", "de", "", "EINE MILLION"},
+		{21000, "w", "es", "", "veintiún mil"},
+		{100, "w", "es", "", "cien"},
+		{131, "w", "es", "", "ciento treinta y uno"},
+		{1000000, "w", "es", "", "un millón"},
+		{500000000, "w", "es", "", "quinientos millones"},
+		{21, "w", "en", "", "twenty one"},
+		{21, "w", "", "", "twenty one"},
+	}
+	for _, test := range tests {
+		f := &numberFormat{lang: test.lang, letterValue: test.letterValue}
+		if got := formatNumber(test.n, test.format, f); got != test.want {
+			t.Errorf("formatNumber(%d, %q) with lang %q = %q, want %q", test.n, test.format, test.lang, got, test.want)
+		}
+	}
+}
+
+func TestRegisterNumbering(t *testing.T) {
+	RegisterNumbering("x-test", "o", func(n int, letterValue string) string {
+		return strings.Repeat("o", n)
+	})
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:template match="/doc">
+  <xsl:for-each select="i"><xsl:number format="o." lang="{@lang}"/></xsl:for-each>
+</xsl:template>
+</xsl:stylesheet>`
+	stylesheet, doc := parseTransformTest(t, xsl, `<doc><i lang="x-test"/><i lang="en"/><i lang="X-Test-Variant"/></doc>`)
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Error(err)
+	}
+	if want := "o.2.ooo."; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
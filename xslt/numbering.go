@@ -0,0 +1,455 @@
+package xslt
+
+import (
+	"strings"
+	"sync"
+)
+
+// A Numbering converts a positive integer into a numbering sequence, such
+// as letters of an alphabet, traditional numerals or words.
+//
+// The letterValue is the value of the letter-value attribute of
+// xsl:number ("alphabetic", "traditional" or empty), which distinguishes
+// sequences that start with the same token.
+type Numbering func(n int, letterValue string) string
+
+var numberings = struct {
+	sync.RWMutex
+	m map[string]Numbering
+}{m: make(map[string]Numbering)}
+
+// RegisterNumbering makes a numbering sequence available to xsl:number
+// through a format token. Registering a token again replaces the earlier
+// sequence.
+//
+// If lang is empty, the sequence is used whenever the lang attribute of
+// xsl:number does not select a more specific one. Otherwise it is used
+// when the lang attribute names that language or one of its variants, so
+// a sequence registered for "fr" also applies to lang="fr-CA".
+//
+// If no sequence is registered for the tokens "W" or "Ww", the sequence
+// registered for "w" is used and converted to upper or title case.
+func RegisterNumbering(lang, token string, fn Numbering) {
+	numberings.Lock()
+	numberings.m[numberingKey(lang, token)] = fn
+	numberings.Unlock()
+}
+
+func numberingKey(lang, token string) string {
+	return strings.ToLower(lang) + " " + token
+}
+
+// Find the numbering sequence for a format token, trying each less
+// specific variant of the language in turn.
+func lookupNumbering(lang, token string) Numbering {
+	numberings.RLock()
+	defer numberings.RUnlock()
+	lang = strings.ToLower(lang)
+	for {
+		if fn, ok := numberings.m[numberingKey(lang, token)]; ok {
+			return fn
+		}
+		switch token {
+		case "W":
+			if fn, ok := numberings.m[numberingKey(lang, "w")]; ok {
+				return func(n int, letterValue string) string {
+					return strings.ToUpper(fn(n, letterValue))
+				}
+			}
+		case "Ww":
+			if fn, ok := numberings.m[numberingKey(lang, "w")]; ok {
+				return func(n int, letterValue string) string {
+					return strings.Title(fn(n, letterValue))
+				}
+			}
+		}
+		if lang == "" {
+			return nil
+		}
+		if i := strings.LastIndex(lang, "-"); i >= 0 {
+			lang = lang[:i]
+		} else {
+			lang = ""
+		}
+	}
+}
+
+const (
+	latinLetters         = "abcdefghijklmnopqrstuvwxyz"
+	greekLetters         = "αβγδεζηθικλμνξοπρστυφχψω"
+	cyrillicLetters      = "абвгдежзиклмнопрстуфхцчшщэюя"
+	hebrewLetters        = "אבגדהוזחטיכלמנסעפצקרשת"
+	upperLatinLetters    = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	upperGreekLetters    = "ΑΒΓΔΕΖΗΘΙΚΛΜΝΞΟΠΡΣΤΥΦΧΨΩ"
+	upperCyrillicLetters = "АБВГДЕЖЗИКЛМНОПРСТУФХЦЧШЩЭЮЯ"
+)
+
+func init() {
+	for _, letters := range []string{latinLetters, upperLatinLetters, greekLetters,
+		upperGreekLetters, cyrillicLetters, upperCyrillicLetters} {
+		first := []rune(letters)[:1]
+		RegisterNumbering("", string(first), alphabeticNumbering(letters))
+	}
+	RegisterNumbering("", "i", romanNumbering(strings.ToLower, latinLetters))
+	RegisterNumbering("", "I", romanNumbering(strings.ToUpper, upperLatinLetters))
+	RegisterNumbering("", "א", func(n int, letterValue string) string {
+		if letterValue == "alphabetic" {
+			return alphabetic(n, hebrewLetters)
+		}
+		return hebrewNumber(n)
+	})
+	RegisterNumbering("", "一", wordNumbering(japaneseNumber))
+	RegisterNumbering("zh", "一", wordNumbering(chineseNumber))
+	RegisterNumbering("", "w", wordNumbering(toWords))
+	RegisterNumbering("de", "w", wordNumbering(germanWords))
+	RegisterNumbering("es", "w", wordNumbering(spanishWords))
+	RegisterNumbering("fr", "w", wordNumbering(frenchWords))
+}
+
+func alphabeticNumbering(letters string) Numbering {
+	return func(n int, letterValue string) string {
+		return alphabetic(n, letters)
+	}
+}
+
+func wordNumbering(words func(int) string) Numbering {
+	return func(n int, letterValue string) string {
+		return words(n)
+	}
+}
+
+// Roman numerals, unless letter-value="alphabetic" asks for letters.
+func romanNumbering(toCase func(string) string, letters string) Numbering {
+	return func(n int, letterValue string) string {
+		if letterValue == "alphabetic" {
+			return alphabetic(n, letters)
+		}
+		return toCase(RomanNumber(n).String())
+	}
+}
+
+// Number using an alphabetic sequence: the letters in turn, then pairs
+// of letters, then triples and so on.
+func alphabetic(n int, letters string) string {
+	alphabet := []rune(letters)
+	var out []rune
+	for n > 0 {
+		n--
+		out = append([]rune{alphabet[n%len(alphabet)]}, out...)
+		n = n / len(alphabet)
+	}
+	return string(out)
+}
+
+var hebrewUnits = []rune("אבגדהוזחט")
+var hebrewTens = []rune("יכלמנסעפצ")
+var hebrewHundreds = []rune("קרשת")
+
+// Hebrew numerals, where each letter stands for a value and the values
+// are added together. Thousands are written as a separate number followed
+// by a geresh.
+func hebrewNumber(n int) string {
+	var out []rune
+	if n >= 1000 {
+		out = append([]rune(hebrewNumber(n/1000)), '׳')
+		n = n % 1000
+	}
+	for ; n >= 400; n -= 400 {
+		out = append(out, hebrewHundreds[3])
+	}
+	if n >= 100 {
+		out = append(out, hebrewHundreds[n/100-1])
+		n = n % 100
+	}
+	// 15 and 16 are written 9+6 and 9+7 to avoid spelling the name of God
+	switch n {
+	case 15, 16:
+		return string(append(out, hebrewUnits[8], hebrewUnits[n-10]))
+	}
+	if n >= 10 {
+		out = append(out, hebrewTens[n/10-1])
+		n = n % 10
+	}
+	if n > 0 {
+		out = append(out, hebrewUnits[n-1])
+	}
+	return string(out)
+}
+
+var cjkDigits = []rune("〇一二三四五六七八九")
+var cjkPlaces = []rune("十百千")
+
+// Japanese numbers, which group digits in fours; 1 is omitted before
+// ten, hundred and thousand.
+func japaneseNumber(n int) string {
+	return cjkNumber(n, []rune("万億兆京"), false)
+}
+
+// Chinese numbers, which mark skipped places with 零 and only omit 1
+// before ten at the start of a number.
+func chineseNumber(n int) string {
+	return cjkNumber(n, []rune("万亿兆京"), true)
+}
+
+func cjkNumber(n int, units []rune, chinese bool) string {
+	var groups []int
+	for ; n > 0; n = n / 10000 {
+		groups = append(groups, n%10000)
+	}
+	var out []rune
+	zero := false // whether places have been skipped since the last digit
+	for g := len(groups) - 1; g >= 0; g-- {
+		for p := 3; p >= 0; p-- {
+			d := groups[g] / []int{1, 10, 100, 1000}[p] % 10
+			if d == 0 {
+				zero = len(out) > 0
+				continue
+			}
+			if zero && chinese {
+				out = append(out, '零')
+			}
+			zero = false
+			switch {
+			case p == 0, d > 1:
+				out = append(out, cjkDigits[d])
+			case chinese && (p > 1 || len(out) > 0):
+				out = append(out, cjkDigits[d])
+			}
+			if p > 0 {
+				out = append(out, cjkPlaces[p-1])
+			}
+		}
+		if g > 0 && groups[g] > 0 {
+			out = append(out, units[g-1])
+		}
+	}
+	return string(out)
+}
+
+var frenchUnits = []string{"zéro", "un", "deux", "trois", "quatre", "cinq",
+	"six", "sept", "huit", "neuf", "dix", "onze", "douze", "treize",
+	"quatorze", "quinze", "seize", "dix-sept", "dix-huit", "dix-neuf"}
+var frenchTens = []string{"", "dix", "vingt", "trente", "quarante",
+	"cinquante", "soixante"}
+var frenchScales = []string{"", "mille", "million", "milliard", "billion",
+	"billiard", "trillion"}
+
+// Spell out a number in French. Vingt and cent take a plural s when they
+// end a number, or are multiplied by million and higher (which are nouns).
+func frenchWords(n int) string {
+	if n == 0 {
+		return frenchUnits[0]
+	}
+	var words []string
+	for g := 0; n > 0; g, n = g+1, n/1000 {
+		group := n % 1000
+		var w []string
+		switch {
+		case group == 0:
+			continue
+		case g == 0:
+			w = []string{frenchBelow1000(group, true)}
+		case g == 1 && group == 1:
+			w = []string{"mille"}
+		case g == 1:
+			w = []string{frenchBelow1000(group, false), "mille"}
+		case group == 1:
+			w = []string{"un", frenchScales[g]}
+		default:
+			w = []string{frenchBelow1000(group, true), frenchScales[g] + "s"}
+		}
+		words = append(w, words...)
+	}
+	return strings.Join(words, " ")
+}
+
+func frenchBelow1000(n int, plural bool) string {
+	h, r := n/100, n%100
+	var w []string
+	switch {
+	case h == 1:
+		w = append(w, "cent")
+	case h > 1 && r == 0 && plural:
+		w = append(w, frenchUnits[h], "cents")
+	case h > 1:
+		w = append(w, frenchUnits[h], "cent")
+	}
+	if r > 0 {
+		w = append(w, frenchBelow100(r, plural))
+	}
+	return strings.Join(w, " ")
+}
+
+func frenchBelow100(n int, plural bool) string {
+	switch {
+	case n < 20:
+		return frenchUnits[n]
+	case n == 71:
+		return "soixante et onze"
+	case n < 80:
+		t, u := n/10, n%10
+		if t == 7 {
+			t, u = 6, u+10
+		}
+		switch u {
+		case 0:
+			return frenchTens[t]
+		case 1:
+			return frenchTens[t] + " et un"
+		}
+		return frenchTens[t] + "-" + frenchUnits[u]
+	case n == 80 && plural:
+		return "quatre-vingts"
+	case n == 80:
+		return "quatre-vingt"
+	}
+	return "quatre-vingt-" + frenchUnits[n-80]
+}
+
+var germanUnits = []string{"null", "eins", "zwei", "drei", "vier", "fünf",
+	"sechs", "sieben", "acht", "neun", "zehn", "elf", "zwölf", "dreizehn",
+	"vierzehn", "fünfzehn", "sechzehn", "siebzehn", "achtzehn", "neunzehn"}
+var germanTens = []string{"", "zehn", "zwanzig", "dreißig", "vierzig",
+	"fünfzig", "sechzig", "siebzig", "achtzig", "neunzig"}
+var germanScales = []string{"", "", "million", "milliarde", "billion",
+	"billiarde", "trillion"}
+
+// Spell out a number in German. Numbers below a million are written as a
+// single word; millions and higher are separate words.
+func germanWords(n int) string {
+	if n == 0 {
+		return germanUnits[0]
+	}
+	var words []string
+	if below := n % 1000000; below > 0 {
+		w := ""
+		if t := below / 1000; t > 0 {
+			w = germanBelow1000(t, false) + "tausend"
+		}
+		if r := below % 1000; r > 0 {
+			w = w + germanBelow1000(r, true)
+		}
+		words = []string{w}
+	}
+	for g, n := 2, n/1000000; n > 0; g, n = g+1, n/1000 {
+		group := n % 1000
+		switch {
+		case group == 0:
+			continue
+		case group == 1:
+			words = append([]string{"eine", germanScales[g]}, words...)
+		case strings.HasSuffix(germanScales[g], "e"):
+			words = append([]string{germanBelow1000(group, false), germanScales[g] + "n"}, words...)
+		default:
+			words = append([]string{germanBelow1000(group, false), germanScales[g] + "en"}, words...)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// A number below 1000 as one word. One is "eins" at the end of a number
+// and "ein" when it multiplies something.
+func germanBelow1000(n int, final bool) (out string) {
+	h, r := n/100, n%100
+	if h > 0 {
+		out = germanUnit(h, false) + "hundert"
+	}
+	switch {
+	case r == 0:
+	case r < 20:
+		out = out + germanUnit(r, final)
+	case r%10 == 0:
+		out = out + germanTens[r/10]
+	default:
+		out = out + germanUnit(r%10, false) + "und" + germanTens[r/10]
+	}
+	return
+}
+
+func germanUnit(n int, final bool) string {
+	if n == 1 && !final {
+		return "ein"
+	}
+	return germanUnits[n]
+}
+
+var spanishUnits = []string{"cero", "uno", "dos", "tres", "cuatro", "cinco",
+	"seis", "siete", "ocho", "nueve", "diez", "once", "doce", "trece",
+	"catorce", "quince", "dieciséis", "diecisiete", "dieciocho", "diecinueve",
+	"veinte", "veintiuno", "veintidós", "veintitrés", "veinticuatro",
+	"veinticinco", "veintiséis", "veintisiete", "veintiocho", "veintinueve"}
+var spanishTens = []string{"", "", "", "treinta", "cuarenta", "cincuenta",
+	"sesenta", "setenta", "ochenta", "noventa"}
+var spanishHundreds = []string{"", "ciento", "doscientos", "trescientos",
+	"cuatrocientos", "quinientos", "seiscientos", "setecientos",
+	"ochocientos", "novecientos"}
+var spanishScales = []string{"", "millón", "billón", "trillón"}
+var spanishPluralScales = []string{"", "millones", "billones", "trillones"}
+
+// Spell out a number in Spanish, using the long scale: a billón is a
+// million millions.
+func spanishWords(n int) string {
+	if n == 0 {
+		return spanishUnits[0]
+	}
+	var words []string
+	for g := 0; n > 0; g, n = g+1, n/1000000 {
+		group := n % 1000000
+		switch {
+		case group == 0:
+			continue
+		case g == 0:
+			words = []string{spanishBelowMillion(group, false)}
+		case group == 1:
+			words = append([]string{"un", spanishScales[g]}, words...)
+		default:
+			words = append([]string{spanishBelowMillion(group, true), spanishPluralScales[g]}, words...)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// A number below a million. One is shortened to "un" when the number
+// multiplies a noun such as millón.
+func spanishBelowMillion(n int, shorten bool) string {
+	var w []string
+	switch t := n / 1000; {
+	case t == 1:
+		w = append(w, "mil")
+	case t > 1:
+		w = append(w, spanishBelow1000(t, true), "mil")
+	}
+	if r := n % 1000; r > 0 {
+		w = append(w, spanishBelow1000(r, shorten))
+	}
+	return strings.Join(w, " ")
+}
+
+func spanishBelow1000(n int, shorten bool) (out string) {
+	if n == 100 {
+		return "cien"
+	}
+	h, r := n/100, n%100
+	var w []string
+	if h > 0 {
+		w = append(w, spanishHundreds[h])
+	}
+	switch {
+	case r == 0:
+	case r < 30:
+		w = append(w, spanishUnits[r])
+	case r%10 == 0:
+		w = append(w, spanishTens[r/10])
+	default:
+		w = append(w, spanishTens[r/10], "y", spanishUnits[r%10])
+	}
+	out = strings.Join(w, " ")
+	if shorten {
+		if strings.HasSuffix(out, "veintiuno") {
+			out = strings.TrimSuffix(out, "uno") + "ún"
+		} else if strings.HasSuffix(out, "uno") {
+			out = strings.TrimSuffix(out, "o")
+		}
+	}
+	return
+}
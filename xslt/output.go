@@ -0,0 +1,155 @@
+package xslt
+
+/*
+#include <stdint.h>
+*/
+import "C"
+
+import (
+	"bytes"
+	"errors"
+	"github.com/jbowtie/gokogiri/xml"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf16"
+	"unsafe"
+)
+
+// outputWriter writes the serialized result tree to an io.Writer in the
+// encoding requested by xsl:output, as libxml produces it.
+//
+// The result tree itself is transcoded by libxml, which replaces any
+// character that cannot be represented in the target encoding with a
+// character reference. Markup constructed here (the XML declaration and
+// document type declaration) is encoded to match.
+type outputWriter struct {
+	w        io.Writer
+	encoding string // passed to libxml
+	utf16    string // "LE" or "BE" when the encoding is a UTF-16 variant
+	bom      bool   // whether the UTF-16 byte order mark has been written
+	first    bool   // set until the first chunk of each node serialized by libxml
+	prolog   string // written before the first serialized chunk, if there is one
+	started  bool   // whether libxml has serialized anything
+	err      error
+}
+
+// utf16 byte order mark as written by libxml for "UTF-16"
+var utf16BOM = []byte{0xff, 0xfe}
+
+func newOutputWriter(w io.Writer, encoding string) *outputWriter {
+	o := &outputWriter{w: w, encoding: encoding}
+	switch strings.ToUpper(encoding) {
+	case "UTF-16":
+		o.utf16 = "LE"
+	case "UTF-16LE":
+		o.utf16 = "LE"
+		o.bom = true // no byte order mark when the byte order is explicit
+	case "UTF-16BE":
+		o.utf16 = "BE"
+		o.bom = true
+	}
+	return o
+}
+
+func (o *outputWriter) write(b []byte) {
+	if o.err != nil || len(b) == 0 {
+		return
+	}
+	_, o.err = o.w.Write(b)
+}
+
+// Write markup that was constructed as a Go string.
+func (o *outputWriter) writeString(s string) {
+	if o.utf16 == "" {
+		o.write([]byte(s))
+		return
+	}
+	var b []byte
+	if !o.bom {
+		b = append(b, utf16BOM...)
+		o.bom = true
+	}
+	for _, c := range utf16.Encode([]rune(s)) {
+		if o.utf16 == "BE" {
+			b = append(b, byte(c>>8), byte(c))
+		} else {
+			b = append(b, byte(c), byte(c>>8))
+		}
+	}
+	o.write(b)
+}
+
+// Write a chunk serialized by libxml, which starts every UTF-16
+// node it serializes with a byte order mark; only the first one is kept.
+func (o *outputWriter) writeSerialized(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	if !o.started {
+		o.started = true
+		if o.prolog != "" {
+			o.writeString(o.prolog)
+		}
+	}
+	if o.utf16 != "" && o.first && bytes.HasPrefix(b, utf16BOM) {
+		if o.bom {
+			b = b[len(utf16BOM):]
+		}
+		o.bom = true
+	}
+	o.first = false
+	o.write(b)
+}
+
+// Serialize node, passing the output to w as libxml writes it.
+func (o *outputWriter) writeNode(node xml.Node, format xml.SerializationOption) {
+	if o.err != nil {
+		return
+	}
+	o.first = true
+	id := registerWriter(o)
+	defer unregisterWriter(id)
+	if saveNode(node.NodePtr(), o.encoding, int(format), id) < 0 && o.err == nil {
+		o.err = errors.New("cannot serialize the result tree")
+	}
+}
+
+// The writers serializing nodes, by the ID libxml passes back to
+// ratagoWriteOutput; Go pointers cannot be held by C code.
+var (
+	writersLock sync.Mutex
+	writers     = make(map[uintptr]*outputWriter)
+	lastWriter  uintptr
+)
+
+func registerWriter(o *outputWriter) uintptr {
+	writersLock.Lock()
+	defer writersLock.Unlock()
+	lastWriter++
+	writers[lastWriter] = o
+	return lastWriter
+}
+
+func unregisterWriter(id uintptr) {
+	writersLock.Lock()
+	defer writersLock.Unlock()
+	delete(writers, id)
+}
+
+//export ratagoWriteOutput
+func ratagoWriteOutput(id C.uintptr_t, buf *C.char, size C.int) C.int {
+	writersLock.Lock()
+	o := writers[uintptr(id)]
+	writersLock.Unlock()
+	if o == nil {
+		return -1
+	}
+	if size > 0 {
+		o.writeSerialized((*[1 << 30]byte)(unsafe.Pointer(buf))[:size:size])
+	}
+	if o.err != nil {
+		return -1
+	}
+	return size
+}
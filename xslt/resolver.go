@@ -0,0 +1,140 @@
+package xslt
+
+import (
+	"errors"
+	"github.com/jbowtie/gokogiri/xml"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// URIResolver retrieves the resources referenced by xsl:include, xsl:import
+// and document().
+//
+// Relative references have already been resolved against the base URI of the
+// referencing stylesheet module or node by the time Resolve is called, so uri
+// is either an absolute URI or a path relative to wherever the stylesheet
+// itself was loaded from.
+type URIResolver interface {
+	Resolve(uri string) (io.ReadCloser, error)
+}
+
+// FileResolver reads resources from the local file system. It accepts
+// plain file paths as well as file: URIs. It is used whenever no other
+// resolver has been supplied.
+type FileResolver struct{}
+
+func (FileResolver) Resolve(uri string) (io.ReadCloser, error) {
+	name, err := uriToPath(uri)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(name)
+}
+
+// FSResolver reads resources from an fs.FS, such as an embed.FS containing
+// the stylesheets compiled into a binary.
+//
+// Since fs.FS paths are always relative to the root of the file system,
+// any leading slash (as in file:///styles/main.xsl) is ignored.
+type FSResolver struct {
+	FS fs.FS
+}
+
+func (r FSResolver) Resolve(uri string) (io.ReadCloser, error) {
+	name, err := uriToPath(uri)
+	if err != nil {
+		return nil, err
+	}
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		name = "."
+	}
+	return r.FS.Open(name)
+}
+
+// Return the lower-cased scheme of an absolute URI, or the empty string
+// if uri is a file path. Single letters are treated as Windows drive
+// letters rather than schemes.
+func uriScheme(uri string) string {
+	i := strings.Index(uri, ":")
+	if i < 2 {
+		return ""
+	}
+	for n, c := range uri[:i] {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case n > 0 && (c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return ""
+		}
+	}
+	return strings.ToLower(uri[:i])
+}
+
+// Convert a file path or file: URI into a file path.
+func uriToPath(uri string) (string, error) {
+	scheme := uriScheme(uri)
+	if scheme == "" {
+		return uri, nil
+	}
+	if scheme != "file" {
+		return "", errors.New("unsupported URI scheme: " + uri)
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	return u.Path, nil
+}
+
+// Resolve a reference against a base URI. Either may be a URI or a plain
+// file path; an empty base leaves a relative reference unchanged.
+func resolveURI(href, base string) string {
+	if uriScheme(href) != "" || base == "" {
+		return href
+	}
+	if uriScheme(base) != "" {
+		b, err := url.Parse(base)
+		if err != nil {
+			return href
+		}
+		h, err := url.Parse(href)
+		if err != nil {
+			return href
+		}
+		return b.ResolveReference(h).String()
+	}
+	if path.IsAbs(href) {
+		return href
+	}
+	if href == "" {
+		return base
+	}
+	resolved := path.Join(path.Dir(base), href)
+	// a directory, such as the value of xml:base, keeps its trailing slash
+	if strings.HasSuffix(href, "/") {
+		resolved += "/"
+	}
+	return resolved
+}
+
+// Load and parse the document at uri, recording uri as its base URI.
+func loadDocument(resolver URIResolver, uri string) (doc *xml.XmlDocument, err error) {
+	r, err := resolver.Resolve(uri)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+	// let libxml detect the encoding from the XML declaration
+	doc, err = xml.Parse(data, nil, []byte(uri), xml.StrictParseOption, xml.DefaultEncodingBytes)
+	return
+}
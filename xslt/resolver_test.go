@@ -0,0 +1,120 @@
+package xslt
+
+import (
+	"errors"
+	"github.com/jbowtie/gokogiri/xml"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestResolveURI(t *testing.T) {
+	cases := []struct {
+		href, base, want string
+	}{
+		{"b.xsl", "", "b.xsl"},
+		{"b.xsl", "a.xsl", "b.xsl"},
+		{"b.xsl", "styles/a.xsl", "styles/b.xsl"},
+		{"../lib/b.xsl", "styles/main/a.xsl", "styles/lib/b.xsl"},
+		{"/abs/b.xsl", "styles/a.xsl", "/abs/b.xsl"},
+		{"parts/", "data/a.xml", "data/parts/"},
+		{"b.xml", "data/parts/", "data/parts/b.xml"},
+		{"", "data/a.xml", "data/a.xml"},
+		{"b.xsl", "file:///styles/a.xsl", "file:///styles/b.xsl"},
+		{"../b.xsl", "http://example.com/x/y/a.xsl", "http://example.com/x/b.xsl"},
+		{"file:///other/b.xsl", "styles/a.xsl", "file:///other/b.xsl"},
+		{"urn:x-test:b", "file:///styles/a.xsl", "urn:x-test:b"},
+		{"C:/styles/b.xsl", "", "C:/styles/b.xsl"},
+	}
+	for _, c := range cases {
+		if got := resolveURI(c.href, c.base); got != c.want {
+			t.Errorf("resolveURI(%q, %q) = %q, want %q", c.href, c.base, got, c.want)
+		}
+	}
+}
+
+func TestFileResolverAcceptsFileURIs(t *testing.T) {
+	abs, _ := filepath.Abs("testdata/test.xml")
+	r, err := FileResolver{}.Resolve("file://" + filepath.ToSlash(abs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if _, err = (FileResolver{}).Resolve("http://example.com/test.xml"); err == nil {
+		t.Error("expected an error for an unsupported scheme")
+	}
+}
+
+var resolverFS = fstest.MapFS{
+	"styles/main.xsl": &fstest.MapFile{Data: []byte(`<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:import href="../shared/base.xsl"/>
+<xsl:include href="lib/common.xsl"/>
+<xsl:output omit-xml-declaration="yes"/>
+<xsl:template match="/">
+  <out><xsl:apply-templates/><xsl:call-template name="common"/><xsl:value-of select="document('data/extra.xml')/extra"/></out>
+</xsl:template>
+</xsl:stylesheet>`)},
+	"styles/lib/common.xsl": &fstest.MapFile{Data: []byte(`<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:template name="common">[common]</xsl:template>
+</xsl:stylesheet>`)},
+	"shared/base.xsl": &fstest.MapFile{Data: []byte(`<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:template match="doc">[base]</xsl:template>
+</xsl:stylesheet>`)},
+	"styles/data/extra.xml": &fstest.MapFile{Data: []byte(`<extra>[extra]</extra>`)},
+}
+
+// include, import and document() are all loaded through the resolver,
+// each relative to the module that references them
+func TestFSResolver(t *testing.T) {
+	resolver := FSResolver{resolverFS}
+	for _, uri := range []string{"styles/main.xsl", "file:///styles/main.xsl"} {
+		style, err := loadDocument(resolver, uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stylesheet, err := ParseStylesheetWithResolver(style, uri, resolver)
+		if err != nil {
+			t.Fatal(uri, err)
+		}
+		input, _ := xml.Parse([]byte("<doc/>"), nil, nil, xml.StrictParseOption, nil)
+		output, err := stylesheet.Process(input, StylesheetOptions{})
+		if err != nil {
+			t.Error(uri, err)
+		}
+		if want := "<out>[base][common][extra]</out>\n"; output != want {
+			t.Errorf("%s: got %q, want %q", uri, output, want)
+		}
+	}
+}
+
+type mapResolver map[string]string
+
+func (m mapResolver) Resolve(uri string) (io.ReadCloser, error) {
+	data, ok := m[uri]
+	if !ok {
+		return nil, errors.New("not found: " + uri)
+	}
+	return ioutil.NopCloser(strings.NewReader(data)), nil
+}
+
+// A resolver supplied when processing is used for document()
+func TestProcessResolver(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output omit-xml-declaration="yes"/>
+<xsl:template match="/"><out><xsl:value-of select="document('urn:x-db:greeting')"/></out></xsl:template>
+</xsl:stylesheet>`
+	style, _ := xml.Parse([]byte(xsl), nil, nil, xml.StrictParseOption, nil)
+	stylesheet, _ := ParseStylesheet(style, "")
+	input, _ := xml.Parse([]byte("<doc/>"), nil, nil, xml.StrictParseOption, nil)
+	resolver := mapResolver{"urn:x-db:greeting": "<greeting>hello</greeting>"}
+	output, err := stylesheet.Process(input, StylesheetOptions{Resolver: resolver})
+	if err != nil {
+		t.Error(err)
+	}
+	if want := "<out>hello</out>\n"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
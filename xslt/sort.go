@@ -1,19 +1,43 @@
 package xslt
 
 import (
+	"bytes"
 	"github.com/jbowtie/gokogiri/xml"
+	"github.com/jbowtie/gokogiri/xpath"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+	"math"
 	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
-func (i *XsltInstruction) Sort(nodes []xml.Node, context *ExecutionContext) {
-	ns := &NodeSorter{nodes, i.sorting, context}
-	sort.Sort(ns)
+// Sort the nodes using the xsl:sort elements of the instruction. Any
+// attribute value templates are evaluated with node as the context node.
+//
+// Each sort key is evaluated exactly once per node, with the unsorted
+// list of nodes as the current node list. The sort is stable, so nodes
+// that compare equal on every sort key remain in their original
+// (document) order.
+func (i *XsltInstruction) Sort(nodes []xml.Node, node xml.Node, context *ExecutionContext) {
+	ns := &NodeSorter{nodes: nodes, keys: make([][]sortKey, len(nodes))}
+	for j := range ns.keys {
+		ns.keys[j] = make([]sortKey, len(i.sorting))
+	}
+	for k, s := range i.sorting {
+		crit := s.resolve(node, context)
+		crit.evalKeys(nodes, ns.keys, k, context)
+		ns.crit = append(ns.crit, crit)
+	}
+	sort.Stable(ns)
 }
 
+// NodeSorter sorts nodes by their precomputed sort keys.
 type NodeSorter struct {
-	nodes   []xml.Node
-	crit    []*sortCriteria
-	context *ExecutionContext
+	nodes []xml.Node
+	keys  [][]sortKey // the keys for each node, one per sort criterion
+	crit  []*sortCriteria
 }
 
 func (s *NodeSorter) Len() int {
@@ -22,136 +46,197 @@ func (s *NodeSorter) Len() int {
 
 func (s *NodeSorter) Swap(i, j int) {
 	s.nodes[i], s.nodes[j] = s.nodes[j], s.nodes[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
 }
 
 func (s *NodeSorter) Less(i, j int) bool {
-	//make this loop through the by array
-	// return as soon as non-equal result
-	return execSortFunction(s.nodes[i], s.nodes[j], s.crit, s.context)
+	for k, crit := range s.crit {
+		c := crit.compare(&s.keys[i][k], &s.keys[j][k])
+		if crit.reverse {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return false
+}
+
+// The value of a sort key for one node.
+type sortKey struct {
+	str  string
+	coll []byte // collation key, when sorting with a lang
+	num  float64
 }
 
 type sortCriteria struct {
-	sel     string
-	reverse bool
-	numeric bool
+	Node      xml.Node // the xsl:sort element
+	expr      *xpath.Expression
+	order     *avt
+	dataType  *avt
+	caseOrder *avt
+	lang      *avt
+
+	// set when the attribute value templates are evaluated
+	reverse    bool
+	numeric    bool
+	upperFirst bool
+	lowerFirst bool
+	collator   *collate.Collator
 }
 
 func compileSortFunction(i *XsltInstruction) (s *sortCriteria) {
-	s = new(sortCriteria)
-	s.sel = i.Node.Attr("select")
-	if s.sel == "" {
-		s.sel = "string(.)"
-	}
-	order := i.Node.Attr("order")
-	if order == "descending" {
-		s.reverse = true
-	}
-	datatype := i.Node.Attr("data-type")
-	if datatype == "number" {
-		s.numeric = true
+	s = &sortCriteria{Node: i.Node}
+	s.expr = compileExpression(i.Node, "select")
+	if s.expr == nil {
+		s.expr = xpath.Compile("string(.)")
 	}
+	s.order = compileAttributeAVT(i.Node, "order")
+	s.dataType = compileAttributeAVT(i.Node, "data-type")
+	s.caseOrder = compileAttributeAVT(i.Node, "case-order")
+	s.lang = compileAttributeAVT(i.Node, "lang")
 	return s
 }
 
-func execSortFunction(n1, n2 xml.Node, crits []*sortCriteria, context *ExecutionContext) bool {
+func (s *sortCriteria) free() {
+	freeExpression(s.expr)
+	s.order.free()
+	s.dataType.free()
+	s.caseOrder.free()
+	s.lang.free()
+}
 
-	for _, crit := range crits {
-		if crit.numeric {
-			if execNumericSortFunction(n1, n2, crit, context) {
-				return true
-			}
-			continue
+// Evaluate any attribute value templates and return the criteria to sort by.
+func (s *sortCriteria) resolve(node xml.Node, context *ExecutionContext) *sortCriteria {
+	r := &sortCriteria{Node: s.Node, expr: s.expr}
+	order := s.order.eval(node, context)
+	dataType := s.dataType.eval(node, context)
+	caseOrder := s.caseOrder.eval(node, context)
+	lang := s.lang.eval(node, context)
+
+	switch order {
+	case "", "ascending":
+	case "descending":
+		r.reverse = true
+	default:
+		context.reportError(newTransformError("XTDE0030", s.Node, node, nil, "invalid sort order %q", order))
+	}
+	// a QName data-type is implementation-defined; we sort those as text
+	r.numeric = dataType == "number"
+	switch caseOrder {
+	case "":
+	case "upper-first":
+		r.upperFirst = true
+	case "lower-first":
+		r.lowerFirst = true
+	default:
+		context.reportError(newTransformError("XTDE0030", s.Node, node, nil, "invalid case-order %q", caseOrder))
+	}
+	if lang != "" && !r.numeric {
+		tag, err := language.Parse(lang)
+		if err != nil {
+			context.reportError(newTransformError("XTDE0030", s.Node, node, err, "invalid sort language %q", lang))
+		} else if r.upperFirst || r.lowerFirst {
+			// case is compared separately according to case-order
+			r.collator = collate.New(tag, collate.IgnoreCase)
+		} else {
+			r.collator = collate.New(tag)
 		}
+	}
+	return r
+}
 
-		s1, _ := context.EvalXPath(n1, crit.sel)
-		s1, _ = context.XPathContext.ResultAsString()
-		s2, _ := context.EvalXPath(n2, crit.sel)
-		s2, _ = context.XPathContext.ResultAsString()
-
-		if s1.(string) == s2.(string) {
+// Evaluate the select expression for every node, storing the values as
+// sort key k.
+func (s *sortCriteria) evalKeys(nodes []xml.Node, keys [][]sortKey, k int, context *ExecutionContext) {
+	context.RegisterXPathNamespaces(s.Node)
+	var buf collate.Buffer
+	oldpos, oldtotal := context.XPathContext.GetContextPosition()
+	oldcurr := context.Current
+	for j, n := range nodes {
+		context.XPathContext.SetContextPosition(j+1, len(nodes))
+		context.Current = n
+		key := &keys[j][k]
+		_, err := context.EvalXPath(n, s.expr)
+		if err != nil {
+			context.reportError(newTransformError("", s.Node, n, err, "cannot evaluate select=%q", s.expr))
 			continue
 		}
-
-		if !crit.reverse {
-			return s1.(string) < s2.(string)
-		} else {
-			return s1.(string) > s2.(string)
+		if s.numeric {
+			key.num, _ = context.XPathContext.ResultAsNumber()
+			continue
+		}
+		key.str, _ = context.XPathContext.ResultAsString()
+		if s.collator != nil {
+			key.coll = s.collator.KeyFromString(&buf, key.str)
 		}
 	}
-	return false
-	//case-order
-	//lang
-	//data-type (text)
+	context.XPathContext.SetContextPosition(oldpos, oldtotal)
+	context.Current = oldcurr
 }
-func execNumericSortFunction(n1, n2 xml.Node, crit *sortCriteria, context *ExecutionContext) bool {
 
-	s1, _ := context.EvalXPath(n1, crit.sel)
-	s1, _ = context.XPathContext.ResultAsNumber()
-	s2, _ := context.EvalXPath(n2, crit.sel)
-	s2, _ = context.XPathContext.ResultAsNumber()
+// Compare two sort keys, returning -1, 0 or 1.
+func (s *sortCriteria) compare(k1, k2 *sortKey) int {
+	if s.numeric {
+		return compareNumbers(k1.num, k2.num)
+	}
+	return s.compareText(k1, k2)
+}
 
-	if !crit.reverse {
-		if s1.(float64) < s2.(float64) {
-			return true
+// Compare two keys as text. Without a lang attribute the strings
+// are compared by code point.
+func (s *sortCriteria) compareText(k1, k2 *sortKey) (c int) {
+	if !s.upperFirst && !s.lowerFirst {
+		if s.collator != nil {
+			return bytes.Compare(k1.coll, k2.coll)
 		}
+		return strings.Compare(k1.str, k2.str)
+	}
+	// strings that differ only in case are ordered by case-order
+	if s.collator != nil {
+		c = bytes.Compare(k1.coll, k2.coll)
 	} else {
-		if s1.(float64) > s2.(float64) {
-			return true
-		}
+		c = strings.Compare(strings.ToLower(k1.str), strings.ToLower(k2.str))
 	}
-	return false
+	if c != 0 {
+		return
+	}
+	return compareCase(k1.str, k2.str, s.upperFirst)
 }
 
-/*
-package collate_test
-
-import (
-        "fmt"
-        "testing"
-
-        "code.google.com/p/go.text/collate"
-        "code.google.com/p/go.text/language"
-)
+// Order strings that are equal ignoring case by the case of the first
+// letter that differs.
+func compareCase(s1, s2 string, upperFirst bool) int {
+	for s1 != "" && s2 != "" {
+		r1, w1 := utf8.DecodeRuneInString(s1)
+		r2, w2 := utf8.DecodeRuneInString(s2)
+		if r1 != r2 {
+			u1, u2 := unicode.IsUpper(r1), unicode.IsUpper(r2)
+			if u1 != u2 {
+				if u1 == upperFirst {
+					return -1
+				}
+				return 1
+			}
+			if r1 < r2 {
+				return -1
+			}
+			return 1
+		}
+		s1, s2 = s1[w1:], s2[w2:]
+	}
+	return strings.Compare(s1, s2)
+}
 
-func ExampleCollator_Strings() {
-        c := collate.New(language.Und)
-        strings := []string{
-                "ad",
-                "ab",
-                "äb",
-                "ac",
-        }
-        c.SortStrings(strings)
-        fmt.Println(strings)
-        // Output: [ab äb ac ad]
-    }
-
-    type sorter []string
-
-    func (s sorter) Len() int {
-        return len(s)
-    }
-
-    func (s sorter) Swap(i, j int) {
-        s[j], s[i] = s[i], s[j]
-    }
-
-    func (s sorter) Bytes(i int) []byte {
-        return []byte(s[i])
-    }
-
-    func TestSort(t *testing.T) {
-        c := collate.New(language.En)
-        strings := []string{
-            "bcd",
-            "abc",
-            "ddd",
-        }
-        c.Sort(sorter(strings))
-        res := fmt.Sprint(strings)
-        want := "[abc bcd ddd]"
-        if res != want {
-                t.Errorf("found %s; want %s", res, want)
-        }
+// Compare two numbers; NaN sorts before all other numbers.
+func compareNumbers(f1, f2 float64) int {
+	switch {
+	case math.IsNaN(f1) && math.IsNaN(f2):
+		return 0
+	case math.IsNaN(f1) || f1 < f2:
+		return -1
+	case math.IsNaN(f2) || f1 > f2:
+		return 1
+	}
+	return 0
 }
-*/
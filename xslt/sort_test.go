@@ -0,0 +1,80 @@
+package xslt
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Sort keys are evaluated with the unsorted node list as the current node
+// list, and with current() being the node whose key is computed.
+func TestSortKeyContext(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:template match="/doc">
+  <xsl:for-each select="i"><xsl:sort select="last() - position()" data-type="number"/><xsl:value-of select="."/></xsl:for-each>
+  <xsl:text>|</xsl:text>
+  <xsl:for-each select="i"><xsl:sort select="current()/@k"/><xsl:value-of select="."/></xsl:for-each>
+  <xsl:text>|</xsl:text>
+  <xsl:for-each select="i"><xsl:sort select="@k"/><xsl:value-of select="position()"/>/<xsl:value-of select="last()"/>,</xsl:for-each>
+</xsl:template>
+</xsl:stylesheet>`
+	stylesheet, doc := parseTransformTest(t, xsl, `<doc><i k="c">1</i><i k="a">2</i><i k="b">3</i><i k="a">4</i></doc>`)
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Error(err)
+	}
+	if want := "4321|2431|1/4,2/4,3/4,4/4,"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
+// Each sort key is evaluated exactly once for each node.
+func TestSortKeyEvaluatedOnce(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform" xmlns:t="urn:x-test:sort">
+<xsl:output method="text"/>
+<xsl:template match="/doc">
+  <xsl:for-each select="i"><xsl:sort select="t:key(.)" data-type="number"/><xsl:value-of select="."/>,</xsl:for-each>
+</xsl:template>
+</xsl:stylesheet>`
+	var input []string
+	for i := 0; i < 100; i++ {
+		input = append(input, fmt.Sprintf("<i>%d</i>", (i*37)%100))
+	}
+	stylesheet, doc := parseTransformTest(t, xsl, "<doc>"+strings.Join(input, "")+"</doc>")
+	calls := 0
+	stylesheet.RegisterFunction("urn:x-test:sort", "key", func(c *ExecutionContext, args FunctionArgs) (interface{}, error) {
+		calls++
+		return args.Number(0), nil
+	})
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Error(err)
+	}
+	if calls != 100 {
+		t.Errorf("sort key evaluated %d times for 100 nodes", calls)
+	}
+	if !strings.HasPrefix(output, "0,1,2,3,") || !strings.HasSuffix(output, ",98,99,") {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func BenchmarkSort(b *testing.B) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:template match="/doc">
+  <xsl:for-each select="row"><xsl:sort select="@name" lang="de"/><xsl:sort select="@price" data-type="number"/><xsl:value-of select="@name"/></xsl:for-each>
+</xsl:template>
+</xsl:stylesheet>`
+	var input []string
+	for i := 0; i < 10000; i++ {
+		input = append(input, fmt.Sprintf(`<row name="Artikel %d" price="%d"/>`, (i*7919)%1000, i%97))
+	}
+	stylesheet, doc := parseTransformTest(b, xsl, "<doc>"+strings.Join(input, "")+"</doc>")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := stylesheet.Process(doc, StylesheetOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package xslt
+
+import (
+	"github.com/jbowtie/gokogiri/xml"
+	"strings"
+)
+
+// A name test from the elements attribute of xsl:strip-space or
+// xsl:preserve-space.
+type spaceRule struct {
+	strip     bool
+	namespace string
+	name      string // the local name, or * to match any name in the namespace
+	any       bool   // the test is *, which matches every element
+	priority  float64
+}
+
+// Compile the name tests of xsl:strip-space or xsl:preserve-space. Prefixes
+// are resolved using the namespace declarations in scope on the element;
+// as in patterns, unprefixed names are in no namespace.
+func compileSpaceRules(node xml.Node, strip bool) (rules []*spaceRule, err error) {
+	for _, test := range strings.Fields(node.Attr("elements")) {
+		r := &spaceRule{strip: strip, name: test}
+		if test == "*" {
+			r.any = true
+			r.priority = -0.5
+		} else if i := strings.Index(test, ":"); i >= 0 {
+			prefix := test[:i]
+			r.name = test[i+1:]
+			r.namespace = lookupPrefix(node, prefix)
+			if prefix == "xml" {
+				r.namespace = XML_NAMESPACE
+			}
+			if r.namespace == "" {
+				err = newTransformError("XTSE0280", node, nil, nil, "undeclared namespace prefix %s in %s", prefix, test)
+				return
+			}
+			if r.name == "*" {
+				r.priority = -0.25
+			}
+		}
+		rules = append(rules, r)
+	}
+	return
+}
+
+func (r *spaceRule) matches(elem xml.Node) bool {
+	if r.any {
+		return true
+	}
+	if elem.Namespace() != r.namespace {
+		return false
+	}
+	return r.name == "*" || r.name == elem.Name()
+}
+
+// Determine whether whitespace-only text nodes should be stripped from
+// elem. The rules at the highest import precedence that has a matching
+// rule are used; among those, a QName beats prefix:*, which beats *.
+// If two matching rules have the same priority, the last one wins.
+func (style *Stylesheet) stripsSpace(elem xml.Node) (strip, found bool) {
+	var best *spaceRule
+	for _, r := range style.spaceRules {
+		if r.matches(elem) && (best == nil || r.priority >= best.priority) {
+			best = r
+		}
+	}
+	if best != nil {
+		return best.strip, true
+	}
+	for _, s := range style.Imports {
+		if strip, found = s.stripsSpace(elem); found {
+			return
+		}
+	}
+	return
+}
+
+// Returns the value of the xml:space attribute in scope for an element,
+// or the empty string if there is none.
+func xmlSpace(elem xml.Node) string {
+	for n := elem; n != nil && n.NodeType() == xml.XML_ELEMENT_NODE; n = n.Parent() {
+		for _, attr := range n.AttributeList() {
+			if attr.Name() == "space" && attr.Namespace() == XML_NAMESPACE {
+				return attr.Value()
+			}
+		}
+	}
+	return ""
+}
+
+// Whether any strip-space rule applies in the stylesheet or the modules it
+// imports; if not, no whitespace is ever stripped.
+func (style *Stylesheet) stripsAnySpace() bool {
+	for _, r := range style.spaceRules {
+		if r.strip {
+			return true
+		}
+	}
+	for _, s := range style.Imports {
+		if s.stripsAnySpace() {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove every whitespace-only text node that should be stripped from the
+// tree below node, before it is processed (see section 3.4 of the spec).
+//
+// Only documents owned by the transformation are modified; the source
+// document belongs to the caller (and may be shared by concurrent
+// transformations), so a copy of it is stripped instead.
+func (context *ExecutionContext) stripWhitespace(node xml.Node) {
+	for cur := node.FirstChild(); cur != nil; {
+		next := cur.NextSibling()
+		if context.ShouldStrip(cur) {
+			cur.Remove()
+		} else if cur.NodeType() == xml.XML_ELEMENT_NODE {
+			context.stripWhitespace(cur)
+		}
+		cur = next
+	}
+}
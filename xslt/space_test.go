@@ -0,0 +1,100 @@
+package xslt
+
+import (
+	"github.com/jbowtie/gokogiri/xml"
+	"testing"
+)
+
+// Conflicts between strip-space and preserve-space are resolved by import
+// precedence and then by priority, and xml:space="preserve" is inherited.
+func TestStripSpace(t *testing.T) {
+	resolver := mapResolver{
+		"main.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform" xmlns:p="urn:p">
+<xsl:import href="low.xsl"/>
+<xsl:output method="text"/>
+<xsl:preserve-space elements="p:*"/>
+<xsl:strip-space elements="p:gone"/>
+<xsl:template match="/">
+  <xsl:apply-templates/>
+  <xsl:value-of select="count(document('extra.xml')/extra/node())"/>
+</xsl:template>
+<xsl:template match="*"><xsl:value-of select="name()"/>(<xsl:apply-templates/>)</xsl:template>
+<xsl:template match="text()">[<xsl:value-of select="."/>]</xsl:template>
+</xsl:stylesheet>`,
+		"low.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:strip-space elements="*"/>
+<xsl:preserve-space elements="keep"/>
+</xsl:stylesheet>`,
+		"extra.xml": "<extra> <a/> </extra>",
+	}
+	input := `<doc>
+ <a> </a>
+ <keep> </keep>
+ <q:keep xmlns:q="urn:q"> </q:keep>
+ <p:x xmlns:p="urn:p"> </p:x>
+ <p:gone xmlns:p="urn:p"> </p:gone>
+ <b xml:space="preserve"><c> </c></b>
+ <b xml:space="preserve"><c xml:space="default"> </c></b>
+</doc>`
+	style, _ := loadDocument(resolver, "main.xsl")
+	defer style.Free()
+	stylesheet, err := ParseStylesheetWithResolver(style, "main.xsl", resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stylesheet.Close()
+	doc, _ := xml.Parse([]byte(input), nil, nil, xml.StrictParseOption, nil)
+	defer doc.Free()
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Error(err)
+	}
+	want := "doc(a()keep([ ])q:keep()p:x([ ])p:gone()b(c([ ]))b(c()))1"
+	if output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
+func TestStripSpaceUndeclaredPrefix(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:strip-space elements="q:*"/>
+</xsl:stylesheet>`
+	style, _ := xml.Parse([]byte(xsl), nil, nil, xml.StrictParseOption, nil)
+	defer style.Free()
+	_, err := ParseStylesheet(style, "")
+	if terr, ok := err.(*TransformError); !ok || terr.Code != "XTSE0280" {
+		t.Errorf("got %v, want XTSE0280", err)
+	}
+}
+
+// Whitespace is stripped from the source before it is processed, so every
+// way of reaching its nodes sees the same tree, but never from result tree
+// fragments.
+func TestStripSpaceTrees(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="xml" omit-xml-declaration="yes"/>
+<xsl:strip-space elements="*"/>
+<xsl:variable name="rtf"><a><xsl:text> </xsl:text><b/><xsl:text> </xsl:text></a></xsl:variable>
+<xsl:template match="/doc">
+  <xsl:value-of select="count(node())"/>
+  <xsl:for-each select="node()">:<xsl:value-of select="last()"/></xsl:for-each>
+  <xsl:copy-of select="$rtf"/>
+</xsl:template>
+</xsl:stylesheet>`
+	input := `<doc> <x/> <y/> </doc>`
+	stylesheet, doc := parseTransformTest(t, xsl, input)
+	defer stylesheet.Close()
+	defer doc.Free()
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2:2:2<a> <b/> </a>\n"
+	if output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+	// the caller's document is left as it was
+	if n := doc.Root().CountChildren(); n != 5 {
+		t.Errorf("source has %d children after the transformation, want 5", n)
+	}
+}
@@ -1,14 +1,15 @@
 package xslt
 
 import (
-	"container/list"
+	"bytes"
 	"fmt"
 	"github.com/jbowtie/gokogiri/xml"
 	"github.com/jbowtie/gokogiri/xpath"
-	"log"
-	"path"
+	"io"
 	"strconv"
 	"strings"
+	"sync"
+	"unsafe"
 )
 
 const XSLT_NAMESPACE = "http://www.w3.org/1999/XSL/Transform"
@@ -21,39 +22,60 @@ type Stylesheet struct {
 	NamedTemplates     map[string]*Template
 	NamespaceMapping   map[string]string
 	NamespaceAlias     map[string]string
-	ElementMatches     map[string]*list.List //matches on element name
-	AttrMatches        map[string]*list.List //matches on attr name
-	NodeMatches        *list.List            //matches on node()
-	TextMatches        *list.List            //matches on text()
-	PIMatches          *list.List            //matches on processing-instruction()
-	CommentMatches     *list.List            //matches on comment()
-	IdKeyMatches       *list.List            //matches on id() or key()
-	Imports            *list.List
-	Variables          map[string]*Variable
+	Imports            []*Stylesheet        //imported modules, highest import precedence first
+	Variables          map[string]*Variable //global variables and parameters, by expanded name
 	Functions          map[string]xpath.XPathFunction
+	Elements           map[string]ExtensionElement //extension instructions, keyed by {namespace}name
 	AttributeSets      map[string]CompiledStep
+	DecimalFormats     map[string]*DecimalFormat
 	ExcludePrefixes    []string
 	ExtensionPrefixes  []string
 	StripSpace         []string
 	PreserveSpace      []string
 	CDataElements      []string
+	spaceRules         []*spaceRule //strip-space and preserve-space name tests, in document order
 	GlobalParameters   []string
 	includes           map[string]bool
-	Keys               map[string]*Key
-	OutputMethod       string //html, xml, text
-	DesiredEncoding    string //encoding specified by xsl:output
-	OmitXmlDeclaration bool   //defaults to false
-	IndentOutput       bool   //defaults to false
-	Standalone         bool   //defaults to false
+	Keys               map[string][]*Key //xsl:key declarations, by expanded name
+	Resolver           URIResolver       //loads xsl:include, xsl:import and document() resources
+	OutputMethod       string            //html, xml, text
+	DesiredEncoding    string            //encoding specified by xsl:output
+	OmitXmlDeclaration bool              //defaults to false
+	IndentOutput       bool              //defaults to false
+	Standalone         bool              //defaults to false
 	doctypeSystem      string
 	doctypePublic      string
+	uri                string             //the base URI of the principal stylesheet module
+	outputProperties   map[string]string  //explicitly specified xsl:output attributes, including imports
+	templates          []*Template        //every template in the module, so that Close can find them
+	compiled           []CompiledStep     //top-level variables, parameters and attribute sets
+	documents          []*xml.XmlDocument //included and imported modules, owned by the stylesheet
+	index              *dispatchIndex     //template rules by node kind, name and mode; see dispatch
+	indexOnce          sync.Once
+	nsURIs             map[string]unsafe.Pointer //C copies of the namespace URIs registered with XPath contexts
+	nsLock             sync.Mutex
 }
 
+// ConflictMode controls what happens when a node matches more than one
+// template rule with the same import precedence and priority.
+type ConflictMode int
+
+const (
+	ConflictRecover ConflictMode = iota // use the last matching rule in the stylesheet
+	ConflictWarn                        // as ConflictRecover, but pass a warning to the WarningHandler
+	ConflictError                       // stop the transformation with an XTDE0540 error
+)
+
 // StylesheetOptions to control processing. Parameters values are passed into
 // the stylesheet via this structure.
 type StylesheetOptions struct {
-	IndentOutput bool                   //force the output to be indented
-	Parameters   map[string]interface{} //supply values for stylesheet parameters
+	IndentOutput   bool                   //force the output to be indented
+	Parameters     map[string]interface{} //supply values for stylesheet parameters, by name or as {namespace}name
+	ErrorHandler   func(*TransformError)  //receives recoverable errors; if nil, Process returns the first one
+	Resolver       URIResolver            //loads documents for document(); if nil, the stylesheet's resolver is used
+	Conflicts      ConflictMode           //how to handle nodes matched by several template rules
+	WarningHandler func(*TransformError)  //receives warnings; if nil, they are written to standard error
+	StableIds      bool                   //number the IDs from generate-id() in document order, so they are the same on every run
 }
 
 // Returns true if the node is in the XSLT namespace
@@ -81,23 +103,65 @@ func IsBlank(xmlnode xml.Node) bool {
 // The fileuri argument is used to resolve relative paths for xsl:import and xsl:include
 // instructions and should generally be the filename of the stylesheet. If you pass
 // an empty string, the working directory will be used for path resolution.
+//
+// Any error returned is a *TransformError identifying the offending
+// stylesheet module and line.
 func ParseStylesheet(doc *xml.XmlDocument, fileuri string) (style *Stylesheet, err error) {
+	return ParseStylesheetWithResolver(doc, fileuri, nil)
+}
+
+// ParseStylesheetWithResolver is like ParseStylesheet, but loads any
+// xsl:include and xsl:import modules through the supplied resolver rather
+// than reading them from the local file system. Here fileuri may also be an
+// absolute URI, such as a file: URI.
+//
+// The resolver is also used for document() unless one is provided
+// in the StylesheetOptions passed to Process.
+func ParseStylesheetWithResolver(doc *xml.XmlDocument, fileuri string, resolver URIResolver) (style *Stylesheet, err error) {
+	if doc == nil || doc.Root() == nil {
+		err = &TransformError{Code: "XTSE0165", URI: fileuri, Message: "no stylesheet document to compile"}
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoveredError(r)
+		}
+	}()
+	style, err = parseModule(doc, fileuri, resolver)
+	if err == nil {
+		// a global variable may be declared in any module, so references
+		// can only be checked once the whole stylesheet is compiled
+		style.checkVariables()
+	}
+	return
+}
+
+// Compile a stylesheet module and the modules it imports. Static errors
+// are either returned or raised as a panic.
+func parseModule(doc *xml.XmlDocument, fileuri string, resolver URIResolver) (style *Stylesheet, err error) {
+	if doc.Root() == nil {
+		err = &TransformError{Code: "XTSE0165", URI: fileuri, Message: "no stylesheet document to compile"}
+		return
+	}
+	if resolver == nil {
+		resolver = FileResolver{}
+	}
+	if fileuri == "" {
+		fileuri = doc.Uri()
+	}
 	style = &Stylesheet{Doc: doc,
+		Resolver:         resolver,
+		uri:              fileuri,
 		NamespaceMapping: make(map[string]string),
 		NamespaceAlias:   make(map[string]string),
-		ElementMatches:   make(map[string]*list.List),
-		AttrMatches:      make(map[string]*list.List),
-		PIMatches:        list.New(),
-		CommentMatches:   list.New(),
-		IdKeyMatches:     list.New(),
-		NodeMatches:      list.New(),
-		TextMatches:      list.New(),
-		Imports:          list.New(),
 		NamedTemplates:   make(map[string]*Template),
 		AttributeSets:    make(map[string]CompiledStep),
+		DecimalFormats:   make(map[string]*DecimalFormat),
 		includes:         make(map[string]bool),
-		Keys:             make(map[string]*Key),
+		Keys:             make(map[string][]*Key),
+		outputProperties: make(map[string]string),
 		Functions:        make(map[string]xpath.XPathFunction),
+		Elements:         make(map[string]ExtensionElement),
 		Variables:        make(map[string]*Variable)}
 
 	// register the built-in XSLT functions
@@ -111,11 +175,8 @@ func ParseStylesheet(doc *xml.XmlDocument, fileuri string) (style *Stylesheet, e
 		style.NamespaceMapping[ns.Uri] = ns.Prefix
 	}
 
-	//get xsl:version, should be 1.0 or 2.0
-	version := cur.Attr("version")
-	if version != "1.0" {
-		log.Println("VERSION 1.0 expected")
-	}
+	// xsl:version other than 1.0 calls for forwards-compatible processing,
+	// which is not an error, so there is nothing to report
 
 	//record excluded prefixes
 	excl := cur.Attr("exclude-result-prefixes")
@@ -130,7 +191,7 @@ func ParseStylesheet(doc *xml.XmlDocument, fileuri string) (style *Stylesheet, e
 
 	//if the root is an LRE, this is an simplified stylesheet
 	if !IsXsltName(cur, "stylesheet") && !IsXsltName(cur, "transform") {
-		template := &Template{Match: "/", Priority: 0}
+		template := &Template{Match: "/", Priority: 0, Style: style}
 		template.CompileContent(doc)
 		style.compilePattern(template, "")
 		return
@@ -147,6 +208,37 @@ func ParseStylesheet(doc *xml.XmlDocument, fileuri string) (style *Stylesheet, e
 	return
 }
 
+// the xsl:output attributes we record (in the order we apply them)
+var outputAttributes = []string{"method", "version", "encoding", "omit-xml-declaration", "standalone",
+	"doctype-public", "doctype-system", "cdata-section-elements", "indent", "media-type"}
+
+// Record the value of an xsl:output attribute.
+func (style *Stylesheet) setOutputProperty(name, value string) {
+	style.outputProperties[name] = value
+	switch name {
+	case "method":
+		style.OutputMethod = value
+	case "encoding":
+		// UTF-8 is the default, so don't bother declaring it
+		if value != "utf-8" {
+			style.DesiredEncoding = value
+		}
+	case "omit-xml-declaration":
+		style.OmitXmlDeclaration = value == "yes"
+	case "standalone":
+		style.Standalone = value == "yes"
+	case "indent":
+		style.IndentOutput = value == "yes"
+	case "doctype-public":
+		style.doctypePublic = value
+	case "doctype-system":
+		style.doctypeSystem = value
+	case "cdata-section-elements":
+		// the lists are combined rather than replaced
+		style.CDataElements = append(style.CDataElements, strings.Fields(value)...)
+	}
+}
+
 // Here we iterate through the children; this has been moved to its own function
 // to facilitate the implementation of xsl:include (where we want the children to
 // be treated as if they were part of the calling stylesheet)
@@ -175,18 +267,18 @@ func (style *Stylesheet) parseChildren(root xml.Node, fileuri string) (err error
 		}
 
 		if IsXsltName(cur, "key") {
-			name := cur.Attr("name")
-			use := cur.Attr("use")
+			name := expandedName(resolveQName(cur, cur.Attr("name")))
+			use := compileExpression(cur, "use")
 			match := cur.Attr("match")
-			k := &Key{make(map[string]xml.Nodeset), use, match}
-			style.Keys[name] = k
+			k := &Key{node: cur, use: use, match: match, patterns: compileMatch(cur, "match", match, nil)}
+			style.Keys[name] = append(style.Keys[name], k)
 			continue
 		}
 
 		if IsXsltName(cur, "param") {
-			name := cur.Attr("name")
-			// record that it's a global parameter - we'll check supplied options against this list
-			style.GlobalParameters = append(style.GlobalParameters, name)
+			ns, name := resolveQName(cur, cur.Attr("name"))
+			// record that it's a global parameter, which can be supplied in the StylesheetOptions
+			style.GlobalParameters = append(style.GlobalParameters, expandedName(ns, name))
 			style.RegisterGlobalVariable(cur)
 			continue
 		}
@@ -198,28 +290,25 @@ func (style *Stylesheet) parseChildren(root xml.Node, fileuri string) (err error
 
 		if IsXsltName(cur, "include") {
 			//check for recursion, multiple includes
-			loc := cur.Attr("href")
-			base := path.Dir(fileuri)
-			loc = path.Join(base, loc)
+			loc := resolveURI(cur.Attr("href"), fileuri)
 			_, already := style.includes[loc]
 			if already {
-				panic("Multiple include detected of " + loc)
+				err = newTransformError("XTSE0180", cur, nil, nil, "multiple include detected of %s", loc)
+				return
 			}
 			style.includes[loc] = true
 
 			//load the stylesheet
-			doc, e := xml.ReadFile(loc, xml.StrictParseOption)
+			doc, e := loadDocument(style.Resolver, loc)
 			if e != nil {
-				fmt.Println(e)
-				err = e
+				err = newTransformError("XTSE0165", cur, nil, e, "cannot include %s", loc)
 				return
 			}
-			//_, _ = ParseStylesheet(doc, loc)
+			// the compiled templates refer to the included document
+			style.documents = append(style.documents, doc)
 			//update the including stylesheet
-			e = style.parseChildren(doc.Root(), loc)
-			if e != nil {
-				fmt.Println(e)
-				err = e
+			err = style.parseChildren(doc.Root(), loc)
+			if err != nil {
 				return
 			}
 			continue
@@ -227,62 +316,58 @@ func (style *Stylesheet) parseChildren(root xml.Node, fileuri string) (err error
 
 		if IsXsltName(cur, "import") {
 			//check for recursion, multiple includes
-			loc := cur.Attr("href")
-			base := path.Dir(fileuri)
-			loc = path.Join(base, loc)
+			loc := resolveURI(cur.Attr("href"), fileuri)
 			_, already := style.includes[loc]
 			if already {
-				panic("Multiple include detected of " + loc)
+				err = newTransformError("XTSE0180", cur, nil, nil, "multiple include detected of %s", loc)
+				return
 			}
 			style.includes[loc] = true
 			//increment import; new style context
-			doc, _ := xmlReadFile(loc)
-			_import, _ := ParseStylesheet(doc, loc)
-			style.Imports.PushFront(_import)
-			continue
-		}
-
-		if IsXsltName(cur, "output") {
-			cdata := cur.Attr("cdata-section-elements")
-			if cdata != "" {
-				style.CDataElements = strings.Fields(cdata)
-			}
-			style.OutputMethod = cur.Attr("method")
-			omit := cur.Attr("omit-xml-declaration")
-			if omit == "yes" {
-				style.OmitXmlDeclaration = true
-			}
-			indent := cur.Attr("indent")
-			if indent == "yes" {
-				style.IndentOutput = true
+			doc, e := loadDocument(style.Resolver, loc)
+			if e != nil {
+				err = newTransformError("XTSE0165", cur, nil, e, "cannot import %s", loc)
+				return
 			}
-			standalone := cur.Attr("standalone")
-			if standalone == "yes" {
-				style.Standalone = true
+			style.documents = append(style.documents, doc)
+			_import, e := parseModule(doc, loc, style.Resolver)
+			if e != nil {
+				err = e
+				return
 			}
-			encoding := cur.Attr("encoding")
-			if encoding != "" && encoding != "utf-8" {
-				//TODO: emit a warning if we do not support the encoding
-				// if unsupported, leave blank to output default UTF-8
-				style.DesiredEncoding = encoding
+			_import.Parent = style
+			style.Imports = append([]*Stylesheet{_import}, style.Imports...)
+			// xsl:output in this module (which comes after the imports) takes precedence
+			for _, name := range outputAttributes {
+				if value, ok := _import.outputProperties[name]; ok {
+					style.setOutputProperty(name, value)
+				}
 			}
-			style.doctypeSystem = cur.Attr("doctype-system")
-			style.doctypePublic = cur.Attr("doctype-public")
 			continue
 		}
 
-		if IsXsltName(cur, "strip-space") {
-			el := cur.Attr("elements")
-			if el != "" {
-				style.StripSpace = strings.Fields(el)
+		if IsXsltName(cur, "output") {
+			// multiple xsl:output elements are merged, later ones winning
+			for _, name := range outputAttributes {
+				if value := cur.Attr(name); value != "" {
+					style.setOutputProperty(name, value)
+				}
 			}
 			continue
 		}
 
-		if IsXsltName(cur, "preserve-space") {
-			el := cur.Attr("elements")
-			if el != "" {
-				style.PreserveSpace = strings.Fields(el)
+		if IsXsltName(cur, "strip-space") || IsXsltName(cur, "preserve-space") {
+			strip := cur.Name() == "strip-space"
+			rules, e := compileSpaceRules(cur, strip)
+			if e != nil {
+				err = e
+				return
+			}
+			style.spaceRules = append(style.spaceRules, rules...)
+			if strip {
+				style.StripSpace = append(style.StripSpace, strings.Fields(cur.Attr("elements"))...)
+			} else {
+				style.PreserveSpace = append(style.PreserveSpace, strings.Fields(cur.Attr("elements"))...)
 			}
 			continue
 		}
@@ -295,13 +380,81 @@ func (style *Stylesheet) parseChildren(root xml.Node, fileuri string) (err error
 		}
 
 		if IsXsltName(cur, "decimal-format") {
-			fmt.Println("GLOBAL TODO ", cur.Name())
+			f := compileDecimalFormat(cur)
+			// redeclaring a format is only allowed if nothing changes
+			if old, ok := style.DecimalFormats[f.Name]; ok && *old != *f {
+				panic(newTransformError("XTSE1290", cur, nil, nil, "conflicting declarations of decimal format %s", cur.Attr("name")))
+			}
+			style.DecimalFormats[f.Name] = f
 			continue
 		}
 	}
 	return
 }
 
+// Close releases the compiled XPath expressions held by the stylesheet and
+// the stylesheets it imports, along with the documents loaded for
+// xsl:include and xsl:import. The stylesheet must not be used once it has
+// been closed.
+//
+// The document passed to ParseStylesheet belongs to the caller and is not
+// freed by Close.
+func (style *Stylesheet) Close() {
+	for _, t := range style.templates {
+		freeSteps(t.Children)
+		freeMatches(t.matches)
+	}
+	style.templates = nil
+	freeSteps(style.compiled)
+	style.compiled = nil
+	for _, keys := range style.Keys {
+		for _, k := range keys {
+			freeExpression(k.use)
+			freeMatches(k.patterns)
+		}
+	}
+	for _, s := range style.Imports {
+		s.Close()
+	}
+	style.Imports = nil
+	for _, doc := range style.documents {
+		doc.Free()
+	}
+	style.documents = nil
+	style.freeNamespaceURIs()
+}
+
+// Release the compiled expressions held by the steps and their children.
+func freeSteps(steps []CompiledStep) {
+	for _, step := range steps {
+		switch s := step.(type) {
+		case *XsltInstruction:
+			freeExpression(s.expr)
+			for _, a := range s.avts {
+				a.free()
+			}
+			for _, c := range s.sorting {
+				c.free()
+			}
+			if s.number != nil {
+				s.number.free()
+			}
+			freeSteps(s.Children)
+		case *Variable:
+			freeExpression(s.expr)
+			freeSteps(s.Children)
+		case *LiteralResultElement:
+			for _, a := range s.attributes {
+				a.value.free()
+			}
+			freeSteps(s.Children)
+		case *ExtensionInstruction:
+			freeSteps(s.Children)
+			freeSteps(s.fallback)
+		}
+	}
+}
+
 func (style *Stylesheet) IsExcluded(prefix string) bool {
 	for _, p := range style.ExcludePrefixes {
 		if p == prefix {
@@ -320,50 +473,91 @@ func (style *Stylesheet) IsExcluded(prefix string) bool {
 // by executing the stylesheet.
 
 // The output is not guaranteed to be well-formed XML, so the
-// serialized string is returned. Consideration is being given
-// to returning a slice of bytes and encoding information.
+// serialized string is returned. It holds the bytes of the output
+// in the encoding requested by xsl:output (UTF-8 by default); use
+// ProcessTo to write them directly to a file or network connection.
+//
+// A compiled Stylesheet is not modified by Process, so it may be
+// used to transform several documents concurrently.
+//
+// Any error is a *TransformError. A fatal error (such as xsl:message
+// with terminate="yes") stops processing and no output is returned.
+// Recoverable errors are passed to options.ErrorHandler if it is set;
+// otherwise the output is returned along with the first of them.
 func (style *Stylesheet) Process(doc *xml.XmlDocument, options StylesheetOptions) (out string, err error) {
+	var buf bytes.Buffer
+	err = style.ProcessTo(doc, &buf, options)
+	out = buf.String()
+	return
+}
+
+// ProcessTo executes the stylesheet against the input document and writes
+// the serialized output to w, encoded as requested by xsl:output. Characters
+// that cannot be represented in that encoding are written as character
+// references.
+//
+// Errors are reported as for Process; nothing is written if a fatal error
+// occurs during the transformation itself.
+func (style *Stylesheet) ProcessTo(doc *xml.XmlDocument, w io.Writer, options StylesheetOptions) (err error) {
 	// lookup output method, doctypes, encoding
 	// create output document with appropriate values
 	output := xml.CreateEmptyDocument(doc.InputEncoding(), doc.OutputEncoding())
+	// the result tree (and any result tree fragments) only live until
+	// the output has been written
+	defer output.Free()
 	// init context node/document
 	context := &ExecutionContext{Output: output.Me, OutputNode: output, Style: style, Source: doc}
+	defer context.freeInputDocuments()
 	context.Current = doc
-	context.XPathContext = doc.DocXPathCtx()
-	// when evaluating keys/global vars position is always 1
+	context.sourceNode = doc
+	context.parameters = options.Parameters
+	context.errorHandler = options.ErrorHandler
+	context.resolver = options.Resolver
+	context.conflicts = options.Conflicts
+	context.stableIds = options.StableIds
+	context.warningHandler = options.WarningHandler
+	if context.resolver == nil {
+		context.resolver = style.Resolver
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoveredError(r)
+		}
+	}()
+	// whitespace is stripped from a copy of the source, which belongs to the
+	// caller, before it is processed
+	if style.stripsAnySpace() {
+		if stripped := copyDocument(doc); stripped != nil {
+			defer stripped.Free()
+			context.stripWhitespace(stripped)
+			doc = stripped
+			context.Source = doc
+			context.Current = doc
+			context.sourceNode = doc
+		}
+	}
+	// every transformation gets its own XPath context so that concurrent
+	// transformations (even of the same document) never share evaluation state
+	context.XPathContext = xpath.NewXPath(doc.DocPtr())
+	defer freeXPath(context.XPathContext)
 	context.XPathContext.SetContextPosition(1, 1)
-	start := doc
-	style.populateKeys(start, context)
-	// eval global params
-	// eval global variables
-	for _, val := range style.Variables {
-		val.Apply(doc, context)
-	}
-
-	// for each global parameter
-	for _, param := range style.GlobalParameters {
-		// was a parameter passed with this name?
-		gp_value, gp_ok := options.Parameters[param]
-		if gp_ok {
-			gp_var := style.Variables[param]
-			// replace value of style.Variables[key]
-			gp_var.Value = gp_value
-			// fmt.Println("Existing", param, "set to", gp_value)
-		}
-	}
+	// global variables and parameters are evaluated when first referenced
+	// (see ExecutionContext.VariableValue)
 
 	// process nodes
-	style.processNode(start, context, nil)
+	style.processNode(doc, context, nil)
 
-	out, err = style.constructOutput(output, options)
-	// reset anything required for re-use
+	err = style.constructOutput(output, w, options, context)
+	if err == nil && context.err != nil {
+		err = context.err
+	}
 	return
 }
 
-func (style *Stylesheet) constructXmlDeclaration() (out string) {
+func (style *Stylesheet) constructXmlDeclaration(encoding string) (out string) {
 	out = "<?xml version=\"1.0\""
-	if style.DesiredEncoding != "" {
-		out = out + fmt.Sprintf(" encoding=\"%s\"", style.DesiredEncoding)
+	if encoding != "" {
+		out = out + fmt.Sprintf(" encoding=\"%s\"", encoding)
 	}
 	if style.Standalone {
 		out = out + " standalone=\"yes\""
@@ -372,8 +566,8 @@ func (style *Stylesheet) constructXmlDeclaration() (out string) {
 	return
 }
 
-// actually produce (and possibly write) the final output
-func (style *Stylesheet) constructOutput(output *xml.XmlDocument, options StylesheetOptions) (out string, err error) {
+// actually produce (and write) the final output
+func (style *Stylesheet) constructOutput(output *xml.XmlDocument, w io.Writer, options StylesheetOptions, context *ExecutionContext) (err error) {
 	//if not explicitly set, spec requires us to check for html
 	outputType := style.OutputMethod
 	if outputType == "" {
@@ -384,60 +578,70 @@ func (style *Stylesheet) constructOutput(output *xml.XmlDocument, options Styles
 		}
 	}
 
+	// the spec allows us to fall back to UTF-8 for encodings we cannot produce
+	encoding := style.DesiredEncoding
+	if encoding != "" && !encodingSupported(encoding) {
+		context.reportError(&TransformError{Code: "SESU0007", Message: "unsupported output encoding " + encoding + ", using UTF-8"})
+		encoding = ""
+	}
+	out := newOutputWriter(w, encoding)
+	if encoding == "" {
+		// serialize as the document would by default
+		out.encoding = string(bytes.TrimRight(output.OutputEncoding(), "\x00"))
+	}
+
 	// construct DTD declaration depending on xsl:output settings
 	docType := ""
-	if style.doctypeSystem != "" {
+	// (html output may declare only a public identifier)
+	root := output.Root()
+	if root != nil && (style.doctypeSystem != "" || (outputType == "html" && style.doctypePublic != "")) {
 		docType = "<!DOCTYPE "
-		docType = docType + output.Root().Name()
+		docType = docType + root.Name()
 		if style.doctypePublic != "" {
 			docType = docType + fmt.Sprintf(" PUBLIC \"%s\"", style.doctypePublic)
 		} else {
 			docType = docType + " SYSTEM"
 		}
-		docType = docType + fmt.Sprintf(" \"%s\"", style.doctypeSystem)
+		if style.doctypeSystem != "" {
+			docType = docType + fmt.Sprintf(" \"%s\"", style.doctypeSystem)
+		}
 		docType = docType + ">\n"
 	}
 
 	// create the XML declaration depending on xsl:output settings
-	decl := ""
 	if outputType == "xml" {
+		// written along with the first serialized node, so that an empty
+		// result produces no output at all
 		if !style.OmitXmlDeclaration {
-			decl = style.constructXmlDeclaration()
+			out.prolog = style.constructXmlDeclaration(encoding)
 		}
+		out.prolog = out.prolog + docType
 		format := xml.XML_SAVE_NO_DECL | xml.XML_SAVE_AS_XML
 		if options.IndentOutput || style.IndentOutput {
 			format = format | xml.XML_SAVE_FORMAT
 		}
 		// we get slightly incorrect output if we call out.SerializeWithFormat directly
 		// this seems to be a libxml bug; we work around it the same way libxslt does
-
-		//TODO: honor desired encoding
-		//  this involves decisions about supported encodings, strings vs byte slices
-		//  we can sidestep a little if we enable option to write directly to file
 		for cur := output.FirstChild(); cur != nil; cur = cur.NextSibling() {
-			b, size := cur.SerializeWithFormat(format, nil, nil)
-			if b != nil {
-				out = out + string(b[:size])
-			}
+			out.writeNode(cur, format)
 		}
-		if out != "" {
-			out = decl + docType + out + "\n"
+		if out.started {
+			out.writeString("\n")
 		}
 	}
 	if outputType == "html" {
-		out = docType
-		b, size := output.ToHtml(nil, nil)
-		out = out + string(b[:size])
+		out.writeString(docType)
+		out.writeNode(output, xml.XML_SAVE_AS_HTML|xml.XML_SAVE_FORMAT)
 	}
 	if outputType == "text" {
 		format := xml.XML_SAVE_NO_DECL
 		for cur := output.FirstChild(); cur != nil; cur = cur.NextSibling() {
-			b, size := cur.SerializeWithFormat(format, nil, nil)
-			if b != nil {
-				out = out + string(b[:size])
-			}
+			out.writeNode(cur, format)
 		}
 	}
+	if out.err != nil {
+		err = &TransformError{Message: "cannot write output", Err: out.err}
+	}
 	return
 }
 
@@ -445,106 +649,42 @@ func (style *Stylesheet) constructOutput(output *xml.XmlDocument, options Styles
 
 // If there is no matching template, nil is returned.
 func (style *Stylesheet) LookupTemplate(node xml.Node, mode string, context *ExecutionContext) (template *Template) {
-	name := node.Name()
-	if node.NodeType() == xml.XML_DOCUMENT_NODE {
-		name = "/"
-	}
-	found := new(list.List)
-	l := style.ElementMatches[name]
-	if l != nil {
-		for i := l.Front(); i != nil; i = i.Next() {
-			c := i.Value.(*CompiledMatch)
-			if c.EvalMatch(node, mode, context) {
-				insertByPriority(found, c)
-				break
-			}
-		}
-	}
-	l = style.ElementMatches["*"]
-	if l != nil {
-		for i := l.Front(); i != nil; i = i.Next() {
-			c := i.Value.(*CompiledMatch)
-			if c.EvalMatch(node, mode, context) {
-				insertByPriority(found, c)
-				break
-			}
-		}
-	}
-	l = style.AttrMatches[name]
-	if l != nil {
-		for i := l.Front(); i != nil; i = i.Next() {
-			c := i.Value.(*CompiledMatch)
-			if c.EvalMatch(node, mode, context) {
-				insertByPriority(found, c)
-				break
-			}
-		}
-	}
-	l = style.AttrMatches["*"]
-	if l != nil {
-		for i := l.Front(); i != nil; i = i.Next() {
-			c := i.Value.(*CompiledMatch)
-			if c.EvalMatch(node, mode, context) {
-				insertByPriority(found, c)
-				break
-			}
-		}
-	}
-	//TODO: review order in which we consult generic matches
-	for i := style.IdKeyMatches.Front(); i != nil; i = i.Next() {
-		c := i.Value.(*CompiledMatch)
-		if c.EvalMatch(node, mode, context) {
-			insertByPriority(found, c)
-			break
-		}
-	}
-	for i := style.NodeMatches.Front(); i != nil; i = i.Next() {
-		c := i.Value.(*CompiledMatch)
-		if c.EvalMatch(node, mode, context) {
-			insertByPriority(found, c)
+	ix := style.dispatch()
+	return ix.lookup(node, mode, context, 0, ix.next)
+}
+
+// Report the template rules other than the first that match the node with
+// the same import precedence and priority; in XSLT 1.0 this is an error that
+// processors may recover from by choosing the last such rule.
+func (context *ExecutionContext) checkConflicts(rules []dispatchRule, node xml.Node, mode string) {
+	best := rules[0]
+	templates := []*Template{best.match.Template}
+	for _, r := range rules[1:] {
+		if r.precedence != best.precedence || r.match.priority != best.match.priority {
 			break
 		}
-	}
-	for i := style.TextMatches.Front(); i != nil; i = i.Next() {
-		c := i.Value.(*CompiledMatch)
-		if c.EvalMatch(node, mode, context) {
-			insertByPriority(found, c)
-			break
+		duplicate := false
+		for _, t := range templates {
+			duplicate = duplicate || t == r.match.Template
 		}
-	}
-	for i := style.PIMatches.Front(); i != nil; i = i.Next() {
-		c := i.Value.(*CompiledMatch)
-		if c.EvalMatch(node, mode, context) {
-			insertByPriority(found, c)
-			break
+		if !duplicate && r.match.EvalMatch(node, mode, context) {
+			templates = append(templates, r.match.Template)
 		}
 	}
-	for i := style.CommentMatches.Front(); i != nil; i = i.Next() {
-		c := i.Value.(*CompiledMatch)
-		if c.EvalMatch(node, mode, context) {
-			insertByPriority(found, c)
-			break
-		}
-	}
-
-	// if there's a match at this import precedence, return
-	// the one with the highest priority
-	f := found.Front()
-	if f != nil {
-		template = f.Value.(*CompiledMatch).Template
+	if len(templates) == 1 {
 		return
 	}
-
-	// no match at this import precedence,
-	//consult the imported stylesheets
-	for i := style.Imports.Front(); i != nil; i = i.Next() {
-		s := i.Value.(*Stylesheet)
-		t := s.LookupTemplate(node, mode, context)
-		if t != nil {
-			return t
+	var desc []string
+	for _, t := range templates {
+		if t.Node != nil {
+			desc = append(desc, fmt.Sprintf("match=%q on line %d", t.Match, t.Node.LineNumber()))
 		}
 	}
-	return
+	err := newTransformError("XTDE0540", best.match.Template.Node, node, nil, "ambiguous rule match: %s", strings.Join(desc, ", "))
+	if context.conflicts == ConflictError {
+		panic(err)
+	}
+	context.warn(err)
 }
 
 func (style *Stylesheet) RegisterAttributeSet(node xml.Node) {
@@ -552,28 +692,34 @@ func (style *Stylesheet) RegisterAttributeSet(node xml.Node) {
 	res := CompileSingleNode(node)
 	res.Compile(node)
 	style.AttributeSets[name] = res
+	style.compiled = append(style.compiled, res)
 }
 
+// RegisterGlobalVariable compiles a top-level xsl:variable or xsl:param.
+// Two global variables with the same name in a module (including the
+// modules it includes) are a static error.
 func (style *Stylesheet) RegisterGlobalVariable(node xml.Node) {
-	name := node.Attr("name")
 	_var := CompileSingleNode(node).(*Variable)
 	_var.Compile(node)
+	name := expandedName(_var.namespace, _var.local)
+	if _, ok := style.Variables[name]; ok {
+		panic(newTransformError("XTSE0630", node, nil, nil, "duplicate global variable %s", _var.Name))
+	}
 	style.Variables[name] = _var
+	style.compiled = append(style.compiled, _var)
 }
 
+// Apply the built-in template rule for a node (see section 5.8 of the
+// XSLT 1.0 spec). The children of the root and of elements are processed in
+// the current mode; text and attribute nodes are copied to the output as
+// text; comments, processing instructions and namespace nodes produce
+// nothing.
 func (style *Stylesheet) processDefaultRule(node xml.Node, context *ExecutionContext) {
-	//default for DOCUMENT, ELEMENT
-	children := context.ChildrenOf(node)
-	total := len(children)
-	for i, cur := range children {
-		context.XPathContext.SetContextPosition(i+1, total)
-		style.processNode(cur, context, nil)
-	}
-	//default for CDATA, TEXT, ATTR is copy as text
-	if node.NodeType() == xml.XML_TEXT_NODE {
-		if context.ShouldStrip(node) {
-			return
-		}
+	switch node.NodeType() {
+	case xml.XML_DOCUMENT_NODE, xml.XML_HTML_DOCUMENT_NODE, xml.XML_DOCUMENT_FRAG_NODE,
+		xml.XML_ELEMENT_NODE, xml.XML_ENTITY_REF_NODE:
+		style.processNodes(context.ChildrenOf(node), context, nil)
+	case xml.XML_TEXT_NODE, xml.XML_CDATA_SECTION_NODE, xml.XML_ATTRIBUTE_NODE:
 		if context.UseCDataSection(context.OutputNode) {
 			r := context.Output.CreateCDataNode(node.Content())
 			context.OutputNode.AddChild(r)
@@ -582,10 +728,24 @@ func (style *Stylesheet) processDefaultRule(node xml.Node, context *ExecutionCon
 			context.OutputNode.AddChild(r)
 		}
 	}
-	//default for namespace declaration is copy to output document
 }
 
-func (style *Stylesheet) processNode(node xml.Node, context *ExecutionContext, params []*Variable) {
+// Process each of the nodes in turn, with the nodes as the current node
+// list.
+func (style *Stylesheet) processNodes(nodes []xml.Node, context *ExecutionContext, params []binding) {
+	total := len(nodes)
+	oldpos, oldtotal := context.XPathContext.GetContextPosition()
+	oldcurr := context.Current
+	for i, cur := range nodes {
+		context.XPathContext.SetContextPosition(i+1, total)
+		//processNode will update Context.Current whenever a template is invoked
+		style.processNode(cur, context, params)
+	}
+	context.XPathContext.SetContextPosition(oldpos, oldtotal)
+	context.Current = oldcurr
+}
+
+func (style *Stylesheet) processNode(node xml.Node, context *ExecutionContext, params []binding) {
 	//get template
 	template := style.LookupTemplate(node, context.Mode, context)
 	//  for each import scope
@@ -599,42 +759,50 @@ func (style *Stylesheet) processNode(node xml.Node, context *ExecutionContext, p
 		return
 	}
 	//apply template to current node
+	style.applyTemplateRule(template, node, context, params)
+}
+
+// Instantiate a template rule, recording it as the current template rule
+// so that xsl:apply-imports knows where to continue the search.
+func (style *Stylesheet) applyTemplateRule(template *Template, node xml.Node, context *ExecutionContext, params []binding) {
+	oldTemplate := context.CurrentTemplate
+	context.CurrentTemplate = template
 	template.Apply(node, context, params)
+	context.CurrentTemplate = oldTemplate
 }
 
-func (style *Stylesheet) populateKeys(node xml.Node, context *ExecutionContext) {
-	for _, key := range style.Keys {
-		//see if the current node matches
-		matches := CompileMatch(key.match, nil)
-		hasMatch := false
-		for _, m := range matches {
-			if m.EvalMatch(node, "", context) {
-				hasMatch = true
-				break
-			}
-		}
-		if !hasMatch {
-			continue
-		}
-		lookupkey, _ := node.EvalXPath(key.use, context)
-		lookup := ""
-		switch lk := lookupkey.(type) {
-		case []xml.Node:
-			if len(lk) == 0 {
-				continue
-			}
-			lookup = lk[0].String()
-		case string:
-			lookup = lk
-		default:
-			lookup = fmt.Sprintf("%v", lk)
+// Process the current node using only the template rules imported into the
+// stylesheet module that contains the current template rule. If no imported
+// rule matches, the built-in rule is applied.
+//
+// The caller is responsible for checking that there is a current template rule.
+func (style *Stylesheet) applyImports(node xml.Node, context *ExecutionContext) {
+	ix := style.dispatch()
+	modules := ix.modules[context.CurrentTemplate.Style]
+	if t := ix.lookup(node, context.Mode, context, modules.imports, modules.precedence); t != nil {
+		style.applyTemplateRule(t, node, context, nil)
+		return
+	}
+	style.processDefaultRule(node, context)
+}
+
+// The document of this stylesheet module, or of a module it includes or
+// imports, with the given pointer; nil if there is none.
+func (style *Stylesheet) moduleDocument(ptr unsafe.Pointer) *xml.XmlDocument {
+	if style.Doc.DocPtr() == ptr {
+		return style.Doc
+	}
+	for _, doc := range style.documents {
+		if doc.DocPtr() == ptr {
+			return doc
 		}
-		key.nodes[lookup] = append(key.nodes[lookup], node)
 	}
-	children := context.ChildrenOf(node)
-	for _, cur := range children {
-		style.populateKeys(cur, context)
+	for _, s := range style.Imports {
+		if doc := s.moduleDocument(ptr); doc != nil {
+			return doc
+		}
 	}
+	return nil
 }
 
 // ParseTemplate parses and compiles the xsl:template elements.
@@ -651,7 +819,7 @@ func (style *Stylesheet) ParseTemplate(node xml.Node) {
 	}
 
 	// TODO: validate the name (duplicate should raise error)
-	template := &Template{Match: match, Mode: mode, Name: name, Priority: p, Node: node}
+	template := &Template{Match: match, Mode: mode, Name: name, Priority: p, Node: node, Style: style}
 
 	template.CompileContent(node)
 
@@ -660,6 +828,8 @@ func (style *Stylesheet) ParseTemplate(node xml.Node) {
 }
 
 func (style *Stylesheet) compilePattern(template *Template, priority string) {
+	template.position = len(style.templates)
+	style.templates = append(style.templates, template)
 	if template.Name != "" {
 		style.NamedTemplates[template.Name] = template
 	}
@@ -668,60 +838,15 @@ func (style *Stylesheet) compilePattern(template *Template, priority string) {
 		return
 	}
 
-	matches := CompileMatch(template.Match, template)
-	for _, c := range matches {
+	template.matches = compileMatch(template.Node, "match", template.Match, template)
+	for _, c := range template.matches {
 		//  calculate priority if not explicitly set
+		//  (each alternative of a union has its own default priority)
 		if priority == "" {
 			template.Priority = c.DefaultPriority()
-			//fmt.Println("COMPILED", template.Match, c.Steps[0].Value, c.Steps[0].Op, template.Priority)
-		}
-		// insert into 'best' collection
-		if c.IsElement() {
-			hash := c.Hash()
-			l := style.ElementMatches[hash]
-			if l == nil {
-				l = list.New()
-				style.ElementMatches[hash] = l
-			}
-			insertByPriority(l, c)
-		}
-		if c.IsAttr() {
-			hash := c.Hash()
-			l := style.AttrMatches[hash]
-			if l == nil {
-				l = list.New()
-				style.AttrMatches[hash] = l
-			}
-			insertByPriority(l, c)
-		}
-		if c.IsIdKey() {
-			insertByPriority(style.IdKeyMatches, c)
-		}
-		if c.IsText() {
-			insertByPriority(style.TextMatches, c)
-		}
-		if c.IsComment() {
-			insertByPriority(style.CommentMatches, c)
-		}
-		if c.IsPI() {
-			insertByPriority(style.PIMatches, c)
-		}
-		if c.IsNode() {
-			insertByPriority(style.NodeMatches, c)
-		}
-	}
-}
-
-func insertByPriority(l *list.List, match *CompiledMatch) {
-	for i := l.Front(); i != nil; i = i.Next() {
-		cur := i.Value.(*CompiledMatch)
-		if cur.Template.Priority <= match.Template.Priority {
-			l.InsertBefore(match, i)
-			return
 		}
+		c.priority = template.Priority
 	}
-	//either list is empty, or we're lowest priority template
-	l.PushBack(match)
 }
 
 // Locate an attribute set by name
@@ -730,8 +855,7 @@ func (style *Stylesheet) LookupAttributeSet(name string) CompiledStep {
 	if ok {
 		return attset
 	}
-	for i := style.Imports.Front(); i != nil; i = i.Next() {
-		s := i.Value.(*Stylesheet)
+	for _, s := range style.Imports {
 		t := s.LookupAttributeSet(name)
 		if t != nil {
 			return t
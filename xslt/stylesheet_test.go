@@ -1,12 +1,17 @@
 package xslt
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/jbowtie/gokogiri/xml"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
+	"sync"
 	"testing"
+	"unicode/utf16"
 )
 
 // Simple naive test; primarily exists as a canary in case test helpers break
@@ -38,10 +43,28 @@ func runXslTestWithOptions(t *testing.T, xslFile, inputXmlFile, outputXmlFile st
 }
 
 func runXslTest(t *testing.T, xslFile, inputXmlFile, outputXmlFile string) bool {
-	testOptions := StylesheetOptions{false, nil}
+	testOptions := StylesheetOptions{}
 	return runXslTestWithOptions(t, xslFile, inputXmlFile, outputXmlFile, testOptions)
 }
 
+// Parse an inline stylesheet and input document, failing the test if
+// either is malformed.
+func parseTransformTest(t testing.TB, xsl, input string) (*Stylesheet, *xml.XmlDocument) {
+	style, err := xml.Parse([]byte(xsl), nil, nil, xml.StrictParseOption, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stylesheet, err := ParseStylesheet(style, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := xml.Parse([]byte(input), nil, nil, xml.StrictParseOption, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stylesheet, doc
+}
+
 // check whether a file exists
 func exists(path string) (bool, error) {
 	_, err := os.Stat(path)
@@ -105,7 +128,7 @@ func TestXsltRECexample2(t *testing.T) {
 
 // Test the handling of global parameters
 func TestXsltParameters(t *testing.T) {
-	testOptions := StylesheetOptions{false, map[string]interface{}{
+	testOptions := StylesheetOptions{Parameters: map[string]interface{}{
 		"numberVal": 1.0,
 		"stringVal": "abcdef",
 	}}
@@ -113,6 +136,296 @@ func TestXsltParameters(t *testing.T) {
 	runXslTestWithOptions(t, "testdata/parameters/basic.xsl", inputXml, "testdata/parameters/basic.xml", testOptions)
 }
 
+// Test xsl:apply-imports across several levels of xsl:import
+func TestXsltApplyImports(t *testing.T) {
+	inputXml := "testdata/imports/data.xml"
+	runXslTest(t, "testdata/imports/apply-imports.xsl", inputXml, "testdata/imports/apply-imports.xml")
+}
+
+// Test xsl:sort with lang, case-order, attribute value templates and ties
+func TestXsltSort(t *testing.T) {
+	runXslTest(t, "testdata/sort/sort.xsl", "testdata/sort/products.xml", "testdata/sort/sort.out")
+}
+
+// Test the built-in template rules for each kind of node, and that the
+// mode is preserved by the built-in rules and restored after apply-templates
+func TestXsltBuiltinRules(t *testing.T) {
+	runXslTest(t, "testdata/builtin/builtin.xsl", "testdata/builtin/doc.xml", "testdata/builtin/builtin.out")
+}
+
+// Template rules are chosen by priority, then by position in the stylesheet;
+// ambiguous matches can be reported as warnings or errors
+func TestXsltConflictResolution(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:template match="doc|x"><xsl:apply-templates select="*"/></xsl:template>
+<xsl:template match="a|x/b">[first <xsl:value-of select="name()"/>]</xsl:template>
+<xsl:template match="b">[b]</xsl:template>
+<xsl:template match="a">[last a]</xsl:template>
+<xsl:template match="*" priority="-1">[any]</xsl:template>
+<xsl:template match="node()">[node]</xsl:template>
+</xsl:stylesheet>`
+	stylesheet, doc := parseTransformTest(t, xsl, "<doc><a/><x><b/></x><b/><c/></doc>")
+	want := "[last a][first b][b][node]"
+
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil || output != want {
+		t.Errorf("got %q, %v; want %q", output, err, want)
+	}
+
+	var warnings []*TransformError
+	options := StylesheetOptions{Conflicts: ConflictWarn, WarningHandler: func(e *TransformError) { warnings = append(warnings, e) }}
+	output, err = stylesheet.Process(doc, options)
+	if err != nil || output != want {
+		t.Errorf("got %q, %v; want %q", output, err, want)
+	}
+	if len(warnings) != 1 || warnings[0].Code != "XTDE0540" || warnings[0].Line != 6 || !strings.Contains(warnings[0].Message, "line 4") {
+		t.Errorf("unexpected warnings %v", warnings)
+	}
+
+	_, err = stylesheet.Process(doc, StylesheetOptions{Conflicts: ConflictError})
+	if terr, ok := err.(*TransformError); !ok || terr.Code != "XTDE0540" {
+		t.Errorf("got %v, want XTDE0540", err)
+	}
+}
+
+// Reuse a single compiled stylesheet from many goroutines at once.
+// Run with -race to check that no per-transformation state is shared.
+func TestXsltConcurrentProcess(t *testing.T) {
+	xslFile := "testdata/concurrency/keys.xsl"
+	style, _ := xml.ReadFile(xslFile, xml.StrictParseOption)
+	stylesheet, _ := ParseStylesheet(style, xslFile)
+	expected := map[string]string{
+		"fruit":     "<result category=\"fruit\" total=\"5\"><item>apple-1</item><item>pear-2</item><item>plum-3</item></result>",
+		"vegetable": "<result category=\"vegetable\" total=\"5\"><item>carrot-1</item><item>leek-2</item></result>",
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		category := "fruit"
+		if i%2 == 1 {
+			category = "vegetable"
+		}
+		wg.Add(1)
+		go func(category string) {
+			defer wg.Done()
+			input, _ := xml.ReadFile("testdata/concurrency/data.xml", xml.StrictParseOption)
+			defer input.Free()
+			options := StylesheetOptions{Parameters: map[string]interface{}{"category": category}}
+			for j := 0; j < 10; j++ {
+				output, _ := stylesheet.Process(input, options)
+				if !strings.Contains(output, expected[category]) {
+					t.Errorf("%s: got %q", category, output)
+					return
+				}
+			}
+		}(category)
+	}
+	wg.Wait()
+}
+
+// Errors while compiling report the offending module and line
+func TestXsltParseErrors(t *testing.T) {
+	cases := []struct {
+		xslFile string
+		code    string
+		line    int
+	}{
+		{"testdata/errors/missing-include.xsl", "XTSE0165", 4},
+		{"testdata/errors/double-include.xsl", "XTSE0180", 5},
+		{"testdata/errors/syntax.xsl", "XPST0003", 7},
+		{"testdata/errors/avt.xsl", "XTSE0350", 5},
+	}
+	for _, c := range cases {
+		style, _ := xml.ReadFile(c.xslFile, xml.StrictParseOption)
+		_, err := ParseStylesheet(style, c.xslFile)
+		terr, ok := err.(*TransformError)
+		if !ok {
+			t.Errorf("%s: expected *TransformError, got %v", c.xslFile, err)
+			continue
+		}
+		if terr.Code != c.code || terr.Line != c.line || !strings.HasSuffix(terr.URI, c.xslFile) {
+			t.Errorf("%s: unexpected error %v", c.xslFile, terr)
+		}
+	}
+}
+
+// xsl:message terminate="yes" stops processing and is returned as an error
+func TestXsltMessageTerminate(t *testing.T) {
+	xslFile := "testdata/errors/terminate.xsl"
+	style, _ := xml.ReadFile(xslFile, xml.StrictParseOption)
+	input, _ := xml.ReadFile("testdata/errors/data.xml", xml.StrictParseOption)
+	stylesheet, _ := ParseStylesheet(style, xslFile)
+	output, err := stylesheet.Process(input, StylesheetOptions{})
+	terr, ok := err.(*TransformError)
+	if !ok {
+		t.Fatalf("expected *TransformError, got %v", err)
+	}
+	if output != "" {
+		t.Error("no output expected after termination, got", output)
+	}
+	if terr.Code != "XTMM9000" || terr.Message != "stopped at stop" || terr.Line != 9 || terr.NodePath != "/items/item[2]" {
+		t.Error("unexpected error", terr)
+	}
+}
+
+// xsl:message without terminate="yes" is passed to the warning handler and
+// does not appear in the output
+func TestXsltMessage(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:template match="item">
+  <xsl:message>at <xsl:value-of select="@name"/></xsl:message>
+  <xsl:value-of select="@name"/>
+</xsl:template>
+</xsl:stylesheet>`
+	stylesheet, doc := parseTransformTest(t, xsl, `<items><item name="a"/><item name="b"/></items>`)
+	defer stylesheet.Close()
+	defer doc.Free()
+	var messages []string
+	handler := func(e *TransformError) { messages = append(messages, e.Message) }
+	output, err := stylesheet.Process(doc, StylesheetOptions{WarningHandler: handler})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "ab" {
+		t.Errorf("got %q, want %q", output, "ab")
+	}
+	if strings.Join(messages, ",") != "at a,at b" {
+		t.Error("unexpected messages", messages)
+	}
+}
+
+// Recoverable errors are passed to the handler, or the first one is returned
+func TestXsltRecoverableErrors(t *testing.T) {
+	xslFile := "testdata/errors/recoverable.xsl"
+	style, _ := xml.ReadFile(xslFile, xml.StrictParseOption)
+	input, _ := xml.ReadFile("testdata/errors/data.xml", xml.StrictParseOption)
+	stylesheet, _ := ParseStylesheet(style, xslFile)
+
+	output, err := stylesheet.Process(input, StylesheetOptions{})
+	if terr, ok := err.(*TransformError); !ok || terr.Code != "XTDE0560" || terr.Line != 6 {
+		t.Error("unexpected error", err)
+	}
+	if !strings.Contains(output, "<result") {
+		t.Error("output expected despite recoverable errors, got", output)
+	}
+
+	var codes []string
+	handler := func(e *TransformError) { codes = append(codes, e.Code) }
+	_, err = stylesheet.Process(input, StylesheetOptions{ErrorHandler: handler})
+	if err != nil {
+		t.Error("errors should have gone to the handler, got", err)
+	}
+	if strings.Join(codes, " ") != "XTDE0560 XTDE0560 XTDE1280" {
+		t.Error("unexpected errors reported", codes)
+	}
+}
+
+// Output is written in the encoding requested by xsl:output, using
+// character references for anything that encoding cannot represent
+func TestXsltProcessToEncoding(t *testing.T) {
+	utf16le := func(s string) string {
+		out := []byte{0xff, 0xfe}
+		for _, c := range utf16.Encode([]rune(s)) {
+			out = append(out, byte(c), byte(c>>8))
+		}
+		return string(out)
+	}
+	cases := []struct {
+		xslFile string
+		want    string
+	}{
+		{"testdata/encoding/iso-8859-1.xsl", "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n<out>caf\xe9 &#8364; &#26085;&#26412;</out>\n"},
+		{"testdata/encoding/shift-jis.xsl", "<?xml version=\"1.0\" encoding=\"Shift_JIS\"?>\n<out>caf&#233; &#8364; \x93\xfa\x96{</out>\n"},
+		{"testdata/encoding/utf-16.xsl", utf16le("<?xml version=\"1.0\" encoding=\"UTF-16\"?>\n<out>café € 日本</out>\n")},
+	}
+	input, _ := xml.ReadFile("testdata/encoding/data.xml", xml.StrictParseOption)
+	for _, c := range cases {
+		style, _ := xml.ReadFile(c.xslFile, xml.StrictParseOption)
+		stylesheet, _ := ParseStylesheet(style, c.xslFile)
+		var buf bytes.Buffer
+		err := stylesheet.ProcessTo(input, &buf, StylesheetOptions{})
+		if err != nil {
+			t.Error(c.xslFile, err)
+		}
+		if buf.String() != c.want {
+			t.Errorf("%s: got %q, want %q", c.xslFile, buf.String(), c.want)
+		}
+	}
+}
+
+// records the size of each write, failing once it has been given limit bytes
+type chunkWriter struct {
+	sizes []int
+	total int
+	limit int
+}
+
+func (w *chunkWriter) Write(b []byte) (int, error) {
+	if w.limit > 0 && w.total+len(b) > w.limit {
+		return 0, errors.New("disk full")
+	}
+	w.sizes = append(w.sizes, len(b))
+	w.total += len(b)
+	return len(b), nil
+}
+
+// ProcessTo passes the output to the writer in chunks as it is serialized,
+// rather than serializing each top-level node into memory first, and stops
+// when the writer fails
+func TestXsltProcessToStreams(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:template match="/">
+  <out>
+    <xsl:for-each select="//item"><xsl:for-each select="//item"><i><xsl:value-of select="."/></i></xsl:for-each></xsl:for-each>
+  </out>
+</xsl:template>
+</xsl:stylesheet>`
+	input := "<doc>" + strings.Repeat("<item>some text in an item</item>", 200) + "</doc>"
+	stylesheet, doc := parseTransformTest(t, xsl, input)
+	defer stylesheet.Close()
+	defer doc.Free()
+	w := &chunkWriter{}
+	if err := stylesheet.ProcessTo(doc, w, StylesheetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	largest := 0
+	for _, size := range w.sizes {
+		if size > largest {
+			largest = size
+		}
+	}
+	if w.total < 1000000 || largest > 64*1024 {
+		t.Errorf("wrote %d bytes in %d writes, the largest %d bytes", w.total, len(w.sizes), largest)
+	}
+
+	failing := &chunkWriter{limit: 100000}
+	err := stylesheet.ProcessTo(doc, failing, StylesheetOptions{})
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Error("expected the write error, got", err)
+	}
+	if failing.total > failing.limit {
+		t.Errorf("kept writing after the writer failed: %d bytes", failing.total)
+	}
+}
+
+// An encoding we cannot produce falls back to UTF-8 with a recoverable error
+func TestXsltUnsupportedEncoding(t *testing.T) {
+	xslFile := "testdata/encoding/x-unknown.xsl"
+	style, _ := xml.ReadFile(xslFile, xml.StrictParseOption)
+	input, _ := xml.ReadFile("testdata/encoding/data.xml", xml.StrictParseOption)
+	stylesheet, _ := ParseStylesheet(style, xslFile)
+	output, err := stylesheet.Process(input, StylesheetOptions{})
+	if terr, ok := err.(*TransformError); !ok || terr.Code != "SESU0007" {
+		t.Error("unexpected error", err)
+	}
+	want := "<?xml version=\"1.0\"?>\n<out>café € 日本</out>\n"
+	if output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
 var genRun = 0
 
 //convenience function to fix up the paths before running a test
@@ -130,189 +443,197 @@ func runGeneralXslTest(t *testing.T, xslFile string) bool {
 	return runXslTest(t, xslf, ii, oo)
 }
 
+// The general suite of libxslt regression tests; the commented out tests
+// don't pass yet.
+var generalTests = []string{
+	//"items", //doesn't match pattern - how do we run test?
+
+	"array", // document('')
+	"character",
+	//"date_add", // EXSL date functions
+	"bug-1-",
+	"bug-2-",
+	"bug-3-",
+	"bug-4-",
+	//"bug-5-", // rounding issues outputting numbers; UTF-8 casing?
+	"bug-6-",
+	"bug-7-",
+	"bug-8-", //issue resolving namespaces in imported stylesheet
+	"bug-9-",
+	"bug-10-",
+	"bug-11-",
+	"bug-12-",
+	"bug-13-",
+	"bug-14-",
+	"bug-15-",
+	"bug-16-",
+	"bug-17-",
+	"bug-18-",
+	"bug-19-",
+	"bug-20-",
+	"bug-21-", // unparsed-entity-uri()
+	"bug-22-",
+	"bug-23-",
+	"bug-24-",
+	"bug-25-", // encoding attr when UTF-8 explicitly specified in doc
+	"bug-26-",
+	"bug-27-",
+	"bug-28-",
+	"bug-29-", // document('href'); need to resolve to new source document
+	"bug-30-",
+	"bug-31-",
+	"bug-32-",
+	"bug-33-",
+	"bug-35-",
+	"bug-36-", //xsl:include
+	"bug-37-", //xsl:include
+	//"bug-38-", // handle copy-of() for namespace nodes
+	"bug-39-",
+	"bug-40-", //variable scope is global when call-template is invoked
+	"bug-41-", //also avoid overwriting global variable using with-param
+	"bug-42-", //as 40 but for apply-templates
+	"bug-43-", //as 41 but for apply-templates
+	"bug-44-", // with-param
+	"bug-45-", // ensure params/variables resolve in correct order
+	"bug-46-",
+	"bug-47-",
+	"bug-48-",
+	"bug-49-", // global variable defined in terms of inner variable
+	"bug-50-",
+	"bug-52", //unparsed-entity-uri with nodeset argument
+	"bug-53", // depends on DTD processing of ATTLIST with default attribute
+	//"bug-54", //fails intermittently due to ordering of namespaces
+	"bug-55",
+	//"bug-56", // unsure what's going on here
+	"bug-57",
+	"bug-59",
+	"bug-60", // fallback for unknown XSL element
+	"bug-61", // format-number outputs NaN correctly
+	"bug-62",
+	//"bug-63", //resolve namespace nodes and relative paths
+	"bug-64",
+	//"bug-65", // libxslt:node-set
+	"bug-66", //current()
+	"bug-68",
+	"bug-69", // stylesheet and input in iso-8859-1
+	"bug-70", // key() - nodeset as arg 2
+	//"bug-71", //only fails due to order of NS declarations; need to review spec on that
+	"bug-72", //variables declared in RVT
+	"bug-73",
+	"bug-74",
+	"bug-75", //format-number()
+	"bug-76", //issue with count? or variable resolution?
+	"bug-77", //handle spaces around OR
+	"bug-78",
+	"bug-79",
+	"bug-80", //fails due to ordering of attributes; review, possibly edit test
+	"bug-81", //rounding error in XPath calculation; might be caused by CGO conversion
+	"bug-82",
+	"bug-83",
+	"bug-84",
+	"bug-86", //getting some unnecessary duplication of namespaces declarations using copy-of
+	//"bug-87", //matching on namespace node
+	"bug-88",
+	"bug-89", //fails with stricter parser
+	"bug-90", // CDATA handling
+	"bug-91", // disable-output-escaping attribute
+	//"bug-92", //libxml2 doesn't output the xs namespace here; why not?
+	"bug-93", // presence of xsl:output in imported stylesheets should cause effective merge
+	"bug-94", //variable/param confusion
+	"bug-95",  //format-number, ISO-8859-1 output
+	"bug-96", //cdata-section-elements
+	"bug-97",
+	"bug-98",
+	//"bug-99", // expects multiple namespace declarations
+	//"bug-100", // libxslt:test extension element
+	"bug-101", // xsl:element with default namespace
+	//"bug-102", // imported xsl:attribute-set
+	"bug-103", //copy-of needs to explicitly set empty namespace when needed
+	//"bug-104", //copy-of should preserve attr prefix if plausible
+	"bug-105",
+	"bug-106", //copy-of
+	"bug-107",
+	"bug-108",
+	"bug-109", // disable-output-escaping
+	"bug-110", //generate-id()
+	"bug-111", //exsl:node-set()
+	"bug-112", //exsl:node-set()
+	"bug-113", // stylesheet and parser in ISO-8859-1
+	"bug-114",
+	"bug-115", //exsl:node-set()
+	"bug-116",
+	"bug-117", //exsl declaration should not be in output
+	"bug-118", //copy-of
+	"bug-119",
+	//"bug-120", //xsl:sort with data-type; interaction with copy-of?
+	"bug-121",
+	//"bug-122", //namespace nodes
+	"bug-123",
+	//"bug-124", //namespace declared with multiple prefixes; really a bug?
+	//"bug-125", //unclear; needs further investigation
+	//"bug-126", //tests for bugs in AVT parsing
+	"bug-127",
+	//"bug-128", // copy-of omits the namespaces in scope on the copied elements
+	"bug-129", //cdata-section-elements
+	//"bug-130", //document('href') and import; different default namespace in imported stylesheet
+	//"bug-131", // attribute-set combine import defs
+	"bug-132",
+	"bug-133", // xsl:key match with a predicate on node()
+	"bug-134", // xsl:key match "node()[self::sect]" should be same as match "sect"
+	"bug-135", // same as 134
+	"bug-136",
+	//"bug-137", // EXSLT func
+	"bug-138",
+	//"bug-139", //extra output of entity definitions (why?)
+	"bug-140", // failed due to standalone
+	"bug-141",
+	//"bug-142", //lang() function doing strange things?
+	"bug-143", // global variable defined in terms of another
+	"bug-144",
+	"bug-145", //should result in no output (calling template that doesn't exist)
+	//"bug-146", // funny looking key definition plus encoding issue
+	//"bug-147", //looks like import precedence related
+	"bug-148",
+	"bug-149",
+	//"bug-150", //scoping of namespace definitions on literal result elements
+	"bug-151", // outputs just the declaration; should be nothing
+	//"bug-152", //libxml2 inserts a content-type meta tag; unsure why
+	"bug-153", //document('href') and current()
+	"bug-154", //should have no output
+	"bug-155",
+	"bug-156",
+	"bug-157",
+	"bug-158",
+	"bug-159", //escape entities appropriately if encoding=ascii
+	"bug-160", // predicate before an ancestor step
+	"bug-161",
+	"bug-163",
+	"bug-164",
+	//"bug-165", //undeclared variable in predicate; a static error here, libxslt reports it at run time
+	//"bug-166", //need to look closer; slow and much output!
+	"bug-167",
+	//"bug-168", //looks like AVT torture test
+	//"bug-169", // non-ASCII attribute content is written as character references
+	"bug-170",
+	"bug-171",
+	"bug-172", //seems to be bug in xsl:choose (matches when test but no output)
+	//"bug-173", //extra newline on output?
+	//"bug-174", //exslt:func
+	"bug-175", //wrong output encoding/doctype for html output
+	"bug-176",
+	"bug-177", //should not create namespace declaration for built-in xml namespace
+	//"bug-178", //exslt:func
+	//"bug-179", // xsl:element/@namespace don't need to explicitly create namespace already in scope
+	//"bug-180", //undeclared variable; a static error here, libxslt reports it at run time
+	"bug-181",
+	"bug-182", //text()[2] should match something
+}
+
 // Runs the general suite of libxslt regression tests
 func TestXsltGeneral(t *testing.T) {
-	//runGeneralXslTest(t, "items") //doesn't match pattern - how do we run test?
-
-	runGeneralXslTest(t, "array") // document('')
-	runGeneralXslTest(t, "character")
-	//runGeneralXslTest(t, "date_add") // EXSL date functions
-	runGeneralXslTest(t, "bug-1-")
-	runGeneralXslTest(t, "bug-2-")
-	runGeneralXslTest(t, "bug-3-")
-	runGeneralXslTest(t, "bug-4-")
-	//runGeneralXslTest(t, "bug-5-") // rounding issues outputting numbers; UTF-8 casing?
-	runGeneralXslTest(t, "bug-6-")
-	runGeneralXslTest(t, "bug-7-")
-	runGeneralXslTest(t, "bug-8-") //issue resolving namespaces in imported stylesheet
-	runGeneralXslTest(t, "bug-9-")
-	runGeneralXslTest(t, "bug-10-")
-	runGeneralXslTest(t, "bug-11-")
-	runGeneralXslTest(t, "bug-12-")
-	runGeneralXslTest(t, "bug-13-")
-	runGeneralXslTest(t, "bug-14-")
-	runGeneralXslTest(t, "bug-15-")
-	runGeneralXslTest(t, "bug-16-")
-	runGeneralXslTest(t, "bug-17-")
-	runGeneralXslTest(t, "bug-18-")
-	runGeneralXslTest(t, "bug-19-")
-	runGeneralXslTest(t, "bug-20-")
-	runGeneralXslTest(t, "bug-21-") // unparsed-entity-uri()
-	runGeneralXslTest(t, "bug-22-")
-	runGeneralXslTest(t, "bug-23-")
-	runGeneralXslTest(t, "bug-24-")
-	runGeneralXslTest(t, "bug-25-") // encoding attr when UTF-8 explicitly specified in doc
-	runGeneralXslTest(t, "bug-26-")
-	runGeneralXslTest(t, "bug-27-")
-	runGeneralXslTest(t, "bug-28-")
-	runGeneralXslTest(t, "bug-29-") // document('href'); need to resolve to new source document
-	runGeneralXslTest(t, "bug-30-")
-	runGeneralXslTest(t, "bug-31-")
-	runGeneralXslTest(t, "bug-32-")
-	runGeneralXslTest(t, "bug-33-")
-	runGeneralXslTest(t, "bug-35-")
-	runGeneralXslTest(t, "bug-36-") //xsl:include
-	runGeneralXslTest(t, "bug-37-") //xsl:include
-	//runGeneralXslTest(t, "bug-38-") // handle copy-of() for namespace nodes
-	runGeneralXslTest(t, "bug-39-")
-	runGeneralXslTest(t, "bug-40-") //variable scope is global when call-template is invoked
-	runGeneralXslTest(t, "bug-41-") //also avoid overwriting global variable using with-param
-	runGeneralXslTest(t, "bug-42-") //as 40 but for apply-templates
-	runGeneralXslTest(t, "bug-43-") //as 41 but for apply-templates
-	runGeneralXslTest(t, "bug-44-") // with-param
-	runGeneralXslTest(t, "bug-45-") // ensure params/variables resolve in correct order
-	runGeneralXslTest(t, "bug-46-")
-	runGeneralXslTest(t, "bug-47-")
-	runGeneralXslTest(t, "bug-48-")
-	runGeneralXslTest(t, "bug-49-") // global variable defined in terms of inner variable
-	runGeneralXslTest(t, "bug-50-")
-	runGeneralXslTest(t, "bug-52") //unparsed-entity-uri with nodeset argument
-	runGeneralXslTest(t, "bug-53") // depends on DTD processing of ATTLIST with default attribute
-	//runGeneralXslTest(t, "bug-54") //fails intermittently due to ordering of namespaces
-	runGeneralXslTest(t, "bug-55")
-	//runGeneralXslTest(t, "bug-56") // unsure what's going on here
-	runGeneralXslTest(t, "bug-57")
-	runGeneralXslTest(t, "bug-59")
-	runGeneralXslTest(t, "bug-60") // fallback for unknown XSL element
-	//runGeneralXslTest(t, "bug-61") // format-number outputs NaN correctly
-	runGeneralXslTest(t, "bug-62")
-	//runGeneralXslTest(t, "bug-63") //resolve namespace nodes and relative paths
-	runGeneralXslTest(t, "bug-64")
-	//runGeneralXslTest(t, "bug-65") // libxslt:node-set
-	runGeneralXslTest(t, "bug-66") //current()
-	runGeneralXslTest(t, "bug-68")
-	runGeneralXslTest(t, "bug-69") // stylesheet and input in iso-8859-1
-	runGeneralXslTest(t, "bug-70") // key() - nodeset as arg 2
-	//runGeneralXslTest(t, "bug-71") //only fails due to order of NS declarations; need to review spec on that
-	runGeneralXslTest(t, "bug-72") //variables declared in RVT
-	runGeneralXslTest(t, "bug-73")
-	runGeneralXslTest(t, "bug-74")
-	//runGeneralXslTest(t, "bug-75") //format-number()
-	runGeneralXslTest(t, "bug-76") //issue with count? or variable resolution?
-	runGeneralXslTest(t, "bug-77") //handle spaces around OR
-	runGeneralXslTest(t, "bug-78")
-	runGeneralXslTest(t, "bug-79")
-	runGeneralXslTest(t, "bug-80") //fails due to ordering of attributes; review, possibly edit test
-	runGeneralXslTest(t, "bug-81") //rounding error in XPath calculation; might be caused by CGO conversion
-	//runGeneralXslTest(t, "bug-82") //whitespace interactions; possibly not honoring global preserve-space
-	runGeneralXslTest(t, "bug-83")
-	runGeneralXslTest(t, "bug-84")
-	runGeneralXslTest(t, "bug-86") //getting some unnecessary duplication of namespaces declarations using copy-of
-	//runGeneralXslTest(t, "bug-87") //matching on namespace node
-	runGeneralXslTest(t, "bug-88")
-	runGeneralXslTest(t, "bug-89") //fails with stricter parser
-	runGeneralXslTest(t, "bug-90") // CDATA handling
-	runGeneralXslTest(t, "bug-91") // disable-output-escaping attribute
-	//runGeneralXslTest(t, "bug-92") //libxml2 doesn't output the xs namespace here; why not?
-	//runGeneralXslTest(t, "bug-93") // presence of xsl:output in imported stylesheets should cause effective merge
-	runGeneralXslTest(t, "bug-94") //variable/param confusion
-	//runGeneralXslTest(t, "bug-95") //format-number
-	runGeneralXslTest(t, "bug-96") //cdata-section-elements
-	runGeneralXslTest(t, "bug-97")
-	runGeneralXslTest(t, "bug-98")
-	//runGeneralXslTest(t, "bug-99") // expects multiple namespace declarations
-	//runGeneralXslTest(t, "bug-100") // libxslt:test extension element
-	runGeneralXslTest(t, "bug-101") // xsl:element with default namespace
-	//runGeneralXslTest(t, "bug-102") // imported xsl:attribute-set
-	runGeneralXslTest(t, "bug-103") //copy-of needs to explicitly set empty namespace when needed
-	//runGeneralXslTest(t, "bug-104") //copy-of should preserve attr prefix if plausible
-	runGeneralXslTest(t, "bug-105")
-	runGeneralXslTest(t, "bug-106") //copy-of
-	runGeneralXslTest(t, "bug-107")
-	runGeneralXslTest(t, "bug-108")
-	runGeneralXslTest(t, "bug-109") // disable-output-escaping
-	runGeneralXslTest(t, "bug-110") //generate-id()
-	runGeneralXslTest(t, "bug-111") //exsl:node-set()
-	runGeneralXslTest(t, "bug-112") //exsl:node-set()
-	runGeneralXslTest(t, "bug-113") // stylesheet and parser in ISO-8859-1
-	runGeneralXslTest(t, "bug-114")
-	runGeneralXslTest(t, "bug-115") //exsl:node-set()
-	runGeneralXslTest(t, "bug-116")
-	runGeneralXslTest(t, "bug-117") //exsl declaration should not be in output
-	runGeneralXslTest(t, "bug-118") //copy-of
-	runGeneralXslTest(t, "bug-119")
-	//runGeneralXslTest(t, "bug-120") //xsl:sort with data-type; interaction with copy-of?
-	runGeneralXslTest(t, "bug-121")
-	//runGeneralXslTest(t, "bug-122") //namespace nodes
-	runGeneralXslTest(t, "bug-123")
-	//runGeneralXslTest(t, "bug-124") //namespace declared with multiple prefixes; really a bug?
-	//runGeneralXslTest(t, "bug-125") //unclear; needs further investigation
-	//runGeneralXslTest(t, "bug-126") //tests for bugs in AVT parsing
-	runGeneralXslTest(t, "bug-127")
-	//runGeneralXslTest(t, "bug-128") //multiple keys with the same name; need to look at spec
-	runGeneralXslTest(t, "bug-129") //cdata-section-elements
-	//runGeneralXslTest(t, "bug-130") //document('href') and import; different default namespace in imported stylesheet
-	//runGeneralXslTest(t, "bug-131") // attribute-set combine import defs
-	runGeneralXslTest(t, "bug-132")
-	//runGeneralXslTest(t, "bug-133") // interaction between key, generate-id?
-	//runGeneralXslTest(t, "bug-134") // xsl:key match "node()[self::sect]" should be same as match "sect" but is not; context issue??
-	//runGeneralXslTest(t, "bug-135") // same as 134
-	runGeneralXslTest(t, "bug-136")
-	//runGeneralXslTest(t, "bug-137") // EXSLT func
-	runGeneralXslTest(t, "bug-138")
-	//runGeneralXslTest(t, "bug-139") //extra output of entity definitions (why?)
-	runGeneralXslTest(t, "bug-140") // failed due to standalone
-	runGeneralXslTest(t, "bug-141")
-	//runGeneralXslTest(t, "bug-142") //lang() function doing strange things?
-	//runGeneralXslTest(t, "bug-143") //exposes a timing bug in global variable definitions
-	runGeneralXslTest(t, "bug-144")
-	runGeneralXslTest(t, "bug-145") //should result in no output (calling template that doesn't exist)
-	//runGeneralXslTest(t, "bug-146") // funny looking key definition plus encoding issue
-	//runGeneralXslTest(t, "bug-147") //looks like import precedence related
-	runGeneralXslTest(t, "bug-148")
-	runGeneralXslTest(t, "bug-149")
-	//runGeneralXslTest(t, "bug-150") //scoping of namespace definitions on literal result elements
-	runGeneralXslTest(t, "bug-151") // outputs just the declaration; should be nothing
-	//runGeneralXslTest(t, "bug-152") //libxml2 inserts a content-type meta tag; unsure why
-	runGeneralXslTest(t, "bug-153") //document('href') and current()
-	runGeneralXslTest(t, "bug-154") //should have no output
-	runGeneralXslTest(t, "bug-155")
-	runGeneralXslTest(t, "bug-156")
-	runGeneralXslTest(t, "bug-157")
-	runGeneralXslTest(t, "bug-158")
-	//runGeneralXslTest(t, "bug-159") //escape entities appropriately if encoding=ascii
-	//runGeneralXslTest(t, "bug-160") // match criteria seems to be the issue here
-	runGeneralXslTest(t, "bug-161")
-	runGeneralXslTest(t, "bug-163")
-	runGeneralXslTest(t, "bug-164")
-	//runGeneralXslTest(t, "bug-165") //xpath with unresolvable variable in predicate; differs in number of blank lines produced
-	//runGeneralXslTest(t, "bug-166") //need to look closer; slow and much output!
-	runGeneralXslTest(t, "bug-167")
-	//runGeneralXslTest(t, "bug-168") //looks like AVT torture test
-	//runGeneralXslTest(t, "bug-169") // not selecting correct output encoding?
-	runGeneralXslTest(t, "bug-170")
-	runGeneralXslTest(t, "bug-171")
-	runGeneralXslTest(t, "bug-172") //seems to be bug in xsl:choose (matches when test but no output)
-	//runGeneralXslTest(t, "bug-173") //extra newline on output?
-	//runGeneralXslTest(t, "bug-174") //exslt:func
-	//runGeneralXslTest(t, "bug-175") //wrong output encoding/doctype for html output
-	runGeneralXslTest(t, "bug-176")
-	runGeneralXslTest(t, "bug-177") //should not create namespace declaration for built-in xml namespace
-	//runGeneralXslTest(t, "bug-178") //exslt:func
-	//runGeneralXslTest(t, "bug-179") // xsl:element/@namespace don't need to explicitly create namespace already in scope
-	//runGeneralXslTest(t, "bug-180") //expects no output
-	//runGeneralXslTest(t, "bug-181") //this appears to be template priority bug
-	//runGeneralXslTest(t, "bug-182") //text()[2] should match something
+	for _, name := range generalTests {
+		runGeneralXslTest(t, name)
+	}
 	fmt.Println("passed", genRun, "tests")
 }
 
@@ -321,9 +642,10 @@ func ExampleParseStylesheet() {
 	//parse the stylesheet
 	style, _ := xml.ReadFile("testdata/test.xsl", xml.StrictParseOption)
 	stylesheet, _ := ParseStylesheet(style, "testdata/test.xsl")
+	defer stylesheet.Close()
 
 	//process the input
 	input, _ := xml.ReadFile("testdata/test.xml", xml.StrictParseOption)
-	output, _ := stylesheet.Process(input, StylesheetOptions{false, nil})
+	output, _ := stylesheet.Process(input, StylesheetOptions{})
 	fmt.Println(output)
 }
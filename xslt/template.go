@@ -1,12 +1,9 @@
 package xslt
 
 import (
-	"container/list"
-	"fmt"
 	"github.com/jbowtie/gokogiri/xml"
 	"github.com/jbowtie/gokogiri/xpath"
 	"strings"
-	"unicode/utf8"
 )
 
 type CompiledStep interface {
@@ -21,14 +18,27 @@ type Template struct {
 	Priority float64
 	Children []CompiledStep
 	Node     xml.Node
+	Style    *Stylesheet      // the stylesheet module (after includes) that declared the template
+	position int              // document order within the module, for conflict resolution
+	matches  []*CompiledMatch // the compiled alternatives of Match
 }
 
 // Literal result elements are any elements in a template
 // that are not in the xsl namespace.
 // They are copied to the output document.
 type LiteralResultElement struct {
-	Node     xml.Node
-	Children []CompiledStep
+	Node          xml.Node
+	Children      []CompiledStep
+	attributes    []*literalAttribute
+	attributeSets string // the value of xsl:use-attribute-sets
+}
+
+// An attribute of a literal result element, whose value is an
+// attribute value template.
+type literalAttribute struct {
+	namespace string
+	name      string
+	value     *avt
 }
 
 // Stylesheet text nodes
@@ -36,19 +46,29 @@ type TextOutput struct {
 	Content string
 }
 
-// Used to represent an xsl:variable or xsl:param
+// Used to represent an xsl:variable, xsl:param or xsl:with-param.
+//
+// The value of a variable is held by the ExecutionContext rather than by
+// the compiled node, so a Stylesheet can be shared by concurrent
+// transformations and a template can call itself.
 type Variable struct {
-	Name     string
-	Node     xml.Node
-	Children []CompiledStep
-	Value    interface{}
+	Name      string // the name as written in the stylesheet
+	Node      xml.Node
+	Children  []CompiledStep
+	expr      *xpath.Expression // the select expression, if any
+	namespace string            // the expanded name
+	local     string
+	param     bool // the variable is an xsl:param
 }
 
 // Compile the variable.
 //
-// TODO: compile the XPath expression and determine if it is a constant
+// TODO: determine if the expression is a constant
 func (i *Variable) Compile(node xml.Node) {
 	i.Name = i.Node.Attr("name")
+	i.namespace, i.local = resolveQName(node, i.Name)
+	i.param = IsXsltName(node, "param")
+	i.expr = compileExpression(node, "select")
 	for cur := node.FirstChild(); cur != nil; cur = cur.NextSibling() {
 		res := CompileSingleNode(cur)
 		if res != nil {
@@ -58,51 +78,54 @@ func (i *Variable) Compile(node xml.Node) {
 	}
 }
 
-// Applying a variable node is calculating its value.
+// Applying a variable node binds its value to its name for the following
+// siblings and their descendants.
 func (i *Variable) Apply(node xml.Node, context *ExecutionContext) {
-	scope := i.Node.Attr("select")
+	context.bind(i.namespace, i.local, i.value(node, context))
+}
+
+// Calculate the value of the variable.
+func (i *Variable) value(node xml.Node, context *ExecutionContext) interface{} {
 	// if @select
-	if scope != "" {
-		e := xpath.Compile(scope)
-		var err error
+	if i.expr != nil {
 		context.RegisterXPathNamespaces(i.Node)
-		i.Value, err = context.EvalXPath(node, e)
+		val, err := context.EvalXPath(node, i.expr)
 		if err != nil {
-			fmt.Println("Error evaluating variable", i.Name, err)
+			context.reportError(newTransformError("", i.Node, node, err, "cannot evaluate variable %s", i.Name))
 		}
-		//fmt.Println("VARIABLE SELECT", i.Name, i.Value)
-		return
+		return val
 	}
 
 	if len(i.Children) == 0 {
-		//fmt.Println("VARIABLE NIL", name, i.Value)
-		i.Value = nil
-		return
+		return nil
 	}
 
 	// if multiple children, return nodeset
 	curOutput := context.OutputNode
-	context.OutputNode = context.Output.CreateElementNode("RVT")
-	context.PushStack()
-	for _, c := range i.Children {
-		c.Apply(node, context)
-		switch v := c.(type) {
-		case *Variable:
-			_ = context.DeclareLocalVariable(v.Name, "", v)
-		}
-	}
-	context.PopStack()
-	i.Value = nil
+	context.OutputNode = context.createRVT()
+	applySequence(i.Children, node, context)
 	var outNodes xml.Nodeset
 	for cur := context.OutputNode.FirstChild(); cur != nil; cur = cur.NextSibling() {
 		outNodes = append(outNodes, cur)
 	}
-	i.Value = outNodes
 	context.OutputNode = curOutput
-	//fmt.Println("VARIABLE NODES", name, i.Value)
+	return outNodes
 }
 
 func (e *LiteralResultElement) Compile(node xml.Node) {
+	for _, attr := range node.AttributeList() {
+		if attr.Namespace() == XSLT_NAMESPACE {
+			if attr.Name() == "use-attribute-sets" {
+				e.attributeSets = attr.Content()
+			}
+			continue
+		}
+		e.attributes = append(e.attributes, &literalAttribute{
+			namespace: attr.Namespace(),
+			name:      attr.Name(),
+			value:     compileAVT(node, attr.Name(), attr.Content()),
+		})
+	}
 	for cur := node.FirstChild(); cur != nil; cur = cur.NextSibling() {
 		res := CompileSingleNode(cur)
 		if res != nil {
@@ -126,31 +149,7 @@ func ResolveAlias(style *Stylesheet, alias, auri string) (prefix, uri string) {
 	return "", ""
 }
 
-func (e *LiteralResultElement) IsExtension(node xml.Node, context *ExecutionContext) bool {
-	ns := e.Node.Namespace()
-	prefix, _ := context.Style.NamespaceMapping[ns]
-	if prefix != "" {
-		for _, ex := range context.Style.ExtensionPrefixes {
-			if ex == prefix {
-				return true
-			}
-		}
-	}
-	return false
-}
-
 func (e *LiteralResultElement) Apply(node xml.Node, context *ExecutionContext) {
-	//TODO: recognize extension elements at compile time
-	if e.IsExtension(node, context) {
-		for _, c := range e.Children {
-			inst := c.(*XsltInstruction)
-			if inst != nil && inst.Name == "fallback" {
-				c.Apply(node, context)
-			}
-		}
-		return
-	}
-
 	r := context.Output.CreateElementNode(e.Node.Name())
 	context.OutputNode.AddChild(r)
 	context.DeclareStylesheetNamespacesIfRoot(r)
@@ -162,31 +161,20 @@ func (e *LiteralResultElement) Apply(node xml.Node, context *ExecutionContext) {
 		r.SetNamespace(prefix, ns)
 	}
 
-	attsets := ""
-	for _, attr := range e.Node.AttributeList() {
-		//fmt.Println(attr.Namespace(), attr.Name(), attr.Content())
-		txt := attr.Content()
-		if strings.ContainsRune(txt, '{') {
-			txt = evalAVT(txt, node, context)
-		}
-		if attr.Namespace() != "" {
-			if attr.Namespace() == XSLT_NAMESPACE {
-				if attr.Name() == "use-attribute-sets" {
-					attsets = txt
-				}
-			} else {
-				r.SetNsAttr(attr.Namespace(), attr.Name(), txt)
-			}
+	for _, attr := range e.attributes {
+		txt := attr.value.eval(node, context)
+		if attr.namespace != "" {
+			r.SetNsAttr(attr.namespace, attr.name, txt)
 		} else {
-			r.SetAttr(attr.Name(), txt)
+			r.SetAttr(attr.name, txt)
 		}
 	}
 
 	old := context.OutputNode
 	context.OutputNode = r
 
-	if attsets != "" {
-		asets := strings.Fields(attsets)
+	if e.attributeSets != "" {
+		asets := strings.Fields(e.attributeSets)
 		for _, attsetname := range asets {
 			a := context.Style.LookupAttributeSet(attsetname)
 			if a != nil {
@@ -194,78 +182,10 @@ func (e *LiteralResultElement) Apply(node xml.Node, context *ExecutionContext) {
 			}
 		}
 	}
-	for _, c := range e.Children {
-		c.Apply(node, context)
-		switch v := c.(type) {
-		case *Variable:
-			_ = context.DeclareLocalVariable(v.Name, "", v)
-		}
-	}
+	applySequence(e.Children, node, context)
 	context.OutputNode = old
 }
 
-// Evaluate an attribute value template
-func evalAVT(input string, node xml.Node, context *ExecutionContext) (out string) {
-	var start, pos int
-	var inSQlit, inDQlit bool
-	for pos < len(input) {
-		r, width := utf8.DecodeRuneInString(input[pos:])
-		pos += width
-		if r == '\'' {
-			inSQlit = !inSQlit
-		}
-		if r == '"' {
-			inDQlit = !inDQlit
-		}
-		if r == '{' {
-			// if we're not the last character
-			if pos < len(input) {
-				// check for doubled opening brace
-				peek, w := utf8.DecodeRuneInString(input[pos:])
-				if peek == '{' {
-					out = out + input[start:pos]
-					pos += w
-					start = pos
-					continue
-				}
-			}
-			out = out + input[start:pos-width]
-			start = pos
-		}
-		if r == '}' {
-			if inSQlit || inDQlit {
-				continue
-			}
-			// if we're not the last character
-			if pos < len(input) {
-				// check for doubled closing brace
-				peek, w := utf8.DecodeRuneInString(input[pos:])
-				if peek == '}' {
-					out = out + input[start:pos]
-					pos += w
-					start = pos
-					continue
-				}
-			}
-			expr := input[start : pos-width]
-			ret, _ := context.EvalXPath(node, expr)
-			switch val := ret.(type) {
-			case []xml.Node:
-				for _, n := range val {
-					out = out + n.Content()
-				}
-			case float64:
-				out = out + fmt.Sprintf("%v", val)
-			case string:
-				out = out + val
-			}
-			start = pos
-		}
-	}
-	out = out + input[start:pos]
-	return
-}
-
 func (t *TextOutput) Compile(node xml.Node) {
 }
 
@@ -292,13 +212,50 @@ func (template *Template) CompileContent(node xml.Node) {
 			template.AddChild(res)
 		}
 	}
+	markTailCalls(template.Children)
+}
+
+// Mark the xsl:call-template instructions that are the last thing a
+// template does, either directly or as the last instruction of an xsl:if
+// or a branch of an xsl:choose that is itself last. Such calls are made
+// by the calling template's Apply rather than by the instruction, so
+// tail-recursive templates run in constant space.
+func markTailCalls(steps []CompiledStep) {
+	if len(steps) == 0 {
+		return
+	}
+	i, ok := steps[len(steps)-1].(*XsltInstruction)
+	if !ok {
+		return
+	}
+	switch i.Name {
+	case "call-template":
+		i.tail = true
+	case "if", "when", "otherwise":
+		markTailCalls(i.Children)
+	case "choose":
+		for _, c := range i.Children {
+			if branch, ok := c.(*XsltInstruction); ok {
+				markTailCalls(branch.Children)
+			}
+		}
+	}
+}
+
+// Instantiate a sequence constructor. The variables it declares are in
+// scope for their following siblings, and go out of scope at its end.
+func applySequence(steps []CompiledStep, node xml.Node, context *ExecutionContext) {
+	mark := len(context.bindings)
+	for _, c := range steps {
+		c.Apply(node, context)
+	}
+	context.unbind(mark)
 }
 
 func CompileSingleNode(node xml.Node) (step CompiledStep) {
 	switch node.NodeType() {
 	case xml.XML_ELEMENT_NODE:
 		ns := node.Namespace()
-		// element, extension namespace = extension
 		if ns == XSLT_NAMESPACE {
 			// element, XSLT namespace = instruction
 			switch node.Name() {
@@ -309,6 +266,9 @@ func CompileSingleNode(node xml.Node) (step CompiledStep) {
 			default:
 				step = &XsltInstruction{Name: node.Name(), Node: node}
 			}
+		} else if isExtensionElement(node) {
+			// element, extension namespace = extension
+			step = &ExtensionInstruction{Node: node}
 		} else {
 			// element other namespace = LRE
 			step = &LiteralResultElement{Node: node}
@@ -322,39 +282,48 @@ func CompileSingleNode(node xml.Node) (step CompiledStep) {
 	return
 }
 
-func selectParamValue(param *Variable, withParams []*Variable) (out *Variable) {
-	for _, p := range withParams {
-		if param.Name == p.Name {
-			return p
+// The value passed for a template parameter, if there is one.
+func paramValue(param *Variable, params []binding) (interface{}, bool) {
+	for _, p := range params {
+		if p.namespace == param.namespace && p.name == param.local {
+			return p.value, true
 		}
 	}
-	return param
+	return nil, false
 }
 
-func (template *Template) Apply(node xml.Node, context *ExecutionContext, params []*Variable) {
+// Instantiate the template for node, with the values of the xsl:with-param
+// elements of the instruction that invoked it.
+func (template *Template) Apply(node xml.Node, context *ExecutionContext, params []binding) {
 	//init local scope
-	oldStack := context.Stack
-	context.Stack = *new(list.List)
-	context.PushStack()
-
-	//for each node in compiled template body
-	// if xsl:message
-	// if forwards-compatible
-	//   apply fallback
-	for _, c := range template.Children {
-		context.Current = node
-		c.Apply(node, context)
-		switch v := c.(type) {
-		case *Variable:
+	frame := context.frame
+	for {
+		context.frame = len(context.bindings)
+		//for each node in compiled template body
+		// if xsl:message
+		// if forwards-compatible
+		//   apply fallback
+		for _, c := range template.Children {
+			context.Current = node
 			//populate any params (including those passed via with-params)
-			if IsXsltName(v.Node, "param") {
-				v = selectParamValue(v, params)
+			if v, ok := c.(*Variable); ok && v.param {
+				if value, ok := paramValue(v, params); ok {
+					context.bind(v.namespace, v.local, value)
+					continue
+				}
 			}
-			_ = context.DeclareLocalVariable(v.Name, "", v)
+			c.Apply(node, context)
+		}
+		// break out of loop if terminated by xsl:message
+		context.unbind(context.frame)
+		// a call-template in tail position replaces this invocation
+		call := context.tailCall
+		if call == nil {
+			break
 		}
+		context.tailCall = nil
+		template, params = call.template, call.params
 	}
-	// break out of loop if terminated by xsl:message
-	//restore any existing stack
-	context.PopStack()
-	context.Stack = oldStack
+	//restore the caller's frame
+	context.frame = frame
 }
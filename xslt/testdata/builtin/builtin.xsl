@@ -0,0 +1,14 @@
+<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="xml" omit-xml-declaration="yes"/>
+<xsl:template match="/">
+  <out>
+    <attrs><xsl:apply-templates select="doc/item/@*"/></attrs>
+    <text><xsl:apply-templates select="doc"/></text>
+    <marked><xsl:apply-templates select="doc" mode="m"/></marked>
+    <after><xsl:apply-templates select="doc/item"/></after>
+  </out>
+</xsl:template>
+<xsl:template match="b">{<xsl:apply-templates/>}</xsl:template>
+<xsl:template match="b" mode="m">[<xsl:apply-templates mode="m"/>|<xsl:apply-templates select="." mode="inner"/>|<xsl:apply-templates/>]</xsl:template>
+<xsl:template match="b" mode="inner">(inner)</xsl:template>
+</xsl:stylesheet>
@@ -0,0 +1,18 @@
+<?xml version="1.0" encoding="UTF-8" ?>
+<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="xml" indent="no"/>
+
+<xsl:param name="category" select="'fruit'"/>
+<xsl:variable name="total" select="count(//item)"/>
+<xsl:key name="by-category" match="item" use="@category"/>
+
+<xsl:template match="/">
+  <result category="{$category}" total="{$total}">
+    <xsl:for-each select="key('by-category', $category)">
+      <xsl:variable name="label" select="concat(@name, '-', position())"/>
+      <item><xsl:value-of select="$label"/></item>
+    </xsl:for-each>
+  </result>
+</xsl:template>
+
+</xsl:stylesheet>
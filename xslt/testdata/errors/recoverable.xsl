@@ -0,0 +1,11 @@
+<?xml version="1.0" encoding="UTF-8" ?>
+<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+
+<xsl:template match="/">
+  <result>
+    <xsl:for-each select="//item"><xsl:apply-imports/></xsl:for-each>
+    <xsl:value-of select="format-number(1, '#', 'missing')"/>
+  </result>
+</xsl:template>
+
+</xsl:stylesheet>
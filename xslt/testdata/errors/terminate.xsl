@@ -0,0 +1,12 @@
+<?xml version="1.0" encoding="UTF-8" ?>
+<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+
+<xsl:template match="/">
+  <result><xsl:apply-templates/></result>
+</xsl:template>
+
+<xsl:template match="item[@name='stop']">
+  <xsl:message terminate="yes">stopped at <xsl:value-of select="@name"/></xsl:message>
+</xsl:template>
+
+</xsl:stylesheet>
@@ -0,0 +1,17 @@
+<?xml version="1.0" encoding="UTF-8" ?>
+<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform"
+    xmlns:my="urn:x-test:elements" xmlns:un="urn:x-test:unregistered"
+    extension-element-prefixes="my un">
+  <xsl:output omit-xml-declaration="yes"/>
+  <xsl:template match="/">
+    <out>
+      <my:wrap name="greeting">hello <xsl:value-of select="/doc/@name"/><xsl:fallback>wrong</xsl:fallback></my:wrap>
+      <repeated><my:repeat times="3">[<xsl:value-of select="count(/doc/item)"/>]</my:repeat></repeated>
+      <fallback><un:missing>wrong<xsl:fallback>right</xsl:fallback></un:missing></fallback>
+      <scoped xmlns:lre="urn:x-test:elements" xsl:extension-element-prefixes="lre"><lre:repeat times="2">x</lre:repeat></scoped>
+      <available>
+        <xsl:value-of select="element-available('xsl:value-of')"/>,<xsl:value-of select="element-available('xsl:template')"/>,<xsl:value-of select="element-available('my:wrap')"/>,<xsl:value-of select="element-available('un:missing')"/>,<xsl:value-of select="element-available('out')"/>
+      </available>
+    </out>
+  </xsl:template>
+</xsl:stylesheet>
@@ -0,0 +1,20 @@
+<?xml version="1.0" encoding="UTF-8" ?>
+<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform"
+  xmlns:my="urn:x-test:functions" xmlns:other="urn:x-test:other"
+  exclude-result-prefixes="my other">
+<xsl:output omit-xml-declaration="yes"/>
+
+<xsl:template match="/">
+  <out>
+    <greet><xsl:value-of select="my:greet(/doc/@name)"/></greet>
+    <total><xsl:value-of select="my:total(/doc/item)"/></total>
+    <even><xsl:value-of select="my:even(4)"/>,<xsl:value-of select="my:even(3)"/></even>
+    <test><xsl:if test="my:even(3)">wrong</xsl:if><xsl:if test="my:even(2)">right</xsl:if></test>
+    <nodes><xsl:value-of select="count(my:alternate(/doc/item))"/>,<xsl:value-of select="my:alternate(/doc/item)[2]/@v"/></nodes>
+    <available>
+      <xsl:value-of select="function-available('my:greet')"/>,<xsl:value-of select="function-available('other:greet')"/>,<xsl:value-of select="function-available('concat')"/>,<xsl:value-of select="function-available('format-number')"/>
+    </available>
+  </out>
+</xsl:template>
+
+</xsl:stylesheet>
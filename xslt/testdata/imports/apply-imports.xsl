@@ -0,0 +1,30 @@
+<?xml version="1.0" encoding="UTF-8" ?>
+<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+
+<xsl:import href="theme.xsl" />
+
+<xsl:template match="/">
+  <body>
+    <xsl:apply-templates select="list/item" />
+    <xsl:apply-templates select="list/item" mode="summary" />
+    <xsl:apply-templates select="list/note" />
+  </body>
+</xsl:template>
+
+<xsl:template match="item">
+  <customer><xsl:apply-imports /></customer>
+</xsl:template>
+
+<xsl:template match="item" mode="summary">
+  <customer-summary><xsl:apply-imports /></customer-summary>
+</xsl:template>
+
+<xsl:template match="item[@name='plain']">
+  <plain><xsl:apply-imports /></plain>
+</xsl:template>
+
+<xsl:template match="note">
+  <note><xsl:apply-imports /></note>
+</xsl:template>
+
+</xsl:stylesheet>
@@ -0,0 +1,12 @@
+<?xml version="1.0" encoding="UTF-8" ?>
+<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+
+<xsl:template match="item">
+  <base><xsl:value-of select="@name" /></base>
+</xsl:template>
+
+<xsl:template match="item" mode="summary">
+  <summary><xsl:value-of select="@name" /></summary>
+</xsl:template>
+
+</xsl:stylesheet>
@@ -0,0 +1,10 @@
+<?xml version="1.0" encoding="UTF-8" ?>
+<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+
+<xsl:import href="base.xsl" />
+
+<xsl:template match="item">
+  <theme><xsl:apply-imports /></theme>
+</xsl:template>
+
+</xsl:stylesheet>
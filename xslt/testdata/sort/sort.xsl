@@ -0,0 +1,26 @@
+<?xml version="1.0" encoding="UTF-8"?>
+<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text" encoding="UTF-8"/>
+
+<xsl:template match="/products">
+  <xsl:text>codepoint: </xsl:text>
+  <xsl:for-each select="p"><xsl:sort/><xsl:value-of select="."/>,</xsl:for-each>
+  <xsl:text>&#10;de: </xsl:text>
+  <xsl:for-each select="p"><xsl:sort lang="de"/><xsl:value-of select="."/>,</xsl:for-each>
+  <xsl:text>&#10;sv: </xsl:text>
+  <xsl:for-each select="p"><xsl:sort lang="{@lang}"/><xsl:value-of select="."/>,</xsl:for-each>
+  <xsl:text>&#10;de upper-first: </xsl:text>
+  <xsl:for-each select="p"><xsl:sort lang="de" case-order="upper-first"/><xsl:value-of select="."/>,</xsl:for-each>
+  <xsl:text>&#10;lower-first: </xsl:text>
+  <xsl:for-each select="p"><xsl:sort case-order="lower-first"/><xsl:value-of select="."/>,</xsl:for-each>
+  <xsl:text>&#10;price: </xsl:text>
+  <xsl:apply-templates select="p"><xsl:sort select="@price" data-type="{'number'}"/></xsl:apply-templates>
+  <xsl:text>&#10;price descending: </xsl:text>
+  <xsl:apply-templates select="p"><xsl:sort select="@price" data-type="number" order="{@order}"/></xsl:apply-templates>
+  <xsl:text>&#10;price, then name: </xsl:text>
+  <xsl:apply-templates select="p"><xsl:sort select="@price" data-type="number"/><xsl:sort lang="de" order="descending"/></xsl:apply-templates>
+  <xsl:text>&#10;</xsl:text>
+</xsl:template>
+
+<xsl:template match="p"><xsl:value-of select="."/>,</xsl:template>
+</xsl:stylesheet>
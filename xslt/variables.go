@@ -0,0 +1,237 @@
+package xslt
+
+import (
+	"github.com/jbowtie/gokogiri/xml"
+	"strings"
+	"unicode/utf8"
+)
+
+// Variables and parameters are named by QNames, and two names are the
+// same if their expanded names are.
+
+// Resolve a QName in the stylesheet, such as the name of a variable or
+// decimal format, using the namespaces in scope at node. A prefix that hasn't
+// been declared is a static error.
+func resolveQName(node xml.Node, qname string) (ns, local string) {
+	colon := strings.Index(qname, ":")
+	if colon < 0 {
+		return "", qname
+	}
+	prefix := qname[:colon]
+	ns = lookupPrefix(node, prefix)
+	if ns == "" {
+		panic(newTransformError("XTSE0280", node, nil, nil, "undeclared namespace prefix %s in %s", prefix, qname))
+	}
+	return ns, qname[colon+1:]
+}
+
+// The key of a global variable in Stylesheet.Variables: the local name if
+// the variable is in no namespace, otherwise {namespace}name.
+func expandedName(ns, local string) string {
+	if ns == "" {
+		return local
+	}
+	return "{" + ns + "}" + local
+}
+
+// Find the global variable or parameter with the expanded name in the
+// stylesheet module or the modules it imports, or nil if there is none.
+func (style *Stylesheet) lookupVariable(ns, name string) *Variable {
+	if v, ok := style.Variables[expandedName(ns, name)]; ok {
+		return v
+	}
+	for _, s := range style.Imports {
+		if v := s.lookupVariable(ns, name); v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// The attributes of XSLT elements that hold expressions or patterns; the
+// others may be attribute value templates.
+var expressionAttributes = map[string]bool{
+	"select": true, "test": true, "value": true, "count": true, "from": true,
+	"use": true, "match": true,
+}
+
+// A local variable or parameter declared in the part of a template being
+// checked.
+type localBinding struct {
+	namespace string
+	name      string
+	param     bool
+}
+
+// Checks the variable references in the expressions of a stylesheet
+// against the variables in scope where they appear.
+type scopeChecker struct {
+	style  *Stylesheet // the principal stylesheet module, which can find every global variable
+	locals []localBinding
+}
+
+// Check that every variable referenced in the stylesheet has been
+// declared, either globally or earlier in the same template, and that no
+// binding in a template clashes with another. Violations are static errors,
+// raised as a panic.
+func (style *Stylesheet) checkVariables() {
+	c := &scopeChecker{style: style}
+	c.checkModule(style)
+}
+
+func (c *scopeChecker) checkModule(module *Stylesheet) {
+	for _, t := range module.templates {
+		c.locals = nil
+		if t.Node == nil {
+			// the literal result element of a simplified stylesheet
+			c.checkSequence(module.Doc)
+			continue
+		}
+		c.checkElement(t.Node)
+	}
+	for _, step := range module.compiled {
+		c.locals = nil
+		switch s := step.(type) {
+		case *Variable:
+			c.checkElement(s.Node)
+		case *XsltInstruction:
+			c.checkElement(s.Node)
+		}
+	}
+	for _, keys := range module.Keys {
+		for _, k := range keys {
+			c.locals = nil
+			c.checkElement(k.node)
+		}
+	}
+	for _, s := range module.Imports {
+		c.checkModule(s)
+	}
+}
+
+// Check the children of node, each of which can see the variables
+// declared by its preceding siblings.
+func (c *scopeChecker) checkSequence(node xml.Node) {
+	mark := len(c.locals)
+	var withParams []localBinding
+	for cur := node.FirstChild(); cur != nil; cur = cur.NextSibling() {
+		if cur.NodeType() != xml.XML_ELEMENT_NODE {
+			continue
+		}
+		c.checkElement(cur)
+		switch {
+		case IsXsltName(cur, "variable"), IsXsltName(cur, "param"):
+			c.declare(cur)
+		case IsXsltName(cur, "with-param"):
+			ns, name := resolveQName(cur, cur.Attr("name"))
+			for _, p := range withParams {
+				if p.namespace == ns && p.name == name {
+					panic(newTransformError("XTSE0670", cur, nil, nil, "duplicate parameter %s", cur.Attr("name")))
+				}
+			}
+			withParams = append(withParams, localBinding{ns, name, true})
+		}
+	}
+	c.locals = c.locals[:mark]
+}
+
+// Bring the variable or parameter declared by node into scope.
+func (c *scopeChecker) declare(node xml.Node) {
+	param := IsXsltName(node, "param")
+	ns, name := resolveQName(node, node.Attr("name"))
+	for _, b := range c.locals {
+		if b.namespace != ns || b.name != name {
+			continue
+		}
+		if param && b.param {
+			panic(newTransformError("XTSE0580", node, nil, nil, "duplicate parameter %s", node.Attr("name")))
+		}
+		panic(newTransformError("", node, nil, nil, "%s shadows another variable in the same template", node.Attr("name")))
+	}
+	c.locals = append(c.locals, localBinding{ns, name, param})
+}
+
+// Check the expressions in the attributes of node and its content.
+func (c *scopeChecker) checkElement(node xml.Node) {
+	switch {
+	case node.Namespace() == XSLT_NAMESPACE:
+		if node.Name() == "text" {
+			return
+		}
+		for _, attr := range node.AttributeList() {
+			if expressionAttributes[attr.Name()] {
+				c.checkExpression(node, attr.Name(), attr.Content())
+			} else {
+				c.checkAVT(node, attr.Name(), attr.Content())
+			}
+		}
+	case !isExtensionElement(node):
+		// only the attributes of a literal result element are known to be
+		// attribute value templates
+		for _, attr := range node.AttributeList() {
+			if attr.Namespace() != XSLT_NAMESPACE {
+				c.checkAVT(node, attr.Name(), attr.Content())
+			}
+		}
+	}
+	c.checkSequence(node)
+}
+
+func (c *scopeChecker) checkAVT(node xml.Node, attr, value string) {
+	for _, expr := range avtExpressions(value) {
+		c.checkExpression(node, attr, expr)
+	}
+}
+
+// Check that the variables referenced by an expression are in scope.
+func (c *scopeChecker) checkExpression(node xml.Node, attr, expr string) {
+	for _, qname := range variableReferences(expr) {
+		ns, name := "", qname
+		if colon := strings.Index(qname, ":"); colon >= 0 {
+			ns, name = lookupPrefix(node, qname[:colon]), qname[colon+1:]
+		}
+		if !c.inScope(ns, name) {
+			panic(newTransformError("XPST0008", node, nil, nil, "variable $%s is not declared (in %s=%q)", qname, attr, expr))
+		}
+	}
+}
+
+func (c *scopeChecker) inScope(ns, name string) bool {
+	for _, b := range c.locals {
+		if b.namespace == ns && b.name == name {
+			return true
+		}
+	}
+	return c.style.lookupVariable(ns, name) != nil
+}
+
+// The names of the variables referenced in an XPath expression, as written.
+func variableReferences(expr string) (names []string) {
+	var quote byte
+	for pos := 0; pos < len(expr); pos++ {
+		c := expr[pos]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '$':
+			start := pos + 1
+			end := start
+			for end < len(expr) {
+				r, width := utf8.DecodeRuneInString(expr[end:])
+				if !(isNameChar(r) || r == ':') || (end == start && !isNameStartChar(r)) {
+					break
+				}
+				end += width
+			}
+			if end > start {
+				names = append(names, expr[start:end])
+			}
+			pos = end - 1
+		}
+	}
+	return
+}
@@ -0,0 +1,286 @@
+package xslt
+
+import (
+	"github.com/jbowtie/gokogiri/xml"
+	"runtime"
+	"testing"
+)
+
+// Each invocation of a template and each iteration of xsl:for-each has
+// its own bindings, so recursion doesn't clobber the caller's variables.
+func TestVariableFrames(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:template match="n">
+  <xsl:variable name="id" select="@id"/>
+  <xsl:text>(</xsl:text>
+  <xsl:apply-templates select="n"/>
+  <xsl:value-of select="$id"/>
+  <xsl:text>)</xsl:text>
+</xsl:template>
+<xsl:template match="/">
+  <xsl:apply-templates select="doc/n"/>
+  <xsl:for-each select="//n">
+    <xsl:variable name="depth" select="count(ancestor::n)"/>
+    <xsl:if test="$depth > 0"><xsl:variable name="id" select="@id"/>[<xsl:value-of select="$id"/>]</xsl:if>
+    <xsl:value-of select="$depth"/>
+  </xsl:for-each>
+</xsl:template>
+</xsl:stylesheet>`
+	stylesheet, doc := parseTransformTest(t, xsl, `<doc><n id="a"><n id="b"><n id="c"/></n><n id="d"/></n></doc>`)
+	defer stylesheet.Close()
+	defer doc.Free()
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "(((c)b)(d)a)0[b]1[c]2[d]1"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
+// Variables and parameters are matched by expanded name, whatever prefix
+// is used to refer to them.
+func TestVariableNamespaces(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform" xmlns:a="urn:v" xmlns:b="urn:v">
+<xsl:output method="text"/>
+<xsl:param name="a:g" select="'global'"/>
+<xsl:template name="t">
+  <xsl:param name="a:p" select="'default'"/>
+  <xsl:param name="p" select="'unprefixed'"/>
+  <xsl:value-of select="concat($b:p, ' ', $p, ' ', $b:g)"/>
+</xsl:template>
+<xsl:template match="/">
+  <xsl:call-template name="t">
+    <xsl:with-param name="b:p" select="'passed'"/>
+  </xsl:call-template>
+</xsl:template>
+</xsl:stylesheet>`
+	stylesheet, doc := parseTransformTest(t, xsl, "<doc/>")
+	defer stylesheet.Close()
+	defer doc.Free()
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "passed unprefixed global"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+	output, _ = stylesheet.Process(doc, StylesheetOptions{Parameters: map[string]interface{}{"{urn:v}g": "supplied"}})
+	if want := "passed unprefixed supplied"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
+// References to variables that aren't in scope and clashing declarations
+// are reported when the stylesheet is compiled.
+func TestVariableStaticErrors(t *testing.T) {
+	tests := []struct {
+		code string
+		body string
+	}{
+		{"XPST0008", `<xsl:template match="/"><xsl:value-of select="$missing"/></xsl:template>`},
+		{"XPST0008", `<xsl:template match="/"><xsl:value-of select="$later"/><xsl:variable name="later"/></xsl:template>`},
+		{"XPST0008", `<xsl:template match="/"><xsl:if test="1"><xsl:variable name="inner"/></xsl:if><a href="{$inner}"/></xsl:template>`},
+		{"XPST0008", `<xsl:template match="/"><xsl:variable name="self" select="$self"/></xsl:template>`},
+		{"XPST0008", `<xsl:template match="/"><xsl:variable name="x" select="1"/></xsl:template><xsl:template name="t"><xsl:value-of select="$x"/></xsl:template>`},
+		{"XTSE0580", `<xsl:template name="t"><xsl:param name="p"/><xsl:param name="p"/></xsl:template>`},
+		{"XTSE0630", `<xsl:variable name="g"/><xsl:param name="g"/>`},
+		{"XTSE0670", `<xsl:template match="/"><xsl:call-template name="t"><xsl:with-param name="p"/><xsl:with-param name="p"/></xsl:call-template></xsl:template><xsl:template name="t"/>`},
+		{"", `<xsl:template match="/"><xsl:variable name="v"/><xsl:for-each select="*"><xsl:variable name="v"/></xsl:for-each></xsl:template>`},
+		{"XTSE0280", `<xsl:variable name="nope:v"/>`},
+	}
+	for _, test := range tests {
+		xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">` + test.body + `</xsl:stylesheet>`
+		style, _ := xml.Parse([]byte(xsl), nil, nil, xml.StrictParseOption, nil)
+		_, err := ParseStylesheet(style, "")
+		style.Free()
+		if terr, ok := err.(*TransformError); !ok || terr.Code != test.code {
+			t.Errorf("%s: expected %q, got %v", test.body, test.code, err)
+		}
+	}
+}
+
+// Global variables can be referenced before they are declared, and from
+// any module; string literals that look like references are not.
+func TestVariableGlobalReferences(t *testing.T) {
+	resolver := mapResolver{
+		"main.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:import href="lib.xsl"/>
+<xsl:output method="text"/>
+<xsl:template match="/"><xsl:value-of select="concat($main, '$none', $lib)"/> <xsl:call-template name="lib"/></xsl:template>
+<xsl:variable name="main" select="'main'"/>
+</xsl:stylesheet>`,
+		"lib.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:variable name="lib" select="'lib'"/>
+<xsl:template name="lib"><xsl:value-of select="$main"/></xsl:template>
+</xsl:stylesheet>`,
+	}
+	style, _ := loadDocument(resolver, "main.xsl")
+	defer style.Free()
+	stylesheet, err := ParseStylesheetWithResolver(style, "main.xsl", resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stylesheet.Close()
+}
+
+// A named template that calls itself as the last thing it does runs in
+// constant space, however deep the recursion: when it finishes, neither the
+// variable bindings nor the Go stack are any larger than for a shallow call.
+func TestTailRecursion(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform" xmlns:d="urn:x-test:depth">
+<xsl:output method="text"/>
+<xsl:template name="count">
+  <xsl:param name="n"/>
+  <xsl:param name="total" select="0"/>
+  <xsl:choose>
+    <xsl:when test="$n = 0"><xsl:value-of select="d:depth()"/><xsl:value-of select="$total"/></xsl:when>
+    <xsl:otherwise>
+      <xsl:variable name="next" select="$n - 1"/>
+      <xsl:if test="$n mod 10000 = 0">.</xsl:if>
+      <xsl:call-template name="count">
+        <xsl:with-param name="n" select="$next"/>
+        <xsl:with-param name="total" select="$total + 1"/>
+      </xsl:call-template>
+    </xsl:otherwise>
+  </xsl:choose>
+</xsl:template>
+<xsl:template match="/">
+  <xsl:call-template name="count"><xsl:with-param name="n" select="50000"/></xsl:call-template>
+  <xsl:text>|</xsl:text>
+  <xsl:call-template name="count"><xsl:with-param name="n" select="3"/></xsl:call-template>
+  <xsl:text>|</xsl:text>
+</xsl:template>
+</xsl:stylesheet>`
+	stylesheet, doc := parseTransformTest(t, xsl, "<doc/>")
+	defer stylesheet.Close()
+	defer doc.Free()
+	var bindings, stack []int
+	depth := func(c *ExecutionContext, args FunctionArgs) (interface{}, error) {
+		bindings = append(bindings, len(c.bindings))
+		stack = append(stack, runtime.Callers(0, make([]uintptr, 10000)))
+		return "", nil
+	}
+	if err := stylesheet.RegisterFunction("urn:x-test:depth", "depth", depth); err != nil {
+		t.Fatal(err)
+	}
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ".....50000|3|"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+	if len(bindings) != 2 || bindings[0] != bindings[1] {
+		t.Errorf("variable bindings at the deepest call grow with the recursion: %v", bindings)
+	}
+	if len(stack) != 2 || stack[0] != stack[1] {
+		t.Errorf("stack depth at the deepest call grows with the recursion: %v", stack)
+	}
+}
+
+// Global variables are evaluated when first referenced, whatever order they
+// are declared in, after the supplied parameters are in place. Variables
+// that are never referenced are never evaluated.
+func TestGlobalVariablesLazy(t *testing.T) {
+	xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output method="text"/>
+<xsl:variable name="a" select="concat($b, '!')"/>
+<xsl:variable name="b" select="$p * 2"/>
+<xsl:param name="p" select="1"/>
+<xsl:variable name="x" select="'global'"/>
+<xsl:variable name="g" select="$x"/>
+<xsl:variable name="unused" select="document('missing.xml')"/>
+<xsl:template match="/">
+  <xsl:variable name="x" select="'local'"/>
+  <xsl:value-of select="concat($a, ' ', $g, ' ', $x)"/>
+</xsl:template>
+</xsl:stylesheet>`
+	stylesheet, doc := parseTransformTest(t, xsl, "<doc/>")
+	defer stylesheet.Close()
+	defer doc.Free()
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2! global local"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+	output, err = stylesheet.Process(doc, StylesheetOptions{Parameters: map[string]interface{}{"p": 5.0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "10! global local"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
+// A reference to a global variable is to the declaration with the highest
+// import precedence, wherever the reference is.
+func TestGlobalVariablesImported(t *testing.T) {
+	resolver := mapResolver{
+		"main.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:import href="a.xsl"/>
+<xsl:import href="b.xsl"/>
+<xsl:output method="text"/>
+<xsl:variable name="w" select="'main w'"/>
+<xsl:template match="/"><xsl:value-of select="concat($v, ', ', $w, ', ', $x)"/></xsl:template>
+</xsl:stylesheet>`,
+		"a.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:variable name="v" select="'a v'"/>
+<xsl:variable name="w" select="'a w'"/>
+<xsl:variable name="x" select="concat('a x with ', $v, ' and ', $w)"/>
+</xsl:stylesheet>`,
+		"b.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:import href="c.xsl"/>
+<xsl:variable name="v" select="'b v'"/>
+</xsl:stylesheet>`,
+		"c.xsl": `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:variable name="x" select="'c x'"/>
+</xsl:stylesheet>`,
+	}
+	style, _ := loadDocument(resolver, "main.xsl")
+	defer style.Free()
+	stylesheet, err := ParseStylesheetWithResolver(style, "main.xsl", resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stylesheet.Close()
+	doc, _ := xml.Parse([]byte("<doc/>"), nil, nil, xml.StrictParseOption, nil)
+	defer doc.Free()
+	output, err := stylesheet.Process(doc, StylesheetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "b v, main w, c x"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
+// A global variable whose value depends on itself is a non-recoverable
+// error, even when an ErrorHandler would let the transformation continue.
+func TestGlobalVariablesCircular(t *testing.T) {
+	for _, decls := range []string{
+		`<xsl:variable name="a" select="$a"/>`,
+		`<xsl:variable name="a" select="$b"/><xsl:param name="b"><xsl:value-of select="$a"/></xsl:param>`,
+		`<xsl:variable name="a" select="key('k', 'x')"/><xsl:key name="k" match="doc" use="$a"/>`,
+	} {
+		xsl := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">` + decls + `
+<xsl:output method="text"/>
+<xsl:template match="/">before<xsl:value-of select="$a"/>after</xsl:template>
+</xsl:stylesheet>`
+		stylesheet, doc := parseTransformTest(t, xsl, "<doc/>")
+		for _, handler := range []func(*TransformError){nil, func(*TransformError) {}} {
+			output, err := stylesheet.Process(doc, StylesheetOptions{ErrorHandler: handler})
+			if terr, ok := err.(*TransformError); !ok || terr.Code != "XTDE0640" {
+				t.Errorf("%s: expected XTDE0640, got %v", decls, err)
+			}
+			if output != "" {
+				t.Errorf("%s: expected no output, got %q", decls, output)
+			}
+		}
+		stylesheet.Close()
+		doc.Free()
+	}
+}